@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/chunk-analysis/internal"
+	"github.com/weiihann/chunk-analysis/internal/logger"
+)
+
+var convertCmd = &cobra.Command{
+	Use:   "convert-traces [dir]",
+	Short: "Convert JSON trace files to the compact binary format",
+	Long:  `Convert the block_N_trace.json files of a directory, TRACE_DIR by default, to the compact binary trace format read by the analyzer.`,
+	Args:  cobra.MaximumNArgs(1),
+	Run:   executeConvert,
+}
+
+func init() {
+	convertCmd.Flags().Bool("remove", false, "Remove the JSON files once converted")
+}
+
+func executeConvert(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("convert")
+
+	var dir string
+	if len(args) == 1 {
+		dir = args[0]
+	} else {
+		config, err := internal.LoadConfig("./configs")
+		if err != nil {
+			log.Error("Configuration validation failed", "error", err)
+			os.Exit(1)
+		}
+		dir = config.TraceDir
+	}
+
+	remove, err := cmd.Flags().GetBool("remove")
+	if err != nil {
+		log.Error("Invalid flag", "error", err)
+		os.Exit(1)
+	}
+
+	converted, err := internal.ConvertTraceDir(dir, remove)
+	if err != nil {
+		log.Error("Failed to convert traces", "dir", dir, "converted", converted, "error", err)
+		os.Exit(1)
+	}
+	log.Info("Converted traces", "dir", dir, "converted", converted)
+}
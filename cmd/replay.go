@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/chunk-analysis/internal"
+	"github.com/weiihann/chunk-analysis/internal/logger"
+)
+
+var dumpReplayCmd = &cobra.Command{
+	Use:   "dump-replay <block>...",
+	Short: "Dump the replay files of blocks for offline analysis",
+	Long:  `Fetch the given blocks and their prestate from the RPC endpoints, and write them to TRACE_DIR as block_N_replay.json files, which TRACER=replay executes locally without a node.`,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   executeDumpReplay,
+}
+
+func executeDumpReplay(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("replay")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(config.TraceDir, 0o755); err != nil {
+		log.Error("Failed to create trace directory", "dir", config.TraceDir, "error", err)
+		os.Exit(1)
+	}
+
+	pool, err := internal.NewRpcPool(config.RPCURLs, context.Background(), &config)
+	if err != nil {
+		log.Error("Failed to create rpc pool", "error", err)
+		os.Exit(1)
+	}
+	defer pool.Close()
+
+	for _, arg := range args {
+		blockNum, err := strconv.ParseUint(arg, 0, 64)
+		if err != nil {
+			log.Error("Invalid block number", "block", arg, "error", err)
+			os.Exit(1)
+		}
+
+		block, err := pool.ReplayBlock(blockNum)
+		if err != nil {
+			log.Error("Failed to fetch block", "block", blockNum, "error", err)
+			os.Exit(1)
+		}
+		if err := internal.WriteReplayBlock(config.TraceDir, block); err != nil {
+			log.Error("Failed to write replay file", "block", blockNum, "error", err)
+			os.Exit(1)
+		}
+		log.Info("Dumped replay file", "block", blockNum, "txs", len(block.Transactions), "accounts", len(block.Prestate))
+	}
+}
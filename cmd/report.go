@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/chunk-analysis/internal"
+	"github.com/weiihann/chunk-analysis/internal/logger"
+	"github.com/weiihann/chunk-analysis/internal/reader"
+	"github.com/weiihann/chunk-analysis/internal/report"
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report [dir]...",
+	Short: "Print the summary statistics of result files",
+	Long:  `Read the analysis-N.csv files of the given result directories, RESULT_DIR by default, and print the proportion of the code accessed in bytes and chunks by contract size, the use of CODESIZE and CODECOPY, and the chunk efficiency.`,
+	Run:   executeReport,
+}
+
+func init() {
+	reportCmd.Flags().String("format", report.FormatTable, "Output format: table, json or markdown")
+	reportCmd.Flags().String("output", "", "Write the report to this file instead of stdout")
+	reportCmd.Flags().Bool("merge", false, "Count every contract once, merged over the blocks it was accessed in")
+}
+
+func executeReport(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("report")
+
+	dirs := args
+	if len(dirs) == 0 {
+		config, err := internal.LoadConfig("./configs")
+		if err != nil {
+			log.Error("Configuration validation failed", "error", err)
+			os.Exit(1)
+		}
+		dirs = []string{config.ResultDir}
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil || !slices.Contains(report.Formats(), format) {
+		log.Error("Invalid flag", "format", format, "error", err)
+		os.Exit(1)
+	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		log.Error("Invalid flag", "error", err)
+		os.Exit(1)
+	}
+	merge, err := cmd.Flags().GetBool("merge")
+	if err != nil {
+		log.Error("Invalid flag", "error", err)
+		os.Exit(1)
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		files, err := reader.Files(dir)
+		if err != nil {
+			log.Error("Failed to list result files", "dir", dir, "error", err)
+			os.Exit(1)
+		}
+		paths = append(paths, files...)
+	}
+
+	r, err := report.Build(paths, merge)
+	if err != nil {
+		log.Error("Failed to build report", "dirs", dirs, "error", err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			log.Error("Failed to create output file", "output", output, "error", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := report.Write(w, r, format); err != nil {
+		log.Error("Failed to write report", "error", err)
+		os.Exit(1)
+	}
+}
@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/weiihann/chunk-analysis/internal"
 )
 
 var rootCmd = &cobra.Command{
@@ -14,9 +16,14 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(convertCmd)
+	rootCmd.AddCommand(dumpReplayCmd)
+	rootCmd.AddCommand(reportCmd)
 }
 
-func Execute() {
+func Execute(version, buildTime string) {
+	internal.Version = version
+	rootCmd.Version = fmt.Sprintf("%s (built %s)", version, buildTime)
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
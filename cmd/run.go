@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/weiihann/chunk-analysis/internal"
 	"github.com/weiihann/chunk-analysis/internal/logger"
 )
@@ -18,6 +19,13 @@ var runCmd = &cobra.Command{
 	Run:   executeRun,
 }
 
+func init() {
+	runCmd.Flags().Bool("resume", false, "Skip the blocks in the workers' checkpoints and roll their output files back to them, instead of starting over")
+	if err := viper.BindPFlag("RESUME", runCmd.Flags().Lookup("resume")); err != nil {
+		panic(err)
+	}
+}
+
 func executeRun(cmd *cobra.Command, args []string) {
 	log := logger.GetLogger("run")
 
@@ -3,14 +3,21 @@ package internal
 import (
 	"fmt"
 	"log/slog"
+	"math/big"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/hashicorp/golang-lru"
 	"github.com/weiihann/chunk-analysis/internal/logger"
+	"github.com/weiihann/chunk-analysis/internal/treekey"
+	"github.com/weiihann/chunk-analysis/internal/witness"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -26,49 +33,102 @@ const (
 	OpCall         = "CALL"         // address at stack[top-1]
 	OpCallCode     = "CALLCODE"     // address at stack[top-1]
 	OpStaticCall   = "STATICCALL"   // address at stack[top-1]
+	OpCreate       = "CREATE"       // initcode size at stack[top-2]
+	OpCreate2      = "CREATE2"      // initcode size at stack[top-2]
 )
 
 type Analyzer struct {
-	client    *RpcClient
+	client    *RpcPool
 	retriever *TraceRetriever
 	log       *slog.Logger
 	codeCache *lru.Cache // This should be shared, or just put into the rpc client
+	schedule  witness.Schedule
+	chunkSize uint32
 }
 
 type TraceResult struct {
-	Addr common.Address
-	Bits *BitSet
-	Skip bool // Skip this result if it's either a create or self destruct
+	Addr     common.Address
+	Bits     *BitSet
+	CopyBits *BitSet // Bytes copied by CODECOPY/EXTCODECOPY, kept apart from executed bytes
+	Skip     bool    // Skip this result if it's either a failed create or self destruct
+
+	InitCodeHash common.Hash // Set if this is initcode executed by a contract creation rather than deployed code
+	CodeHash     common.Hash // Hash of the deployed code, unset for initcode
 
 	// These opcodes access the entire contract code, keep them separate so we can distinguish between
 	// actual code access from the other opcodes versus just these ones.
 	// 0 means no call to this opcode was made.
 	CodeSizeCount int // CODESIZE, EXTCODESIZE
 	CodeCopyCount int // CODECOPY, EXTCODECOPY
+
+	WitnessGas uint64 // Simulated EIP-4762 code access gas within the transaction
+}
+
+// IsInitCode reports whether the result belongs to initcode rather than deployed code.
+func (t *TraceResult) IsInitCode() bool {
+	return t.InitCodeHash != (common.Hash{})
+}
+
+// AccessedChunks returns the chunks touched either by execution or by CODECOPY/EXTCODECOPY.
+func (t *TraceResult) AccessedChunks() []uint32 {
+	return accessedChunks(t.Bits, t.CopyBits, t.Bits.ChunkSize())
+}
+
+// Stems returns the tree stems touched by the accessed chunks under EIP-6800/EIP-7864.
+func (t *TraceResult) Stems() treekey.Stems {
+	return treekey.CountStems(t.AccessedChunks())
 }
 
 func (t *TraceResult) String() string {
 	if t.Skip {
 		return fmt.Sprintf("Addr: %s, Skip: true", t.Addr.Hex())
 	}
-	return fmt.Sprintf("Addr: %s, Bits: %d, Chunks: %d, CodeSizeCount: %d, CodeCopyCount: %d",
+	return fmt.Sprintf("Addr: %s, Bits: %d, Chunks: %d, CopyBits: %d, CodeSizeCount: %d, CodeCopyCount: %d, WitnessGas: %d",
 		t.Addr.Hex(),
 		t.Bits.Count(),
 		t.Bits.ChunkCount(),
+		t.CopyBits.Count(),
 		t.CodeSizeCount,
 		t.CodeCopyCount,
+		t.WitnessGas,
 	)
 }
 
 type Code struct {
-	addr common.Address
-	code []byte
+	addr         common.Address
+	code         []byte
+	hash         common.Hash
+	initCodeHash common.Hash // Only set for initcode, which is identified by its hash instead of an address
+}
+
+func newCode(addr common.Address, code []byte) *Code {
+	return &Code{
+		addr: addr,
+		code: code,
+		hash: crypto.Keccak256Hash(code),
+	}
+}
+
+func newInitCode(initCode []byte) *Code {
+	return &Code{
+		code:         initCode,
+		initCodeHash: crypto.Keccak256Hash(initCode),
+	}
 }
 
-func newTraceResult(code *Code) *TraceResult {
+func newTraceResult(code *Code, chunkSize uint32) *TraceResult {
+	if code.initCodeHash != (common.Hash{}) {
+		return &TraceResult{
+			Bits:         NewInitCodeBitSet(uint32(len(code.code)), chunkSize),
+			CopyBits:     NewInitCodeBitSet(uint32(len(code.code)), chunkSize),
+			InitCodeHash: code.initCodeHash,
+		}
+	}
 	return &TraceResult{
-		Addr: code.addr,
-		Bits: NewBitSet(uint32(len(code.code))),
+		Addr:     code.addr,
+		Bits:     NewBitSet(uint32(len(code.code)), chunkSize),
+		CopyBits: NewBitSet(uint32(len(code.code)), chunkSize),
+		CodeHash: code.hash,
 	}
 }
 
@@ -78,130 +138,272 @@ func newTraceResultSkip() *TraceResult {
 	}
 }
 
-func NewAnalyzer(id int, client *RpcClient, retriever *TraceRetriever, codeCache *lru.Cache) *Analyzer {
+func NewAnalyzer(id int, client *RpcPool, retriever *TraceRetriever, codeCache *lru.Cache, schedule witness.Schedule, chunkSize uint32) *Analyzer {
 	return &Analyzer{
 		client:    client,
 		retriever: retriever,
 		log:       logger.GetLogger(fmt.Sprintf("analyzer-%d", id)),
 		codeCache: codeCache,
+		schedule:  schedule,
+		chunkSize: chunkSize,
 	}
 }
 
 type BlockResult struct {
-	BlockNum uint64
-	Results  map[common.Address]*MergedTraceResult
+	BlockNum  uint64
+	Results   map[common.Address]*MergedTraceResult
+	InitCodes map[common.Hash]*MergedTraceResult // Initcode executed by contract creations, keyed by initcode hash
+	Txs       []TxResult                         // Per-transaction results, ordered by transaction index
+}
+
+// TxResult holds the code accessed by a single transaction, before merging it into the block.
+type TxResult struct {
+	TxHash     string
+	TxIndex    int
+	TxType     uint8 // EIP-2718 transaction type
+	Results    map[common.Address]*TraceResult
+	InitCodes  map[common.Hash]*TraceResult
+	WitnessGas uint64
 }
 
 type MergedTraceResult struct {
+	CodeHash      common.Hash // Hash of the code first accessed in the block, unset for initcode
 	Bits          *BitSet
+	CopyBits      *BitSet
 	CodeSizeCount int
 	CodeCopyCount int
+	WitnessGas    uint64 // Sum of the per-transaction witness gas, as every transaction starts cold
+}
+
+// Merge adds the accesses and counters of other, which must be of the same code
+func (m *MergedTraceResult) Merge(other *MergedTraceResult) {
+	m.Bits.Merge(other.Bits)
+	m.CopyBits = mergeCopyBits(m.CopyBits, other.CopyBits)
+	m.CodeSizeCount += other.CodeSizeCount
+	m.CodeCopyCount += other.CodeCopyCount
+	m.WitnessGas += other.WitnessGas
+}
+
+// AccessedChunks returns the chunks touched either by execution or by CODECOPY/EXTCODECOPY,
+// which are the chunks that end up in the witness.
+func (m *MergedTraceResult) AccessedChunks() []uint32 {
+	return accessedChunks(m.Bits, m.CopyBits, m.Bits.ChunkSize())
+}
+
+// AccessedChunksFor is the same as AccessedChunks, for the given chunk size.
+func (m *MergedTraceResult) AccessedChunksFor(chunkSize uint32) []uint32 {
+	return accessedChunks(m.Bits, m.CopyBits, chunkSize)
+}
+
+// Stems returns the tree stems touched by the accessed chunks under EIP-6800/EIP-7864.
+func (m *MergedTraceResult) Stems() treekey.Stems {
+	return treekey.CountStems(m.AccessedChunks())
 }
 
 func (a *Analyzer) Analyze(blockNum uint64, trace []TransactionTrace) (BlockResult, error) {
-	// Aggregate the results and send it back
-	// Merge all results per contract
-	aggregated := make(map[common.Address]*MergedTraceResult)
-	var mu sync.Mutex
-	merge := func(result map[common.Address]*TraceResult) {
-		mu.Lock()
-		defer mu.Unlock()
-		for addr, res := range result {
-			if existing, exists := aggregated[addr]; exists {
-				existing.Bits.Merge(res.Bits)
-				existing.CodeSizeCount += res.CodeSizeCount
-				existing.CodeCopyCount += res.CodeCopyCount
-			} else {
-				aggregated[addr] = &MergedTraceResult{
-					Bits:          res.Bits,
-					CodeSizeCount: res.CodeSizeCount,
-					CodeCopyCount: res.CodeCopyCount,
-				}
-			}
-		}
+	return a.AnalyzeStream(blockNum, NewSliceTraceStream(trace))
+}
+
+// AnalyzeStream analyzes the transactions of the block as they are read from the stream, one window of
+// transactions at a time so that their RPC lookups are batched. At most two transactions per CPU are held
+// in memory, the window and the ones being analyzed, so the peak memory is bounded by the largest
+// transactions rather than by the block.
+func (a *Analyzer) AnalyzeStream(blockNum uint64, stream TraceStream) (BlockResult, error) {
+	// Analyze every transaction separately, the block view is derived from the per-transaction results
+	var (
+		mu  sync.Mutex
+		txs []TxResult
+	)
+	deployments := make(map[common.Address]int)
+	initCodes := a.newBlockInitCodes(blockNum)
+	blockTxs, err := a.retriever.GetBlockTxs(blockNum)
+	if err != nil {
+		return BlockResult{}, err
+	}
+	codes, err := a.retriever.GetCodes(blockNum)
+	if err != nil {
+		return BlockResult{}, err
 	}
 
-	// ---- Uncomment below to debug
 	var workers errgroup.Group
 	workers.SetLimit(runtime.NumCPU())
-	for _, tx := range trace {
-		workers.Go(func() error {
-			// fmt.Printf("analyzing tx %d\n", i)
-			res, err := a.analyze(&tx, blockNum)
-			if err != nil {
-				return err
+	for i := 0; ; {
+		window, err := readWindow(stream, runtime.NumCPU())
+		if err != nil {
+			workers.Wait()
+			return BlockResult{}, err
+		}
+		if len(window) == 0 {
+			break
+		}
+
+		// Transactions are read in order, so the deployments of the earlier ones are already known
+		views := make([]stateView, len(window))
+		windowTxs := make([]BlockTx, len(window))
+		txInitCodes := make([][][]byte, len(window))
+		for j, tx := range window {
+			if windowTxs[j], err = lookupBlockTx(blockTxs, tx.TxHash, blockNum, i+j); err != nil {
+				workers.Wait()
+				return BlockResult{}, err
+			}
+			addDeployments(deployments, i+j, windowTxs[j], &tx.Result)
+			views[j] = newStateView(blockNum, i+j, deployments, windowTxs[j], codes)
+			if txInitCodes[j], err = initCodes.forTx(i+j, tx); err != nil {
+				workers.Wait()
+				return BlockResult{}, err
 			}
-			merge(res)
-			return nil
-		})
+		}
+		if err := a.prefetch(window, views, windowTxs); err != nil {
+			workers.Wait()
+			return BlockResult{}, err
+		}
+
+		for j, tx := range window {
+			txIndex := i + j
+			workers.Go(func() error {
+				res, err := a.analyze(tx, views[j], txInitCodes[j], windowTxs[j])
+				if err != nil {
+					return err
+				}
+				txResult := a.newTxResult(tx.TxHash, txIndex, uint8(windowTxs[j].Type), res)
+
+				mu.Lock()
+				txs = append(txs, txResult)
+				mu.Unlock()
+				return nil
+			})
+		}
+		i += len(window)
 	}
 
 	if err := workers.Wait(); err != nil {
 		return BlockResult{}, err
 	}
+	if err := initCodes.checkCount(len(txs)); err != nil {
+		return BlockResult{}, err
+	}
+	if err := a.retriever.PutCodes(blockNum, codes); err != nil {
+		return BlockResult{}, err
+	}
+	slices.SortFunc(txs, func(x, y TxResult) int { return x.TxIndex - y.TxIndex })
 
-	// ---- Uncomment below to debug
-	// for i, tx := range trace {
-	// 	fmt.Printf("analyzing tx %d\n", i)
-	// 	res, err := a.analyze(&tx, blockNum)
-	// 	if err != nil {
-	// 		return BlockResult{}, err
-	// 	}
-	// 	merge(res)
-	// }
-
-	// ---- Uncomment below to debug
-	// targetTrace := trace[141]
-	// fmt.Println(targetTrace.TxHash)
-	// res, err := a.analyze(&targetTrace, blockNum)
-	// if err != nil {
-	// 	return BlockResult{}, err
-	// }
-	// merge(res)
+	return newBlockResult(blockNum, txs), nil
+}
 
+// newBlockResult merges the per-transaction results, ordered by transaction index, into the block result
+func newBlockResult(blockNum uint64, txs []TxResult) BlockResult {
+	results, initCodes := MergeTxResults(txs)
 	return BlockResult{
-		BlockNum: blockNum,
-		Results:  aggregated,
-	}, nil
+		BlockNum:  blockNum,
+		Results:   results,
+		InitCodes: initCodes,
+		Txs:       txs,
+	}
+}
+
+// MergeTxResults merges the per-transaction results into one result per contract and one per initcode.
+// The per-transaction results are left untouched.
+func MergeTxResults(txs []TxResult) (map[common.Address]*MergedTraceResult, map[common.Hash]*MergedTraceResult) {
+	aggregated := make(map[common.Address]*MergedTraceResult)
+	initCodes := make(map[common.Hash]*MergedTraceResult)
+	for _, tx := range txs {
+		mergeInto(aggregated, tx.Results)
+		mergeInto(initCodes, tx.InitCodes)
+	}
+	return aggregated, initCodes
+}
+
+func mergeInto[K comparable](aggregated map[K]*MergedTraceResult, results map[K]*TraceResult) {
+	for key, res := range results {
+		merged := &MergedTraceResult{
+			CodeHash:      res.CodeHash,
+			Bits:          res.Bits,
+			CopyBits:      res.CopyBits,
+			CodeSizeCount: res.CodeSizeCount,
+			CodeCopyCount: res.CodeCopyCount,
+			WitnessGas:    res.WitnessGas,
+		}
+		if existing, exists := aggregated[key]; exists {
+			existing.Merge(merged)
+			continue
+		}
+		// Clone so that merging doesn't modify the per-transaction results
+		merged.Bits = res.Bits.Clone()
+		merged.CopyBits = res.CopyBits.Clone()
+		aggregated[key] = merged
+	}
+}
+
+// newTxResult simulates the witness gas of every contract accessed by the transaction.
+// Initcode is not part of the state tree, so it is not charged any witness gas.
+func (a *Analyzer) newTxResult(txHash string, txIndex int, txType uint8, res txAccess) TxResult {
+	tx := TxResult{
+		TxHash:    txHash,
+		TxIndex:   txIndex,
+		TxType:    txType,
+		Results:   res.results,
+		InitCodes: res.initCodes,
+	}
+	for _, res := range res.results {
+		res.WitnessGas = a.schedule.CodeAccessGas(res.AccessedChunks())
+		tx.WitnessGas += res.WitnessGas
+	}
+	return tx
+}
+
+// txAccess is the code accessed by a single transaction
+type txAccess struct {
+	results   map[common.Address]*TraceResult
+	initCodes map[common.Hash]*TraceResult
 }
 
-func (a *Analyzer) analyze(tr *TransactionTrace, blockNum uint64) (map[common.Address]*TraceResult, error) {
-	code, err := a.getCodeFromTx(tr.TxHash, blockNum)
+func (a *Analyzer) analyze(tr *TransactionTrace, view stateView, createInitCodes [][]byte, tx BlockTx) (txAccess, error) {
+	code, err := a.getCodeFromTx(tx, view)
 	if err != nil {
-		return nil, err
+		return txAccess{}, err
 	}
 
-	if len(code.code) == 0 {
-		return nil, nil
+	if len(code.code) == 0 || len(code.code) > maxInitCodeBytes {
+		return txAccess{}, nil
 	}
 
 	codes := make(map[int][]*TraceResult)
-	codes[1] = []*TraceResult{newTraceResult(code)}
+	codes[1] = []*TraceResult{newTraceResult(code, a.chunkSize)}
 
-	res, err := a.analyzeSteps(blockNum, &tr.Result, codes)
+	res, err := a.analyzeSteps(view, &tr.Result, codes, createInitCodes)
 	if err != nil {
-		return nil, err
+		return txAccess{}, err
 	}
 	return res, nil
 }
 
-func (a *Analyzer) getCodeFromTx(txHash string, blockNum uint64) (*Code, error) {
-	tx, err := a.client.TransactionByHash(txHash)
-	if err != nil {
-		return nil, err
+// getCodeFromTx returns the code executed by the transaction: the code of the recipient,
+// or the initcode in the input for contract creation transactions.
+func (a *Analyzer) getCodeFromTx(tx BlockTx, view stateView) (*Code, error) {
+	if tx.To == "" {
+		initCode, err := hexutil.Decode(tx.Input)
+		if err != nil {
+			return nil, err
+		}
+		return newInitCode(initCode), nil
 	}
 
-	return a.getCode(tx.To, blockNum)
+	return a.getExecutedCode(tx.To, view)
 }
 
-func (a *Analyzer) getCode(addr string, blockNum uint64) (*Code, error) {
-	addrHex := common.HexToAddress(addr)
-	cacheKey := codeCacheKey(addrHex, blockNum)
+// getCode returns the code of addr as seen by the transaction of the given state view
+func (a *Analyzer) getCode(addr string, view stateView) (*Code, error) {
+	req := view.codeRequest(common.HexToAddress(addr))
+	if code, ok := view.codes.get(req); ok {
+		return code, nil
+	}
+	cacheKey := codeCacheKey(req.Address, req.BlockNum)
 	if cached, ok := a.codeCache.Get(cacheKey); ok {
+		view.codes.add(req, cached.(*Code))
 		return cached.(*Code), nil
 	}
 
-	code, err := a.client.Code(addrHex, blockNum)
+	code, err := a.client.Code(req.Address, req.BlockNum)
 	if err != nil {
 		return nil, err
 	}
@@ -210,23 +412,43 @@ func (a *Analyzer) getCode(addr string, blockNum uint64) (*Code, error) {
 		return nil, err
 	}
 
-	result := &Code{
-		addr: addrHex,
-		code: codeBytes,
-	}
+	result := newCode(req.Address, codeBytes)
 	a.codeCache.Add(cacheKey, result)
+	view.codes.add(req, result)
 	return result, nil
 }
 
-func (a *Analyzer) analyzeSteps(blockNum uint64, trace *InnerResult, codes map[int][]*TraceResult) (map[common.Address]*TraceResult, error) {
+// getExecutedCode returns the code executed by a call to addr: the code of the delegate if addr is delegated
+// under EIP-7702. EXTCODESIZE/EXTCODECOPY read the delegation designator itself, which getCode returns.
+// A delegate that is itself delegated isn't followed, as the EVM doesn't either.
+func (a *Analyzer) getExecutedCode(addr string, view stateView) (*Code, error) {
+	code, err := a.getCode(addr, view)
+	if err != nil {
+		return nil, err
+	}
+	if target, ok := types.ParseDelegation(code.code); ok {
+		return a.getCode(target.Hex(), view)
+	}
+	return code, nil
+}
+
+func (a *Analyzer) analyzeSteps(view stateView, trace *InnerResult, codes map[int][]*TraceResult, createInitCodes [][]byte) (txAccess, error) {
 	results := make(map[common.Address]*TraceResult)
-	results[codes[1][0].Addr] = codes[1][0]
+	initCodes := make(map[common.Hash]*TraceResult)
+	if top := codes[1][0]; top.IsInitCode() {
+		initCodes[top.InitCodeHash] = top
+	} else {
+		results[top.Addr] = top
+	}
+
+	// Index of the next CREATE/CREATE2 frame in createInitCodes
+	nextCreate := 0
+	created := createdAddresses(trace.Steps)
 
 	for i, step := range trace.Steps {
-		// if i == 2954 { // TODO: remove
-		// 	a.log.Info("step 2954")
-		// }
-		// fmt.Printf("step %d: pc %d, op %s depth %d\n", i, step.PC, step.Op, step.Depth) // TODO: remove
+		if addr, ok := created[i]; ok {
+			view = view.withCode(addr)
+		}
 		op := step.Op
 		opLen := len(op)
 		stack := step.Stack
@@ -234,17 +456,19 @@ func (a *Analyzer) analyzeSteps(blockNum uint64, trace *InnerResult, codes map[i
 		// EXTCODESIZE, EXTCODECOPY
 		case opLen == 11 && op[0] == 'E' && (op[len(op)-1] == 'Y' || op[len(op)-1] == 'E'):
 			stackTop := step.Stack[len(step.Stack)-1]
-			code, err := a.getCode(stackTop, blockNum)
+			code, err := a.getCode(stackTop, view)
 			if err != nil && !trace.Failed {
-				return nil, err
+				return txAccess{}, err
 			}
-			if len(code.code) != 0 {
+			if code != nil && len(code.code) != 0 {
 				if _, ok := results[code.addr]; !ok {
-					results[code.addr] = newTraceResult(code)
+					results[code.addr] = newTraceResult(code, a.chunkSize)
 				}
 				switch op[len(op)-1] {
 				case 'Y':
+					// EXTCODECOPY(address, destOffset, offset, size)
 					results[code.addr].CodeCopyCount++
+					markCopyRange(results[code.addr].CopyBits, stack[len(stack)-3], stack[len(stack)-4])
 				case 'E':
 					results[code.addr].CodeSizeCount++
 				}
@@ -253,14 +477,14 @@ func (a *Analyzer) analyzeSteps(blockNum uint64, trace *InnerResult, codes map[i
 		case (opLen == 4 && op[3] == 'L') || (opLen == 10 && op[9] == 'L') || (opLen == 12 && op[0] == 'D') || (opLen == 8 && op[2] == 'L'):
 			if i+1 < len(trace.Steps) && trace.Steps[i+1].Depth == step.Depth+1 {
 				nextStep := trace.Steps[i+1]
-				code, err := a.getCode(stack[len(stack)-2], blockNum)
+				code, err := a.getExecutedCode(stack[len(stack)-2], view)
 				if err != nil && !trace.Failed {
-					return nil, err
+					return txAccess{}, err
 				}
-				if len(code.code) != 0 {
+				if code != nil && len(code.code) != 0 {
 					res, ok := results[code.addr]
 					if !ok {
-						res = newTraceResult(code)
+						res = newTraceResult(code, a.chunkSize)
 						results[code.addr] = res
 					}
 					codes[nextStep.Depth] = append(codes[nextStep.Depth], res)
@@ -270,21 +494,33 @@ func (a *Analyzer) analyzeSteps(blockNum uint64, trace *InnerResult, codes map[i
 				}
 			}
 		case opLen >= 6 && op[:2] == "CR": // CREATE, CREATE2
+			// CREATE(value, offset, size), CREATE2(value, offset, size, salt)
+			// The frames are matched in execution order, checking the initcode size against the stack operand.
+			var initCode []byte
+			if nextCreate < len(createInitCodes) {
+				size, ok := parseStackUint(stack[len(stack)-3])
+				if ok && size == uint64(len(createInitCodes[nextCreate])) {
+					initCode = createInitCodes[nextCreate]
+					nextCreate++
+				}
+			}
 			if i+1 < len(trace.Steps) && trace.Steps[i+1].Depth == step.Depth+1 {
 				nextStep := trace.Steps[i+1]
-				codes[nextStep.Depth] = append(codes[nextStep.Depth], newTraceResultSkip())
+				if len(initCode) == 0 || len(initCode) > maxInitCodeBytes {
+					codes[nextStep.Depth] = append(codes[nextStep.Depth], newTraceResultSkip())
+					continue
+				}
+				code := newInitCode(initCode)
+				res, ok := initCodes[code.initCodeHash]
+				if !ok {
+					res = newTraceResult(code, a.chunkSize)
+					initCodes[code.initCodeHash] = res
+				}
+				codes[nextStep.Depth] = append(codes[nextStep.Depth], res)
 			}
 		}
 	}
 
-	// TODO: remove
-	// for depth, res := range codes {
-	// 	fmt.Printf("depth %d: %v\n", depth, res)
-	// }
-	// for addr, res := range results {
-	// 	fmt.Printf("addr %s: %v\n", addr.Hex(), res)
-	// }
-
 	// Populate the initial pointers for each depth
 	pts := make(map[int]int)
 	for depth := range codes {
@@ -294,10 +530,6 @@ func (a *Analyzer) analyzeSteps(blockNum uint64, trace *InnerResult, codes map[i
 	// Second iteration, populate the results accordingly.
 	var prevDepth int
 	for _, step := range trace.Steps {
-		// fmt.Printf("step %d: pc %d, op %s depth %d stack %v\n", i, step.PC, step.Op, step.Depth, step.Stack) // TODO: remove
-		// if i == 2954 {
-		// 	a.log.Info("step 3985")
-		// }
 		op := step.Op
 		opLen := len(op)
 		depth := step.Depth
@@ -323,25 +555,32 @@ func (a *Analyzer) analyzeSteps(blockNum uint64, trace *InnerResult, codes map[i
 			// Do nothing
 		case opLen > 4 && op[:2] == "PU": // PUSH opcodes
 			if err := a.handlePush(res.Bits, &step); err != nil {
-				return nil, err
+				return txAccess{}, err
 			}
 		case opLen > 4 && op[:3] == "COD": // CODESIZE, CODECOPY
 			switch op[len(op)-1] {
 			case 'Y':
+				// CODECOPY(destOffset, offset, size)
 				res.CodeCopyCount++
+				stack := step.Stack
+				markCopyRange(res.CopyBits, stack[len(stack)-2], stack[len(stack)-3])
 			case 'E':
 				res.CodeSizeCount++
 			}
 		}
 
 		prevDepth = depth
+		if step.PC >= uint64(res.Bits.Size()) {
+			return txAccess{}, fmt.Errorf("%s at pc %d is past the end of the %d bytes of code", op, step.PC, res.Bits.Size())
+		}
 		res.Bits.Set(uint32(step.PC))
 	}
 
-	return results, nil
+	return txAccess{results: results, initCodes: initCodes}, nil
 }
 
-// PUSHX opcodes also access the bytecode, add it to the result accordingly
+// PUSHX opcodes also access the bytecode, add it to the result accordingly. The data of a PUSH at the end
+// of the code is cut short, the EVM pads it with zeros.
 func (a *Analyzer) handlePush(bits *BitSet, step *TraceStep) error {
 	pushNum := step.Op[4:] // Extract the PUSHN number (skip "PUSH")
 	pushNumInt, err := strconv.Atoi(pushNum)
@@ -349,13 +588,68 @@ func (a *Analyzer) handlePush(bits *BitSet, step *TraceStep) error {
 		return err
 	}
 
-	pc := uint32(step.PC)
-	for i := 0; i < pushNumInt; i++ {
-		bits.Set(pc + 1 + uint32(i))
+	end := min(step.PC+1+uint64(pushNumInt), uint64(bits.Size()))
+	for i := step.PC + 1; i < end; i++ {
+		bits.Set(uint32(i))
 	}
 	return nil
 }
 
+// mergeCopyBits merges src into dst, either of which may be nil if no copy was recorded.
+func mergeCopyBits(dst, src *BitSet) *BitSet {
+	if dst == nil {
+		return src.Clone()
+	}
+	if src != nil {
+		dst.Merge(src)
+	}
+	return dst
+}
+
+// accessedChunks returns the sorted union of the chunks accessed in bits and copyBits.
+func accessedChunks(bits, copyBits *BitSet, chunkSize uint32) []uint32 {
+	chunks := bits.AccessedChunksFor(chunkSize)
+	if copyBits == nil {
+		return chunks
+	}
+	for _, chunk := range copyBits.AccessedChunksFor(chunkSize) {
+		if !slices.Contains(chunks, chunk) {
+			chunks = append(chunks, chunk)
+		}
+	}
+	slices.Sort(chunks)
+	return chunks
+}
+
+// markCopyRange marks the bytes copied out of the code by CODECOPY/EXTCODECOPY.
+// Offset and size are the raw hex stack operands. Bytes copied past the end of
+// the code are zero-padded by the EVM, so only the range within the code is marked.
+func markCopyRange(bits *BitSet, offsetHex, sizeHex string) {
+	offset, ok := parseStackUint(offsetHex)
+	if !ok || offset >= uint64(bits.Size()) {
+		return
+	}
+	size, ok := parseStackUint(sizeHex)
+	if !ok {
+		size = uint64(bits.Size())
+	}
+	// Compared to the bytes left rather than added up, as offset+size may overflow
+	end := uint64(bits.Size())
+	if size < end-offset {
+		end = offset + size
+	}
+	bits.SetRange(uint32(offset), uint32(end))
+}
+
+// parseStackUint parses a hex stack entry. It returns false if the value does not fit into an uint64.
+func parseStackUint(s string) (uint64, bool) {
+	v, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok || !v.IsUint64() {
+		return 0, false
+	}
+	return v.Uint64(), true
+}
+
 func codeCacheKey(addr common.Address, blockNum uint64) string {
 	return fmt.Sprintf("%s:%d", addr.Hex(), blockNum)
 }
@@ -0,0 +1,29 @@
+package internal
+
+import "testing"
+
+func TestMarkCopyRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   string
+		size     string
+		expected int // Bytes marked out of 100
+	}{
+		{name: "within the code", offset: "0x10", size: "0x20", expected: 32},
+		{name: "past the end", offset: "0x50", size: "0x20", expected: 20},
+		{name: "offset past the end", offset: "0x64", size: "0x20", expected: 0},
+		{name: "max uint64 size", offset: "0x10", size: "0xffffffffffffffff", expected: 84},
+		{name: "size over uint64", offset: "0x10", size: "0x10000000000000000", expected: 84},
+		{name: "offset over uint64", offset: "0x10000000000000000", size: "0x20", expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bits := NewBitSet(100, 32)
+			markCopyRange(bits, tt.offset, tt.size)
+			if got := bits.Count(); got != tt.expected {
+				t.Errorf("Expected %d bytes marked, got %d", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Compact binary trace format. It only keeps what the analyzer reads out of the struct logs:
+//
+//	magic "CATR", version byte
+//	uvarint tx count, then per tx:
+//	  bytes tx hash, byte failed, uvarint step count, then per step:
+//	    uvarint op, uvarint pc, uvarint depth, uvarint stack count, then per stack entry: bytes value
+//
+// where bytes is a uvarint length followed by the raw bytes. The op is the opcode byte,
+// or opLiteral followed by the op name as bytes if the name isn't a known opcode.
+// Only the top stack entries the analyzer needs are kept, in the original bottom to top order.
+const (
+	binaryTraceMagic   = "CATR"
+	binaryTraceVersion = 1
+	binaryTraceExt     = ".bin"
+
+	opLiteral = 256
+)
+
+// stackOperands returns how many entries from the top of the stack the analyzer reads for the op
+func stackOperands(op string) int {
+	switch op {
+	case OpExtCodeCopy:
+		return 4 // address, destOffset, offset, size
+	case OpCodeCopy, OpCreate, OpCreate2:
+		return 3 // destOffset, offset, size / value, offset, size
+	case OpCall, OpCallCode, OpDelegateCall, OpStaticCall:
+		return 2 // gas, address
+	case OpExtCodeSize:
+		return 1 // address
+	default:
+		return 0
+	}
+}
+
+// keptStack returns the number of stack entries kept for every step of the transaction
+func keptStack(steps []TraceStep) []int {
+	kept := make([]int, len(steps))
+	for i, step := range steps {
+		kept[i] = max(kept[i], stackOperands(step.Op))
+
+		// The address created by CREATE/CREATE2 is the stack top of the next step back at its depth
+		if step.Op == OpCreate || step.Op == OpCreate2 {
+			for j := i + 1; j < len(steps); j++ {
+				if steps[j].Depth <= step.Depth {
+					kept[j] = max(kept[j], 1)
+					break
+				}
+			}
+		}
+	}
+	for i, step := range steps {
+		kept[i] = min(kept[i], len(step.Stack))
+	}
+	return kept
+}
+
+// EncodeTraces writes the traces in the compact binary format
+func EncodeTraces(w io.Writer, traces []TransactionTrace) error {
+	bw := bufio.NewWriter(w)
+	enc := binaryEncoder{w: bw}
+
+	enc.raw([]byte(binaryTraceMagic))
+	enc.raw([]byte{binaryTraceVersion})
+	enc.uvarint(uint64(len(traces)))
+
+	for _, trace := range traces {
+		hash, err := hexutil.Decode(orZeroHex(trace.TxHash))
+		if err != nil {
+			return fmt.Errorf("invalid tx hash %q: %w", trace.TxHash, err)
+		}
+		enc.bytes(hash)
+		if trace.Result.Failed {
+			enc.raw([]byte{1})
+		} else {
+			enc.raw([]byte{0})
+		}
+
+		steps := trace.Result.Steps
+		kept := keptStack(steps)
+		enc.uvarint(uint64(len(steps)))
+		for i, step := range steps {
+			if op := vm.StringToOp(step.Op); op.String() == step.Op {
+				enc.uvarint(uint64(op))
+			} else {
+				enc.uvarint(opLiteral)
+				enc.bytes([]byte(step.Op))
+			}
+			enc.uvarint(step.PC)
+			if step.Depth < 0 {
+				return fmt.Errorf("invalid depth %d", step.Depth)
+			}
+			enc.uvarint(uint64(step.Depth))
+
+			enc.uvarint(uint64(kept[i]))
+			for _, entry := range step.Stack[len(step.Stack)-kept[i]:] {
+				value, ok := new(big.Int).SetString(strings.TrimPrefix(entry, "0x"), 16)
+				if !ok || value.Sign() < 0 {
+					return fmt.Errorf("invalid stack entry %q", entry)
+				}
+				enc.bytes(value.Bytes())
+			}
+		}
+	}
+
+	if enc.err != nil {
+		return enc.err
+	}
+	return bw.Flush()
+}
+
+// orZeroHex returns "0x" for an empty string, which hexutil doesn't accept
+func orZeroHex(s string) string {
+	if s == "" {
+		return "0x"
+	}
+	return s
+}
+
+type binaryEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *binaryEncoder) raw(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *binaryEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	e.raw(e.buf[:n])
+}
+
+func (e *binaryEncoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.raw(b)
+}
+
+// DecodeTraces reads traces in the compact binary format. Stack entries are returned as hex strings,
+// like the struct logger reports them, but only the entries kept by the encoder are present.
+func DecodeTraces(r io.Reader) ([]TransactionTrace, error) {
+	stream, err := newBinaryTraceStream(io.NopCloser(r))
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllTraces(stream)
+}
+
+// binaryTraceStream decodes traces in the compact binary format one transaction at a time
+type binaryTraceStream struct {
+	dec       binaryDecoder
+	closer    io.Closer
+	remaining int
+}
+
+func newBinaryTraceStream(r io.ReadCloser) (*binaryTraceStream, error) {
+	s := &binaryTraceStream{
+		dec:    binaryDecoder{r: bufio.NewReader(r)},
+		closer: r,
+	}
+
+	header := s.dec.raw(len(binaryTraceMagic) + 1)
+	if s.dec.err != nil {
+		return nil, fmt.Errorf("failed to read binary trace header: %w", s.dec.err)
+	}
+	if string(header[:len(binaryTraceMagic)]) != binaryTraceMagic {
+		return nil, errors.New("not a binary trace")
+	}
+	if version := header[len(binaryTraceMagic)]; version != binaryTraceVersion {
+		return nil, fmt.Errorf("unsupported binary trace version %d", version)
+	}
+
+	s.remaining = s.dec.count()
+	if s.dec.err != nil {
+		return nil, fmt.Errorf("failed to decode binary trace: %w", s.dec.err)
+	}
+	return s, nil
+}
+
+func (s *binaryTraceStream) Next() (*TransactionTrace, error) {
+	if s.remaining == 0 {
+		return nil, io.EOF
+	}
+	s.remaining--
+
+	dec := &s.dec
+	var trace TransactionTrace
+	if hash := dec.bytes(); len(hash) > 0 {
+		trace.TxHash = hexutil.Encode(hash)
+	}
+	trace.Result.Failed = dec.raw(1)[0] == 1
+
+	steps := make([]TraceStep, dec.count())
+	for j := range steps {
+		step := &steps[j]
+		switch op := dec.uvarint(); {
+		case op == opLiteral:
+			step.Op = string(dec.bytes())
+		case op < opLiteral:
+			step.Op = vm.OpCode(op).String()
+		default:
+			return nil, fmt.Errorf("invalid op %d in binary trace", op)
+		}
+		step.PC = dec.uvarint()
+		step.Depth = int(dec.uvarint())
+
+		if n := dec.count(); n > 0 {
+			step.Stack = make([]string, n)
+			for k := range step.Stack {
+				step.Stack[k] = hexutil.EncodeBig(new(big.Int).SetBytes(dec.bytes()))
+			}
+		}
+		if dec.err != nil {
+			return nil, fmt.Errorf("failed to decode binary trace: %w", dec.err)
+		}
+	}
+	trace.Result.Steps = steps
+
+	if dec.err != nil {
+		return nil, fmt.Errorf("failed to decode binary trace: %w", dec.err)
+	}
+	return &trace, nil
+}
+
+func (s *binaryTraceStream) Close() error {
+	return s.closer.Close()
+}
+
+type binaryDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+// raw returns n bytes, or zeroes once an error occurred
+func (d *binaryDecoder) raw(n int) []byte {
+	b := make([]byte, n)
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+		d.err = unexpectedEOF(d.err)
+	}
+	return b
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, the end of the stream is only known from the counts
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	d.err = unexpectedEOF(err)
+	return v
+}
+
+// count reads a length, bounded so that a corrupt file doesn't allocate unbounded memory
+func (d *binaryDecoder) count() int {
+	n := d.uvarint()
+	if n > 1<<26 {
+		if d.err == nil {
+			d.err = fmt.Errorf("length %d out of range", n)
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.count()
+	if n > 1<<20 {
+		if d.err == nil {
+			d.err = fmt.Errorf("byte length %d out of range", n)
+		}
+		return nil
+	}
+	return d.raw(n)
+}
+
+// ConvertTraceFile converts a JSON trace file, as returned by debug_traceBlockByNumber, to the binary format
+func ConvertTraceFile(jsonPath, binPath string) error {
+	file, err := os.Open(jsonPath)
+	if err != nil {
+		return err
+	}
+	traces, err := ReadAllTraces(newJSONTraceStream(file))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", jsonPath, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(binPath), filepath.Base(binPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", binPath, err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if err := EncodeTraces(tmp, traces); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode %s: %w", jsonPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", binPath, err)
+	}
+	return os.Rename(tmp.Name(), binPath)
+}
+
+// ConvertTraceDir converts every JSON trace file of the directory that has no binary counterpart yet,
+// optionally removing the JSON files. It returns the number of converted files.
+func ConvertTraceDir(dir string, remove bool) (int, error) {
+	jsonPaths, err := filepath.Glob(filepath.Join(dir, "block_*_trace.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	converted := 0
+	for _, jsonPath := range jsonPaths {
+		binPath := strings.TrimSuffix(jsonPath, ".json") + binaryTraceExt
+		if _, err := os.Stat(binPath); errors.Is(err, os.ErrNotExist) {
+			if err := ConvertTraceFile(jsonPath, binPath); err != nil {
+				return converted, err
+			}
+			converted++
+		} else if err != nil {
+			return converted, err
+		}
+
+		if remove {
+			if err := os.Remove(jsonPath); err != nil {
+				return converted, err
+			}
+		}
+	}
+	return converted, nil
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func binaryTestTraces() []TransactionTrace {
+	return []TransactionTrace{
+		{
+			TxHash: "0x8a6d6a7e56e2f5ab4fb4e1d0bd34c9ea1e71ad7df66cb8c11b5d25bba1b1c3b1",
+			Result: InnerResult{Steps: []TraceStep{
+				{PC: 0, Op: "PUSH1", Depth: 1, Stack: []string{}},
+				{PC: 2, Op: OpCall, Depth: 1, Stack: []string{"0x0", "0x1111111111111111111111111111111111111111", "0x5208"}},
+				{PC: 0, Op: OpCodeCopy, Depth: 2, Stack: []string{"0x7", "0x20", "0x10", "0x0"}},
+				{PC: 1, Op: OpCreate, Depth: 2, Stack: []string{"0x40", "0x0", "0x0"}},
+				{PC: 0, Op: "STOP", Depth: 3, Stack: []string{}},
+				{PC: 2, Op: "POP", Depth: 2, Stack: []string{"0x9", "0x2222222222222222222222222222222222222222"}},
+				{PC: 3, Op: "weird op", Depth: 2, Stack: []string{"0x1"}},
+			}},
+		},
+		{
+			TxHash: "0x01",
+			Result: InnerResult{Failed: true, Steps: []TraceStep{
+				{PC: 300000, Op: OpExtCodeCopy, Depth: 1, Stack: []string{"0x20", "0x0000000000000000000000000000000000000000000000000000000000000004", "0x3", "0x0", "0x3333333333333333333333333333333333333333"}},
+			}},
+		},
+	}
+}
+
+func TestBinaryTrace_RoundTrip(t *testing.T) {
+	traces := binaryTestTraces()
+
+	var buf bytes.Buffer
+	if err := EncodeTraces(&buf, traces); err != nil {
+		t.Fatalf("EncodeTraces() failed: %v", err)
+	}
+	decoded, err := DecodeTraces(&buf)
+	if err != nil {
+		t.Fatalf("DecodeTraces() failed: %v", err)
+	}
+
+	if len(decoded) != len(traces) {
+		t.Fatalf("Expected %d traces, got %d", len(traces), len(decoded))
+	}
+	for i, trace := range traces {
+		got := decoded[i]
+		if got.TxHash != trace.TxHash || got.Result.Failed != trace.Result.Failed {
+			t.Errorf("Tx %d: expected %s/%t, got %s/%t", i, trace.TxHash, trace.Result.Failed, got.TxHash, got.Result.Failed)
+		}
+		if len(got.Result.Steps) != len(trace.Result.Steps) {
+			t.Fatalf("Tx %d: expected %d steps, got %d", i, len(trace.Result.Steps), len(got.Result.Steps))
+		}
+		for j, step := range trace.Result.Steps {
+			gotStep := got.Result.Steps[j]
+			if gotStep.Op != step.Op || gotStep.PC != step.PC || gotStep.Depth != step.Depth {
+				t.Errorf("Tx %d step %d: expected %s/%d/%d, got %s/%d/%d", i, j, step.Op, step.PC, step.Depth, gotStep.Op, gotStep.PC, gotStep.Depth)
+			}
+		}
+	}
+
+	steps := decoded[0].Result.Steps
+	expectedStacks := [][]string{
+		nil,
+		{"0x1111111111111111111111111111111111111111", "0x5208"}, // CALL keeps gas and address
+		{"0x20", "0x10", "0x0"},                                  // CODECOPY keeps its operands
+		{"0x40", "0x0", "0x0"},                                   // CREATE keeps its operands
+		nil,
+		{"0x2222222222222222222222222222222222222222"}, // Created address, back at the CREATE's depth
+		nil,
+	}
+	for j, expected := range expectedStacks {
+		if !slices.Equal(steps[j].Stack, expected) {
+			t.Errorf("Step %d: expected stack %v, got %v", j, expected, steps[j].Stack)
+		}
+	}
+
+	// Leading zeros are normalized away
+	expected := []string{"0x4", "0x3", "0x0", "0x3333333333333333333333333333333333333333"}
+	if got := decoded[1].Result.Steps[0].Stack; !slices.Equal(got, expected) {
+		t.Errorf("Expected stack %v, got %v", expected, got)
+	}
+
+	// The analysis only depends on what was kept
+	addrs := createdAddresses(steps)
+	if len(addrs) != 1 || addrs[5] != common.HexToAddress("0x2222222222222222222222222222222222222222") {
+		t.Errorf("Unexpected created addresses %v", addrs)
+	}
+}
+
+func TestBinaryTrace_Invalid(t *testing.T) {
+	if _, err := DecodeTraces(bytes.NewReader([]byte("nope!"))); err == nil {
+		t.Error("Expected an error for a non binary trace")
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeTraces(&buf, binaryTestTraces()); err != nil {
+		t.Fatalf("EncodeTraces() failed: %v", err)
+	}
+	truncated := buf.Bytes()[:buf.Len()/2]
+	if _, err := DecodeTraces(bytes.NewReader(truncated)); err == nil {
+		t.Error("Expected an error for a truncated trace")
+	}
+}
+
+func TestConvertTraceDir(t *testing.T) {
+	tempDir := t.TempDir()
+	data, err := json.Marshal(JSONTrace{Result: binaryTestTraces()})
+	if err != nil {
+		t.Fatalf("Failed to encode trace: %v", err)
+	}
+	jsonPath := filepath.Join(tempDir, "block_5_trace.json")
+	if err := os.WriteFile(jsonPath, data, 0o644); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+
+	converted, err := ConvertTraceDir(tempDir, true)
+	if err != nil {
+		t.Fatalf("ConvertTraceDir() failed: %v", err)
+	}
+	if converted != 1 {
+		t.Errorf("Expected 1 converted file, got %d", converted)
+	}
+	if _, err := os.Stat(jsonPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the JSON file to be removed, got %v", err)
+	}
+
+	binPath := filepath.Join(tempDir, "block_5_trace.bin")
+	stat, err := os.Stat(binPath)
+	if err != nil {
+		t.Fatalf("Expected a binary file: %v", err)
+	}
+	if stat.Size() >= int64(len(data)) {
+		t.Errorf("Expected the binary trace (%d bytes) to be smaller than the JSON one (%d bytes)", stat.Size(), len(data))
+	}
+
+	trace, err := NewTraceRetriever(nil, tempDir, nil).GetTrace(5)
+	if err != nil {
+		t.Fatalf("GetTrace() failed: %v", err)
+	}
+	if len(trace) != 2 || len(trace[0].Result.Steps) != 7 {
+		t.Errorf("Unexpected trace %+v", trace)
+	}
+}
@@ -4,35 +4,84 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math/bits"
+	"slices"
 )
 
 const (
 	maxContractBytes = 24576
+	maxInitCodeBytes = 2 * maxContractBytes // EIP-3860
+	maxChunkSize     = 255                  // Per-chunk counts are encoded as a single byte
 )
 
-var chunkSize = uint32(15)
-
 // Each bit represents a byte in the contract code.
-// Only represent up to 24,576 bytes because that's the current max contract size.
+// Only represent up to 24,576 bytes because that's the current max contract size (49,152 for initcode).
 // It is in big endian order. Least significant bit is the first byte.
+//
+// The access map is byte-granular and independent of the chunk size, so the same BitSet
+// can be re-chunked after the fact with any chunk size through the *For methods.
+// The chunk methods without a chunk size use the chunk size of the instance.
 type BitSet struct {
-	bits []uint32
-	size uint32 // Contract size in bytes
+	bits      []uint64
+	size      uint32 // Contract size in bytes
+	chunkSize uint32 // Chunk size in bytes
+}
+
+func NewBitSet(size uint32, chunkSize uint32) *BitSet {
+	if size > maxContractBytes {
+		panic(fmt.Sprintf("size out of range (%d > max contract size)", size))
+	}
+
+	return newBitSet(size, chunkSize)
+}
+
+// NewInitCodeBitSet creates a BitSet for initcode, which may be up to twice the max contract size.
+func NewInitCodeBitSet(size uint32, chunkSize uint32) *BitSet {
+	if size > maxInitCodeBytes {
+		panic(fmt.Sprintf("size out of range (%d > max initcode size)", size))
+	}
+
+	return newBitSet(size, chunkSize)
 }
 
-func NewBitSet(size uint32) *BitSet {
+func newBitSet(size uint32, chunkSize uint32) *BitSet {
 	if size == 0 {
 		panic("size must be greater than 0")
 	}
 
-	if size > maxContractBytes {
-		panic(fmt.Sprintf("size out of range (%d > max contract size)", size))
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		panic(fmt.Sprintf("chunk size out of range (%d not in 1..%d)", chunkSize, maxChunkSize))
 	}
 
 	return &BitSet{
-		bits: make([]uint32, (size+chunkSize-1)/chunkSize),
-		size: size,
+		bits:      make([]uint64, (size+63)/64),
+		size:      size,
+		chunkSize: chunkSize,
+	}
+}
+
+// NewBitSetFromChunks rebuilds a BitSet from the per-chunk byte counts returned by Chunks. Which bytes of a chunk
+// were accessed isn't known, so the first bytes of every chunk are set: only the counts at the given chunk size
+// are exact.
+func NewBitSetFromChunks(size uint32, chunkSize uint32, chunks []byte) (*BitSet, error) {
+	if size == 0 || size > maxInitCodeBytes {
+		return nil, fmt.Errorf("size out of range (%d not in 1..%d)", size, maxInitCodeBytes)
 	}
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunk size out of range (%d not in 1..%d)", chunkSize, maxChunkSize)
+	}
+
+	b := newBitSet(size, chunkSize)
+	if len(chunks) != b.NumChunksFor(chunkSize) {
+		return nil, fmt.Errorf("expected %d chunks, got %d", b.NumChunksFor(chunkSize), len(chunks))
+	}
+	for i, count := range chunks {
+		start := uint32(i) * chunkSize
+		if end := min(start+chunkSize, size); uint32(count) > end-start {
+			return nil, fmt.Errorf("chunk %d has %d bytes accessed out of %d", i, count, end-start)
+		}
+		b.SetRange(start, start+uint32(count))
+	}
+	return b, nil
 }
 
 func (b *BitSet) Set(index uint32) *BitSet {
@@ -51,33 +100,49 @@ func (b *BitSet) SetWithCheck(index uint32) (*BitSet, error) {
 	return b.set(index), nil
 }
 
-func (b *BitSet) set(index uint32) *BitSet {
-	wordIndex := index / chunkSize
-	bitIndex := index % chunkSize
+// Set all bits in the range [start, end)
+func (b *BitSet) SetRange(start, end uint32) *BitSet {
+	if end > b.size {
+		panic(fmt.Sprintf("index out of range (%d > %d)", end, b.size))
+	}
 
-	mask := uint32(1 << bitIndex)
-	// if b.bits[wordIndex]&mask == 0 {
-	// 	b.setCount++
-	// }
+	for i := start; i < end; i++ {
+		b.set(i)
+	}
+	return b
+}
 
-	// if b.bits[wordIndex] == 0 {
-	// 	b.chunkCount++
-	// }
+func (b *BitSet) set(index uint32) *BitSet {
+	b.bits[index/64] |= 1 << (index % 64)
+	return b
+}
 
-	b.bits[wordIndex] |= mask
+// Count the number of set bits in the range [start, end)
+func (b *BitSet) countRange(start, end uint32) int {
+	count := 0
+	for start < end {
+		wordIndex := start / 64
+		wordEnd := min((wordIndex+1)*64, end)
+
+		// Mask of the bits [start, wordEnd) within the word
+		width := wordEnd - start
+		mask := ^uint64(0)
+		if width < 64 {
+			mask = (uint64(1) << width) - 1
+		}
+		mask <<= start % 64
 
-	return b
+		count += bits.OnesCount64(b.bits[wordIndex] & mask)
+		start = wordEnd
+	}
+	return count
 }
 
 // Count the number of set bits in the BitSet
 func (b *BitSet) Count() int {
-	// if b.setCount != 0 {
-	// 	return int(b.setCount)
-	// }
-
 	count := 0
 	for _, word := range b.bits {
-		count += bits.OnesCount32(word)
+		count += bits.OnesCount64(word)
 	}
 	return count
 }
@@ -87,42 +152,78 @@ func (b *BitSet) Proportion() float64 {
 	return float64(b.Count()) / float64(b.size)
 }
 
+// Number of chunks the contract is split into for the given chunk size.
+func (b *BitSet) NumChunksFor(chunkSize uint32) int {
+	return int((b.size + chunkSize - 1) / chunkSize)
+}
+
 // Count the number of chunks that were at least accessed once.
 func (b *BitSet) ChunkCount() int {
-	// if b.chunkCount != 0 {
-	// 	return int(b.chunkCount)
-	// }
+	return b.ChunkCountFor(b.chunkSize)
+}
 
-	count := 0
-	for _, word := range b.bits {
-		if word != 0 {
-			count++
-		}
-	}
-	return count
+// Count the number of chunks of the given size that were at least accessed once.
+func (b *BitSet) ChunkCountFor(chunkSize uint32) int {
+	return len(b.AccessedChunksFor(chunkSize))
 }
 
 // Return a slice of bytes where each byte is the number of bytes accessed in the corresponding chunk.
 func (b *BitSet) Chunks() []byte {
-	chunks := make([]byte, len(b.bits))
-	for i, word := range b.bits {
-		if word != 0 {
-			chunks[i] = byte(bits.OnesCount32(word))
-		}
+	return b.ChunksFor(b.chunkSize)
+}
+
+// Same as Chunks, for the given chunk size.
+func (b *BitSet) ChunksFor(chunkSize uint32) []byte {
+	chunks := make([]byte, b.NumChunksFor(chunkSize))
+	for i := range chunks {
+		start := uint32(i) * chunkSize
+		chunks[i] = byte(b.countRange(start, min(start+chunkSize, b.size)))
 	}
 
 	return chunks
 }
 
+// Return the indexes of the chunks that were at least accessed once.
+func (b *BitSet) AccessedChunks() []uint32 {
+	return b.AccessedChunksFor(b.chunkSize)
+}
+
+// Same as AccessedChunks, for the given chunk size.
+func (b *BitSet) AccessedChunksFor(chunkSize uint32) []uint32 {
+	var chunks []uint32
+	for i, count := range b.ChunksFor(chunkSize) {
+		if count != 0 {
+			chunks = append(chunks, uint32(i))
+		}
+	}
+	return chunks
+}
+
 func (b *BitSet) EncodeChunks() string {
-	chunks := b.Chunks()
+	return b.EncodeChunksFor(b.chunkSize)
+}
+
+// Same as EncodeChunks, for the given chunk size.
+func (b *BitSet) EncodeChunksFor(chunkSize uint32) string {
+	chunks := b.ChunksFor(chunkSize)
 	encoded := base64.StdEncoding.EncodeToString(chunks)
 	return encoded
 }
 
 // Get the proportion of the contract that was accessed.
 func (b *BitSet) ChunkProportion() float64 {
-	return float64(b.ChunkCount()) / float64(len(b.bits))
+	return float64(b.ChunkCount()) / float64(b.NumChunksFor(b.chunkSize))
+}
+
+func (b *BitSet) Clone() *BitSet {
+	if b == nil {
+		return nil
+	}
+	return &BitSet{
+		bits:      slices.Clone(b.bits),
+		size:      b.size,
+		chunkSize: b.chunkSize,
+	}
 }
 
 func (b *BitSet) Merge(other *BitSet) *BitSet {
@@ -130,6 +231,10 @@ func (b *BitSet) Merge(other *BitSet) *BitSet {
 		panic("size mismatch")
 	}
 
+	if b.chunkSize != other.chunkSize {
+		panic(fmt.Sprintf("chunk size mismatch (%d != %d)", b.chunkSize, other.chunkSize))
+	}
+
 	for i := range b.bits {
 		b.bits[i] |= other.bits[i]
 	}
@@ -144,3 +249,7 @@ func (b *BitSet) IsFull() bool {
 func (b *BitSet) Size() uint32 {
 	return b.size
 }
+
+func (b *BitSet) ChunkSize() uint32 {
+	return b.chunkSize
+}
@@ -14,14 +14,14 @@ func TestChunks(t *testing.T) {
 		{
 			name: "Empty bitset",
 			setup: func() *BitSet {
-				return NewBitSet(128) // 4 chunks
+				return NewBitSet(128, 32) // 4 chunks
 			},
 			expected: []byte{0, 0, 0, 0},
 		},
 		{
 			name: "Single byte in first chunk",
 			setup: func() *BitSet {
-				b := NewBitSet(128)
+				b := NewBitSet(128, 32)
 				b.Set(0)
 				return b
 			},
@@ -30,7 +30,7 @@ func TestChunks(t *testing.T) {
 		{
 			name: "Multiple bytes in different chunks",
 			setup: func() *BitSet {
-				b := NewBitSet(128)
+				b := NewBitSet(128, 32)
 				// First chunk: 3 bytes
 				b.Set(0).Set(5).Set(10)
 				// Second chunk: 2 bytes
@@ -45,7 +45,7 @@ func TestChunks(t *testing.T) {
 		{
 			name: "Full first chunk",
 			setup: func() *BitSet {
-				b := NewBitSet(128)
+				b := NewBitSet(128, 32)
 				for i := uint32(0); i < 32; i++ {
 					b.Set(i)
 				}
@@ -56,7 +56,7 @@ func TestChunks(t *testing.T) {
 		{
 			name: "Mixed chunk usage",
 			setup: func() *BitSet {
-				b := NewBitSet(96) // 3 chunks
+				b := NewBitSet(96, 32) // 3 chunks
 				// First chunk: 8 bytes
 				for i := uint32(0); i < 8; i++ {
 					b.Set(i)
@@ -76,7 +76,7 @@ func TestChunks(t *testing.T) {
 		{
 			name: "Sparse access pattern",
 			setup: func() *BitSet {
-				b := NewBitSet(256) // 8 chunks
+				b := NewBitSet(256, 32) // 8 chunks
 				// Access only specific bytes in different chunks
 				b.Set(0)   // Chunk 0: 1 byte
 				b.Set(63)  // Chunk 1: 1 byte
@@ -116,14 +116,14 @@ func TestEncodeChunks(t *testing.T) {
 		{
 			name: "Empty bitset",
 			setup: func() *BitSet {
-				return NewBitSet(128) // 4 chunks
+				return NewBitSet(128, 32) // 4 chunks
 			},
 			expected: base64.StdEncoding.EncodeToString([]byte{0, 0, 0, 0}),
 		},
 		{
 			name: "Single byte in first chunk",
 			setup: func() *BitSet {
-				b := NewBitSet(128)
+				b := NewBitSet(128, 32)
 				b.Set(0)
 				return b
 			},
@@ -132,7 +132,7 @@ func TestEncodeChunks(t *testing.T) {
 		{
 			name: "Multiple bytes in different chunks",
 			setup: func() *BitSet {
-				b := NewBitSet(128)
+				b := NewBitSet(128, 32)
 				// First chunk: 3 bytes
 				b.Set(0).Set(5).Set(10)
 				// Second chunk: 2 bytes
@@ -147,7 +147,7 @@ func TestEncodeChunks(t *testing.T) {
 		{
 			name: "Full first chunk",
 			setup: func() *BitSet {
-				b := NewBitSet(128)
+				b := NewBitSet(128, 32)
 				for i := uint32(0); i < 32; i++ {
 					b.Set(i)
 				}
@@ -158,7 +158,7 @@ func TestEncodeChunks(t *testing.T) {
 		{
 			name: "Mixed chunk usage",
 			setup: func() *BitSet {
-				b := NewBitSet(96) // 3 chunks
+				b := NewBitSet(96, 32) // 3 chunks
 				// First chunk: 8 bytes
 				for i := uint32(0); i < 8; i++ {
 					b.Set(i)
@@ -178,7 +178,7 @@ func TestEncodeChunks(t *testing.T) {
 		{
 			name: "Sparse access pattern",
 			setup: func() *BitSet {
-				b := NewBitSet(256) // 8 chunks
+				b := NewBitSet(256, 32) // 8 chunks
 				// Access only specific bytes in different chunks
 				b.Set(0)   // Chunk 0: 1 byte
 				b.Set(63)  // Chunk 1: 1 byte
@@ -192,7 +192,7 @@ func TestEncodeChunks(t *testing.T) {
 		{
 			name: "Large contract with various patterns",
 			setup: func() *BitSet {
-				b := NewBitSet(512) // 16 chunks
+				b := NewBitSet(512, 32) // 16 chunks
 				// Create a pattern: alternating high and low usage
 				for i := 0; i < 16; i++ {
 					if i%2 == 0 {
@@ -241,3 +241,49 @@ func TestEncodeChunks(t *testing.T) {
 		})
 	}
 }
+
+func TestChunksFor(t *testing.T) {
+	b := NewBitSet(200, 32)
+	b.SetRange(0, 10)   // bytes 0-9
+	b.SetRange(60, 70)  // bytes 60-69, across a word boundary
+	b.Set(130).Set(199) // sparse bytes
+
+	tests := []struct {
+		chunkSize uint32
+		expected  []byte
+	}{
+		{chunkSize: 1, expected: func() []byte {
+			expected := make([]byte, 200)
+			for _, i := range append(generateSequence(0, 10), append(generateSequence(60, 70), 130, 199)...) {
+				expected[i] = 1
+			}
+			return expected
+		}()},
+		{chunkSize: 24, expected: []byte{10, 0, 10, 0, 0, 1, 0, 0, 1}},
+		{chunkSize: 31, expected: []byte{10, 2, 8, 0, 1, 0, 1}},
+		{chunkSize: 32, expected: []byte{10, 4, 6, 0, 1, 0, 1}},
+		{chunkSize: 64, expected: []byte{14, 6, 1, 1}},
+		{chunkSize: 128, expected: []byte{20, 2}},
+		{chunkSize: 255, expected: []byte{22}},
+	}
+
+	for _, tt := range tests {
+		chunks := b.ChunksFor(tt.chunkSize)
+		if string(chunks) != string(tt.expected) {
+			t.Errorf("ChunksFor(%d): got %v, want %v", tt.chunkSize, chunks, tt.expected)
+		}
+		if got := b.NumChunksFor(tt.chunkSize); got != len(tt.expected) {
+			t.Errorf("NumChunksFor(%d): got %d, want %d", tt.chunkSize, got, len(tt.expected))
+		}
+
+		accessed := 0
+		for _, count := range tt.expected {
+			if count != 0 {
+				accessed++
+			}
+		}
+		if got := b.ChunkCountFor(tt.chunkSize); got != accessed {
+			t.Errorf("ChunkCountFor(%d): got %d, want %d", tt.chunkSize, got, accessed)
+		}
+	}
+}
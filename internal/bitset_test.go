@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"slices"
 	"testing"
 )
 
@@ -8,6 +9,7 @@ func TestNewBitSet(t *testing.T) {
 	tests := []struct {
 		name        string
 		size        uint32
+		chunkSize   uint32 // 32 if not set, unless shouldPanic
 		expected    uint32
 		shouldPanic bool
 	}{
@@ -46,6 +48,24 @@ func TestNewBitSet(t *testing.T) {
 			size:        0,
 			shouldPanic: true,
 		},
+		{
+			name:        "invalid chunk size zero",
+			size:        64,
+			chunkSize:   0,
+			shouldPanic: true,
+		},
+		{
+			name:        "invalid chunk size too large",
+			size:        64,
+			chunkSize:   maxChunkSize + 1,
+			shouldPanic: true,
+		},
+		{
+			name:      "valid chunk size 128",
+			size:      64,
+			chunkSize: 128,
+			expected:  64,
+		},
 	}
 
 	for _, tt := range tests {
@@ -58,7 +78,11 @@ func TestNewBitSet(t *testing.T) {
 				}()
 			}
 
-			bs := NewBitSet(tt.size)
+			chunkSize := tt.chunkSize
+			if chunkSize == 0 && !tt.shouldPanic || tt.size == 0 || tt.size > maxContractBytes {
+				chunkSize = 32
+			}
+			bs := NewBitSet(tt.size, chunkSize)
 
 			if !tt.shouldPanic {
 				if bs == nil {
@@ -144,7 +168,7 @@ func TestBitSet_Set(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			bs := NewBitSet(tt.size, 32)
 
 			for i, index := range tt.setIndexes {
 				shouldPanic := i < len(tt.shouldPanic) && tt.shouldPanic[i]
@@ -227,7 +251,7 @@ func TestBitSet_Count(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			bs := NewBitSet(tt.size, 32)
 
 			for _, index := range tt.setIndexes {
 				bs.Set(index)
@@ -295,7 +319,7 @@ func TestBitSet_Proportion(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			bs := NewBitSet(tt.size, 32)
 
 			for _, index := range tt.setIndexes {
 				bs.Set(index)
@@ -313,9 +337,38 @@ func TestBitSet_ChunkCount(t *testing.T) {
 	tests := []struct {
 		name               string
 		size               uint32
+		chunkSize          uint32 // 32 if not set
 		setIndexes         []uint32
 		expectedChunkCount int
 	}{
+		{
+			name:               "chunk size 64 groups two 32-byte chunks",
+			size:               128,
+			chunkSize:          64,
+			setIndexes:         []uint32{0, 32, 64, 96},
+			expectedChunkCount: 2,
+		},
+		{
+			name:               "chunk size 128 single chunk",
+			size:               128,
+			chunkSize:          128,
+			setIndexes:         []uint32{0, 127},
+			expectedChunkCount: 1,
+		},
+		{
+			name:               "chunk size 128 across chunks",
+			size:               1000,
+			chunkSize:          128,
+			setIndexes:         []uint32{127, 128, 999},
+			expectedChunkCount: 3,
+		},
+		{
+			name:               "chunk size 31 boundaries",
+			size:               100,
+			chunkSize:          31,
+			setIndexes:         []uint32{30, 31, 62, 93},
+			expectedChunkCount: 4,
+		},
 		{
 			name:               "empty bitset",
 			size:               64,
@@ -374,7 +427,11 @@ func TestBitSet_ChunkCount(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			chunkSize := tt.chunkSize
+			if chunkSize == 0 {
+				chunkSize = 32
+			}
+			bs := NewBitSet(tt.size, chunkSize)
 
 			for _, index := range tt.setIndexes {
 				bs.Set(index)
@@ -392,10 +449,27 @@ func TestBitSet_ChunkProportion(t *testing.T) {
 	tests := []struct {
 		name                    string
 		size                    uint32
+		chunkSize               uint32 // 32 if not set
 		setIndexes              []uint32
 		expectedChunkProportion float64
 		tolerance               float64
 	}{
+		{
+			name:                    "chunk size 64 half chunks",
+			size:                    256,
+			chunkSize:               64,
+			setIndexes:              []uint32{0, 200},
+			expectedChunkProportion: 0.5,
+			tolerance:               0.001,
+		},
+		{
+			name:                    "chunk size 128 partial last chunk",
+			size:                    300,
+			chunkSize:               128,
+			setIndexes:              []uint32{299},
+			expectedChunkProportion: 1.0 / 3.0,
+			tolerance:               0.001,
+		},
 		{
 			name:                    "empty bitset",
 			size:                    64,
@@ -456,7 +530,11 @@ func TestBitSet_ChunkProportion(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			chunkSize := tt.chunkSize
+			if chunkSize == 0 {
+				chunkSize = 32
+			}
+			bs := NewBitSet(tt.size, chunkSize)
 
 			for _, index := range tt.setIndexes {
 				bs.Set(index)
@@ -472,7 +550,7 @@ func TestBitSet_ChunkProportion(t *testing.T) {
 
 func TestBitSet_ChunkMethods_EdgeCases(t *testing.T) {
 	t.Run("single chunk bitset", func(t *testing.T) {
-		bs := NewBitSet(20)
+		bs := NewBitSet(20, 32)
 
 		// Initially empty
 		if bs.ChunkCount() != 0 {
@@ -493,7 +571,7 @@ func TestBitSet_ChunkMethods_EdgeCases(t *testing.T) {
 	})
 
 	t.Run("chunk boundaries", func(t *testing.T) {
-		bs := NewBitSet(100)
+		bs := NewBitSet(100, 32)
 
 		// Set bits at chunk boundaries
 		bs.Set(31) // Last bit of first chunk
@@ -514,7 +592,7 @@ func TestBitSet_ChunkMethods_EdgeCases(t *testing.T) {
 	})
 
 	t.Run("maximum size bitset chunks", func(t *testing.T) {
-		bs := NewBitSet(maxContractBytes)
+		bs := NewBitSet(maxContractBytes, 32)
 
 		// Set first and last bits
 		bs.Set(0)
@@ -535,7 +613,7 @@ func TestBitSet_ChunkMethods_EdgeCases(t *testing.T) {
 
 func TestBitSet_EdgeCases(t *testing.T) {
 	t.Run("maximum size bitset", func(t *testing.T) {
-		bs := NewBitSet(maxContractBytes)
+		bs := NewBitSet(maxContractBytes, 32)
 		if bs.size != maxContractBytes {
 			t.Errorf("Max size bitset should have size %d, got %d", maxContractBytes, bs.size)
 		}
@@ -555,7 +633,7 @@ func TestBitSet_EdgeCases(t *testing.T) {
 	})
 
 	t.Run("method chaining", func(t *testing.T) {
-		bs := NewBitSet(10)
+		bs := NewBitSet(10, 32)
 		result := bs.Set(0).Set(1).Set(2)
 
 		if result != bs {
@@ -569,7 +647,7 @@ func TestBitSet_EdgeCases(t *testing.T) {
 
 func TestBitSet_WordBoundaries(t *testing.T) {
 	t.Run("bits around 32-bit word boundaries", func(t *testing.T) {
-		bs := NewBitSet(200)
+		bs := NewBitSet(200, 32)
 
 		// Set bits around word boundaries
 		testIndexes := []uint32{
@@ -646,7 +724,7 @@ func TestBitSet_SetWithCheck(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			bs := NewBitSet(tt.size, 32)
 			originalCount := bs.Count()
 
 			result, err := bs.SetWithCheck(tt.index)
@@ -763,13 +841,13 @@ func TestBitSet_Merge(t *testing.T) {
 			}
 
 			// Create and set up first bitset
-			bs1 := NewBitSet(tt.size)
+			bs1 := NewBitSet(tt.size, 32)
 			for _, index := range tt.setBits1 {
 				bs1.Set(index)
 			}
 
 			// Create and set up second bitset
-			bs2 := NewBitSet(tt.size)
+			bs2 := NewBitSet(tt.size, 32)
 			for _, index := range tt.setBits2 {
 				bs2.Set(index)
 			}
@@ -809,8 +887,21 @@ func TestBitSet_Merge(t *testing.T) {
 			}
 		}()
 
-		bs1 := NewBitSet(10)
-		bs2 := NewBitSet(20)
+		bs1 := NewBitSet(10, 32)
+		bs2 := NewBitSet(20, 32)
+		bs1.Merge(bs2)
+	})
+
+	// Test chunk size mismatch panic
+	t.Run("chunk size mismatch panic", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("Merge() should have panicked for mismatched chunk sizes")
+			}
+		}()
+
+		bs1 := NewBitSet(100, 32)
+		bs2 := NewBitSet(100, 64)
 		bs1.Merge(bs2)
 	})
 }
@@ -892,7 +983,7 @@ func TestBitSet_IsFull(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bs := NewBitSet(tt.size)
+			bs := NewBitSet(tt.size, 32)
 
 			// Set the specified bits
 			for _, index := range tt.setBits {
@@ -933,3 +1024,103 @@ func abs(x float64) float64 {
 	}
 	return x
 }
+
+func TestBitSet_SetRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          uint32
+		start, end    uint32
+		expectedCount int
+		shouldPanic   bool
+	}{
+		{
+			name:          "empty range",
+			size:          100,
+			start:         10,
+			end:           10,
+			expectedCount: 0,
+		},
+		{
+			name:          "range within single word",
+			size:          100,
+			start:         2,
+			end:           6,
+			expectedCount: 4,
+		},
+		{
+			name:          "range across word boundaries",
+			size:          100,
+			start:         20,
+			end:           70,
+			expectedCount: 50,
+		},
+		{
+			name:          "full range",
+			size:          100,
+			start:         0,
+			end:           100,
+			expectedCount: 100,
+		},
+		{
+			name:        "range past end",
+			size:        100,
+			start:       90,
+			end:         101,
+			shouldPanic: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.shouldPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("SetRange(%d, %d) should have panicked", tt.start, tt.end)
+					}
+				}()
+			}
+
+			bs := NewBitSet(tt.size, 32)
+			bs.SetRange(tt.start, tt.end)
+
+			if bs.Count() != tt.expectedCount {
+				t.Errorf("Count() = %d, expected %d", bs.Count(), tt.expectedCount)
+			}
+		})
+	}
+}
+
+func TestNewBitSetFromChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      uint32
+		chunkSize uint32
+		chunks    []byte
+		shouldErr bool
+	}{
+		{name: "partial last chunk", size: 100, chunkSize: 32, chunks: []byte{32, 1, 0, 4}},
+		{name: "no access", size: 40, chunkSize: 32, chunks: []byte{0, 0}},
+		{name: "wrong chunk count", size: 100, chunkSize: 32, chunks: []byte{1, 2}, shouldErr: true},
+		{name: "count past chunk end", size: 100, chunkSize: 32, chunks: []byte{0, 0, 0, 5}, shouldErr: true},
+		{name: "zero size", size: 0, chunkSize: 32, shouldErr: true},
+		{name: "zero chunk size", size: 100, chunkSize: 0, shouldErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := NewBitSetFromChunks(tt.size, tt.chunkSize, tt.chunks)
+			if tt.shouldErr {
+				if err == nil {
+					t.Errorf("NewBitSetFromChunks() should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewBitSetFromChunks() failed: %v", err)
+			}
+			if chunks := bs.Chunks(); !slices.Equal(chunks, tt.chunks) {
+				t.Errorf("Chunks() = %v, expected %v", chunks, tt.chunks)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Checkpoint records which sampled blocks a worker wrote, and the size of each of its output files right after.
+// Anything past those sizes belongs to a block that was interrupted mid-write.
+type Checkpoint struct {
+	Done  []uint64         `json:"done"`  // Sorted sampled blocks the worker wrote
+	Files map[string]int64 `json:"files"` // File name (relative to the result dir) -> size in bytes
+}
+
+func checkpointPath(dir string, worker int) string {
+	return filepath.Join(dir, fmt.Sprintf("checkpoint-%d.json", worker))
+}
+
+// LoadCheckpoint reads the checkpoint of the worker, returning nil if it has none yet
+func LoadCheckpoint(dir string, worker int) (*Checkpoint, error) {
+	data, err := os.ReadFile(checkpointPath(dir, worker))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// IsDone reports whether the block was written
+func (c *Checkpoint) IsDone(block uint64) bool {
+	_, found := slices.BinarySearch(c.Done, block)
+	return found
+}
+
+// SaveCheckpoint atomically replaces the checkpoint of the worker
+func SaveCheckpoint(dir string, worker int, cp *Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	path := checkpointPath(dir, worker)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Restore truncates the output files back to their checkpointed size, dropping the rows of half-written blocks.
+// The given files that didn't exist at checkpoint time are removed.
+func (c *Checkpoint) Restore(dir string, files []string) error {
+	names := slices.Collect(maps.Keys(c.Files))
+	for _, name := range files {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+
+		size, ok := c.Files[name]
+		if !ok {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove %s: %w", name, err)
+			}
+			continue
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", name, err)
+		}
+		if stat.Size() < size {
+			return fmt.Errorf("%s is shorter than its checkpoint (%d < %d bytes)", name, stat.Size(), size)
+		}
+		if stat.Size() > size {
+			if err := os.Truncate(path, size); err != nil {
+				return fmt.Errorf("failed to truncate %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// fileSizes returns the current size of the given files, skipping the ones that don't exist
+func fileSizes(dir string, files []string) (map[string]int64, error) {
+	sizes := make(map[string]int64, len(files))
+	for _, name := range files {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", name, err)
+		}
+		sizes[name] = stat.Size()
+	}
+	return sizes, nil
+}
+
+// progress tracks the blocks written by a worker and persists them as its checkpoint. Each worker has its own,
+// so the workers never wait on each other to checkpoint, and a corrupted checkpoint only loses one worker's blocks.
+type progress struct {
+	dir        string
+	worker     int
+	checkpoint *Checkpoint
+}
+
+func newProgress(dir string, worker int, checkpoint *Checkpoint) *progress {
+	if checkpoint.Files == nil {
+		checkpoint.Files = make(map[string]int64)
+	}
+	return &progress{
+		dir:        dir,
+		worker:     worker,
+		checkpoint: checkpoint,
+	}
+}
+
+// Done records that blocks were fully written, with the sizes of the worker's files right after them
+func (p *progress) Done(blocks []uint64, sizes map[string]int64) error {
+	cp := p.checkpoint
+	maps.Copy(cp.Files, sizes)
+	for _, block := range blocks {
+		if i, found := slices.BinarySearch(cp.Done, block); !found {
+			cp.Done = slices.Insert(cp.Done, i, block)
+		}
+	}
+	return SaveCheckpoint(p.dir, p.worker, cp)
+}
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCheckpoint_SaveLoad(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cp, err := LoadCheckpoint(tempDir, 0)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() failed: %v", err)
+	}
+	if cp != nil {
+		t.Fatalf("Expected no checkpoint, got %+v", cp)
+	}
+
+	want := &Checkpoint{Done: []uint64{42}, Files: map[string]int64{"analysis-0.csv": 123}}
+	if err := SaveCheckpoint(tempDir, 0, want); err != nil {
+		t.Fatalf("SaveCheckpoint() failed: %v", err)
+	}
+	// Overwriting must replace the previous checkpoint
+	want.Done = append(want.Done, 43)
+	if err := SaveCheckpoint(tempDir, 0, want); err != nil {
+		t.Fatalf("SaveCheckpoint() failed: %v", err)
+	}
+	// Each worker has its own checkpoint
+	if err := SaveCheckpoint(tempDir, 1, &Checkpoint{Done: []uint64{44}}); err != nil {
+		t.Fatalf("SaveCheckpoint() failed: %v", err)
+	}
+
+	got, err := LoadCheckpoint(tempDir, 0)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() failed: %v", err)
+	}
+	if !slices.Equal(got.Done, []uint64{42, 43}) || got.Files["analysis-0.csv"] != 123 {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	other, err := LoadCheckpoint(tempDir, 1)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() failed: %v", err)
+	}
+	if !slices.Equal(other.Done, []uint64{44}) {
+		t.Errorf("Expected worker 1 to have done [44], got %v", other.Done)
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected only the 2 checkpoint files, got %d entries", len(entries))
+	}
+}
+
+func TestCheckpoint_Restore(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewResultWriter(tempDir, 0)
+
+	addr := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	results := map[common.Address]*MergedTraceResult{
+		addr: {Bits: NewBitSet(64, 32).Set(0)},
+	}
+
+	if err := writer.Write(1, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	sizes, err := fileSizes(tempDir, writer.Files())
+	if err != nil {
+		t.Fatalf("fileSizes() failed: %v", err)
+	}
+	// The tx file was never written, so it isn't part of the checkpoint
+	delete(sizes, "txs-0.csv")
+	cp := &Checkpoint{Done: []uint64{1}, Files: sizes}
+
+	// Block 2 gets interrupted after its rows were written
+	if err := writer.Write(2, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := writer.WriteTxs(2, []TxResult{{TxHash: "0xaa"}}); err != nil {
+		t.Fatalf("WriteTxs() failed: %v", err)
+	}
+	writer.Close()
+
+	if err := cp.Restore(tempDir, writer.Files()); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "txs-0.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected txs-0.csv to be removed, got %v", err)
+	}
+
+	// Writing the block again must not duplicate it nor leave a blank line
+	writer = NewResultWriter(tempDir, 0)
+	defer writer.Close()
+	if err := writer.Write(2, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "analysis-0.csv"))
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 rows (header + 2 blocks), got %d", len(records))
+	}
+	if records[1][0] != "1" || records[2][0] != "2" {
+		t.Errorf("Expected blocks 1 and 2, got %s and %s", records[1][0], records[2][0])
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Errorf("Expected 3 lines, got %d", lines)
+	}
+}
+
+func TestCheckpoint_RestoreShorterFile(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "analysis-0.csv"), []byte("a\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	cp := &Checkpoint{Files: map[string]int64{"analysis-0.csv": 100}}
+	if err := cp.Restore(tempDir, []string{"analysis-0.csv"}); err == nil {
+		t.Error("Restore() should fail when a file is shorter than its checkpoint")
+	}
+}
+
+func TestProgress_Done(t *testing.T) {
+	tempDir := t.TempDir()
+	p := newProgress(tempDir, 1, &Checkpoint{})
+
+	// The worker gets blocks out of order when another one retries a block
+	if err := p.Done([]uint64{120}, map[string]int64{"analysis-1.csv": 10}); err != nil {
+		t.Fatalf("Done() failed: %v", err)
+	}
+	if err := p.Done([]uint64{100, 130}, map[string]int64{"analysis-1.csv": 20, "txs-1.csv": 5}); err != nil {
+		t.Fatalf("Done() failed: %v", err)
+	}
+
+	cp, err := LoadCheckpoint(tempDir, 1)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() failed: %v", err)
+	}
+	if !slices.Equal(cp.Done, []uint64{100, 120, 130}) {
+		t.Errorf("Expected done [100 120 130], got %v", cp.Done)
+	}
+	if cp.Files["analysis-1.csv"] != 20 || cp.Files["txs-1.csv"] != 5 {
+		t.Errorf("Unexpected file sizes %v", cp.Files)
+	}
+
+	for _, block := range []uint64{100, 120, 130} {
+		if !cp.IsDone(block) {
+			t.Errorf("Expected block %d to be done", block)
+		}
+	}
+	if cp.IsDone(110) {
+		t.Error("Expected block 110 not to be done")
+	}
+
+	if other, err := LoadCheckpoint(tempDir, 0); err != nil || other != nil {
+		t.Errorf("Expected no checkpoint for worker 0, got %+v (%v)", other, err)
+	}
+}
+
+func TestEngine_StartCheckpoints(t *testing.T) {
+	tempDir := t.TempDir()
+	files := [][]string{{"analysis-0.csv"}, {"analysis-1.csv"}}
+	for _, name := range []string{"analysis-0.csv", "analysis-1.csv"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("header\n"), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	engine := NewEngine(&Config{ResultDir: tempDir})
+	checkpoints, err := engine.startCheckpoints(files)
+	if err != nil {
+		t.Fatalf("startCheckpoints() failed: %v", err)
+	}
+
+	// Worker 1 writes a block, then both get interrupted mid-block
+	if err := newProgress(tempDir, 1, checkpoints[1]).Done([]uint64{7}, map[string]int64{"analysis-1.csv": 9}); err != nil {
+		t.Fatalf("Done() failed: %v", err)
+	}
+	for _, content := range []struct{ name, data string }{
+		{"analysis-0.csv", "header\nhalf"},
+		{"analysis-1.csv", "header\n7\nhalf"},
+	} {
+		if err := os.WriteFile(filepath.Join(tempDir, content.name), []byte(content.data), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	engine = NewEngine(&Config{ResultDir: tempDir, Resume: true})
+	checkpoints, err = engine.startCheckpoints(files)
+	if err != nil {
+		t.Fatalf("startCheckpoints() failed: %v", err)
+	}
+	if !checkpoints[1].IsDone(7) || checkpoints[0].IsDone(7) {
+		t.Errorf("Expected only worker 1 to have written block 7, got %+v and %+v", checkpoints[0], checkpoints[1])
+	}
+	for name, want := range map[string]string{"analysis-0.csv": "header\n", "analysis-1.csv": "header\n7\n"} {
+		data, err := os.ReadFile(filepath.Join(tempDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("Expected %s to be rolled back to %q, got %q", name, want, data)
+		}
+	}
+
+	// A missing checkpoint means the files don't match the run
+	if err := os.Remove(checkpointPath(tempDir, 0)); err != nil {
+		t.Fatalf("Failed to remove checkpoint: %v", err)
+	}
+	if _, err := engine.startCheckpoints(files); err == nil {
+		t.Error("startCheckpoints() should fail when a worker's checkpoint is missing")
+	}
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"golang.org/x/sync/errgroup"
+)
+
+// Tracers that can produce the code accesses of a block
+const (
+	TracerStructLog  = "structlog"  // Full struct logs, from which the analyzer derives the code accesses
+	TracerCodeAccess = "codeaccess" // codeAccessTracer, which only reports the code accesses
+	TracerReplay     = "replay"     // No node, the blocks are replayed from their replay files in the trace directory
+)
+
+func Tracers() []string {
+	return []string{TracerStructLog, TracerCodeAccess, TracerReplay}
+}
+
+// codeAccessTracer is a JS tracer for debug_traceBlockByNumber that only reports the code accessed by
+// every transaction, instead of one struct log per step. Accesses are aggregated per code rather than per
+// frame, which is all the analyzer needs: the runtime code of an address, or the initcode of a
+// CREATE/CREATE2 frame. Executed bytes, PUSH data included, are reported as [start, end) ranges.
+// CODECOPY/EXTCODECOPY are reported as [offset, size] pairs, as hex like the struct logger stack.
+// EXTCODESIZE/EXTCODECOPY are reported apart from the frames of the same address, as they read the
+// EIP-7702 delegation designator of a delegated account while its frames execute the delegate's code.
+// The accesses to a contract created by the transaction are reported apart too once it is created, as
+// before that it has no code yet.
+//
+// The transaction itself is the bottom frame. Its code is only known once the transaction is done,
+// from the context passed to result.
+const codeAccessTracer = `{
+	codes: {},
+	order: [],
+	frames: [{key: "top"}],
+	created: [],
+	deployed: {},
+
+	access: function(frame) {
+		var code = this.codes[frame.key];
+		if (code === undefined) {
+			code = {address: frame.address, initcode: frame.initcode, external: frame.external, deployed: frame.deployed, pcs: {}, sizeCount: 0, copies: []};
+			this.codes[frame.key] = code;
+			this.order.push(frame.key);
+		}
+		return code;
+	},
+	external: function(log) {
+		var address = toHex(toAddress(log.stack.peek(0).toString(16)));
+		return this.runtime("e:", address, {external: true});
+	},
+	runtime: function(prefix, address, frame) {
+		frame.address = address;
+		frame.key = prefix + address;
+		if (this.deployed[address]) {
+			frame.key += ":deployed";
+			frame.deployed = true;
+		}
+		return frame;
+	},
+	word: function(log, n) {
+		return "0x" + log.stack.peek(n).toString(16);
+	},
+	enter: function(frame) {
+		var type = frame.getType();
+		var to = toHex(frame.getTo());
+		if (type == "CREATE" || type == "CREATE2") {
+			var input = toHex(frame.getInput());
+			this.frames.push({key: "i:" + input, initcode: input, created: to});
+		} else {
+			this.frames.push(this.runtime("a:", to, {}));
+		}
+	},
+	exit: function(res) {
+		var frame = this.frames.pop();
+		if (frame.created !== undefined && res.getError() === undefined) {
+			this.created.push(frame.created);
+			this.deployed[frame.created] = true;
+		}
+	},
+	step: function(log, db) {
+		var code = this.access(this.frames[this.frames.length - 1]);
+		var op = log.op.toNumber();
+		code.pcs[log.getPC()] = (op >= 0x60 && op <= 0x7f) ? op - 0x5f : 0;
+		switch (op) {
+		case 0x38: // CODESIZE
+			code.sizeCount++;
+			break;
+		case 0x39: // CODECOPY(destOffset, offset, size)
+			code.copies.push([this.word(log, 1), this.word(log, 2)]);
+			break;
+		case 0x3b: // EXTCODESIZE(address)
+			this.access(this.external(log)).sizeCount++;
+			break;
+		case 0x3c: // EXTCODECOPY(address, destOffset, offset, size)
+			this.access(this.external(log)).copies.push([this.word(log, 2), this.word(log, 3)]);
+			break;
+		}
+	},
+	fault: function(log, db) {},
+	ranges: function(pcs) {
+		var starts = Object.keys(pcs).map(Number).sort(function(a, b) { return a - b; });
+		var ranges = [];
+		for (var i = 0; i < starts.length; i++) {
+			var start = starts[i], end = start + 1 + pcs[start];
+			var last = ranges[ranges.length - 1];
+			if (last !== undefined && start <= last[1]) {
+				last[1] = Math.max(last[1], end);
+			} else {
+				ranges.push([start, end]);
+			}
+		}
+		return ranges;
+	},
+	result: function(ctx, db) {
+		var codes = [];
+		for (var i = 0; i < this.order.length; i++) {
+			var code = this.codes[this.order[i]];
+			var out = {ranges: this.ranges(code.pcs), sizeCount: code.sizeCount, copies: code.copies};
+			if (this.order[i] == "top" && ctx.type == "CREATE") {
+				out.initcode = toHex(ctx.input);
+			} else if (this.order[i] == "top") {
+				out.address = toHex(ctx.to);
+			} else if (code.initcode !== undefined) {
+				out.initcode = code.initcode;
+			} else {
+				out.address = code.address;
+				out.external = code.external;
+				out.deployed = code.deployed;
+			}
+			codes.push(out);
+		}
+		return {failed: ctx.error !== undefined, created: this.created, codes: codes};
+	}
+}`
+
+// CodeAccessTrace is the codeAccessTracer trace of a single transaction
+type CodeAccessTrace struct {
+	TxHash string           `json:"txHash"`
+	Result CodeAccessResult `json:"result"`
+}
+
+type CodeAccessResult struct {
+	Failed  bool         `json:"failed"`
+	Created []string     `json:"created"` // Contracts successfully created by CREATE/CREATE2
+	Codes   []CodeAccess `json:"codes"`
+}
+
+// CodeAccess is the access to either the runtime code of an address or to initcode. The same code may
+// be reported more than once, e.g. the recipient of the transaction when it's called back.
+type CodeAccess struct {
+	Address   string      `json:"address,omitempty"`
+	InitCode  string      `json:"initcode,omitempty"`
+	External  bool        `json:"external,omitempty"` // Read by EXTCODESIZE/EXTCODECOPY rather than executed
+	Deployed  bool        `json:"deployed,omitempty"` // Made after the transaction created the contract
+	Ranges    [][2]uint64 `json:"ranges"`             // Executed bytes, [start, end)
+	SizeCount int         `json:"sizeCount"`
+	Copies    [][2]string `json:"copies"` // CODECOPY/EXTCODECOPY offset and size
+}
+
+// view returns the state the access was made against, once the transaction created the contract if made after
+func (access CodeAccess) view(view stateView) stateView {
+	if access.Deployed {
+		return view.withCode(common.HexToAddress(access.Address))
+	}
+	return view
+}
+
+// AnalyzeCodeAccess analyzes a block traced with the codeAccessTracer
+func (a *Analyzer) AnalyzeCodeAccess(blockNum uint64, traces []CodeAccessTrace) (BlockResult, error) {
+	txs := make([]TxResult, len(traces))
+	deployments := make(map[common.Address]int)
+
+	blockTxs, err := a.retriever.GetBlockTxs(blockNum)
+	if err != nil {
+		return BlockResult{}, err
+	}
+	codes, err := a.retriever.GetCodes(blockNum)
+	if err != nil {
+		return BlockResult{}, err
+	}
+
+	// The traces are small, so the code of the whole block is fetched up front, in as few batches as possible
+	views := make([]stateView, len(traces))
+	txTypes := make([]uint8, len(traces))
+	var lookups []codeLookup
+	for i, tx := range traces {
+		blockTx, err := lookupBlockTx(blockTxs, tx.TxHash, blockNum, i)
+		if err != nil {
+			return BlockResult{}, err
+		}
+		txTypes[i] = uint8(blockTx.Type)
+
+		created := txCodeChanges(blockTx, tx.Result.Failed)
+		for _, addr := range tx.Result.Created {
+			created = append(created, common.HexToAddress(addr))
+		}
+		addCreated(deployments, i, created)
+		views[i] = newStateView(blockNum, i, deployments, blockTx, codes)
+
+		for _, access := range tx.Result.Codes {
+			if access.InitCode == "" {
+				lookups = append(lookups, codeLookup{access.Address, access.view(views[i]), !access.External})
+			}
+		}
+	}
+	if err := a.prefetchCodes(lookups); err != nil {
+		return BlockResult{}, err
+	}
+
+	var workers errgroup.Group
+	workers.SetLimit(runtime.NumCPU())
+	for i := range traces {
+		tx := &traces[i]
+		workers.Go(func() error {
+			res, err := a.analyzeCodeAccess(&tx.Result, views[i])
+			if err != nil {
+				return err
+			}
+			txs[i] = a.newTxResult(tx.TxHash, i, txTypes[i], res)
+			return nil
+		})
+	}
+
+	if err := workers.Wait(); err != nil {
+		return BlockResult{}, err
+	}
+	if err := a.retriever.PutCodes(blockNum, codes); err != nil {
+		return BlockResult{}, err
+	}
+	return newBlockResult(blockNum, txs), nil
+}
+
+func (a *Analyzer) analyzeCodeAccess(trace *CodeAccessResult, view stateView) (txAccess, error) {
+	res := txAccess{
+		results:   make(map[common.Address]*TraceResult),
+		initCodes: make(map[common.Hash]*TraceResult),
+	}
+
+	for _, access := range trace.Codes {
+		result, err := a.codeAccessResult(res, access, view)
+		if err != nil {
+			if trace.Failed {
+				continue
+			}
+			return txAccess{}, err
+		}
+		if result == nil {
+			continue
+		}
+
+		size := uint64(result.Bits.Size())
+		for _, r := range access.Ranges {
+			// The implicit STOP past the end of the code is reported too
+			if start, end := min(r[0], size), min(r[1], size); start < end {
+				result.Bits.SetRange(uint32(start), uint32(end))
+			}
+		}
+		result.CodeSizeCount += access.SizeCount
+		for _, copied := range access.Copies {
+			result.CodeCopyCount++
+			markCopyRange(result.CopyBits, copied[0], copied[1])
+		}
+	}
+	return res, nil
+}
+
+// codeAccessResult returns the result the access is recorded in, or nil if the code is empty or too large
+func (a *Analyzer) codeAccessResult(res txAccess, access CodeAccess, view stateView) (*TraceResult, error) {
+	var code *Code
+	if access.InitCode != "" {
+		initCode, err := hexutil.Decode(access.InitCode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode initcode: %w", err)
+		}
+		code = newInitCode(initCode)
+	} else {
+		getCode := a.getExecutedCode
+		if access.External {
+			getCode = a.getCode
+		}
+		var err error
+		if code, err = getCode(access.Address, access.view(view)); err != nil {
+			return nil, err
+		}
+	}
+	if len(code.code) == 0 || len(code.code) > maxInitCodeBytes {
+		return nil, nil
+	}
+
+	if code.initCodeHash != (common.Hash{}) {
+		if _, ok := res.initCodes[code.initCodeHash]; !ok {
+			res.initCodes[code.initCodeHash] = newTraceResult(code, a.chunkSize)
+		}
+		return res.initCodes[code.initCodeHash], nil
+	}
+	if _, ok := res.results[code.addr]; !ok {
+		res.results[code.addr] = newTraceResult(code, a.chunkSize)
+	}
+	return res.results[code.addr], nil
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+// Two transactions as returned by the code access tracer: the first one calls 0xaa, which deploys 0xcc,
+// the second one calls 0xcc
+const testCodeAccessResponse = `[
+	{"txHash":"0x01","result":{"failed":false,"created":["0x00000000000000000000000000000000000000cc"],"codes":[
+		{"address":"0x00000000000000000000000000000000000000aa","ranges":[[0,3],[8,10]],"sizeCount":1,"copies":[["0x4","0x2"]]},
+		{"initcode":"0x600160025b00","ranges":[[0,2],[5,7]],"sizeCount":0,"copies":[]},
+		{"address":"0x00000000000000000000000000000000000000bb","ranges":[],"sizeCount":0,"copies":[["0x0","0xffffffffffffffffffffffffffffffffff"]]},
+		{"address":"0x00000000000000000000000000000000000000aa","ranges":[[20,21]],"sizeCount":0,"copies":[]}
+	]}},
+	{"txHash":"0x02","result":{"failed":false,"created":[],"codes":[
+		{"address":"0x00000000000000000000000000000000000000cc","ranges":[[0,1]],"sizeCount":0,"copies":[]}
+	]}}
+]`
+
+func TestAnalyzeCodeAccess(t *testing.T) {
+	var traces []CodeAccessTrace
+	if err := json.Unmarshal([]byte(testCodeAccessResponse), &traces); err != nil {
+		t.Fatalf("Failed to decode traces: %v", err)
+	}
+
+	codeCache, err := lru.New(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule, err := witness.LookupSchedule(witness.DefaultSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aa, bb, cc := common.HexToAddress("0xaa"), common.HexToAddress("0xbb"), common.HexToAddress("0xcc")
+	codeCache.Add(codeCacheKey(aa, 99), &Code{addr: aa, code: make([]byte, 20)})
+	codeCache.Add(codeCacheKey(bb, 99), &Code{addr: bb, code: make([]byte, 4)})
+	codeCache.Add(codeCacheKey(cc, 100), &Code{addr: cc, code: make([]byte, 2)}) // Deployed by the first transaction
+	// Only the block transactions are fetched, any code missing from the cache fails the analysis
+	client := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		if method != "eth_getBlockByNumber" {
+			return nil, fmt.Errorf("unexpected call %s", method)
+		}
+		return map[string]any{"transactions": []map[string]any{
+			{"hash": common.HexToHash("0x01"), "to": "0xaa", "type": "0x2", "transactionIndex": "0x0"},
+			{"hash": common.HexToHash("0x02"), "to": "0xcc", "type": "0x4", "transactionIndex": "0x1"},
+		}}, nil
+	})
+	pool := newRpcPool([]*RpcClient{client})
+	analyzer := NewAnalyzer(0, pool, NewTraceRetriever(pool, "", nil), codeCache, schedule, 4)
+
+	result, err := analyzer.AnalyzeCodeAccess(100, traces)
+	if err != nil {
+		t.Fatalf("AnalyzeCodeAccess() failed: %v", err)
+	}
+	if len(result.Txs) != 2 || result.Txs[1].TxHash != "0x02" || result.Txs[1].TxIndex != 1 || result.Txs[1].TxType != 4 {
+		t.Fatalf("Unexpected transactions %+v", result.Txs)
+	}
+
+	// Both accesses to 0xaa are merged, the range past the end of the code is dropped
+	first := result.Txs[0]
+	if res := first.Results[aa]; res.Bits.Count() != 5 || res.CopyBits.Count() != 2 || res.CodeSizeCount != 1 || res.CodeCopyCount != 1 {
+		t.Errorf("Unexpected result for 0xaa: %v", res)
+	}
+	if res := first.Results[bb]; res.Bits.Count() != 0 || res.CopyBits.Count() != 4 || res.CodeCopyCount != 1 {
+		t.Errorf("Unexpected result for 0xbb: %v", res)
+	}
+	if first.WitnessGas == 0 {
+		t.Error("Expected witness gas for the first transaction")
+	}
+
+	initCodeHash := crypto.Keccak256Hash([]byte{0x60, 0x01, 0x60, 0x02, 0x5b, 0x00})
+	if res := first.InitCodes[initCodeHash]; res == nil || res.Bits.Count() != 3 {
+		t.Errorf("Unexpected initcode result %v", res)
+	}
+
+	if res := result.Results[cc]; res == nil || res.Bits.Count() != 1 {
+		t.Errorf("Unexpected result for 0xcc: %v", res)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/spf13/viper"
+	"github.com/weiihann/chunk-analysis/internal/sampler"
+	"github.com/weiihann/chunk-analysis/internal/witness"
 )
 
 type Config struct {
@@ -17,6 +19,10 @@ type Config struct {
 	TraceDir  string `mapstructure:"TRACE_DIR"`
 	ResultDir string `mapstructure:"RESULT_DIR"`
 
+	// Write-through cache of the traces fetched over RPC, in TRACE_DIR
+	TraceCache      bool  `mapstructure:"TRACE_CACHE"`
+	TraceCacheMaxMB int64 `mapstructure:"TRACE_CACHE_MAX_MB"` // 0 means unlimited
+
 	// Logging configuration
 	LogLevel  string `mapstructure:"LOG_LEVEL"`
 	LogFormat string `mapstructure:"LOG_FORMAT"`
@@ -25,22 +31,65 @@ type Config struct {
 	GlobalStartBlock uint64 `mapstructure:"GLOBAL_START_BLOCK"`
 	GlobalEndBlock   uint64 `mapstructure:"GLOBAL_END_BLOCK"`
 
-	StartBlocks []uint64 `mapstructure:"START_BLOCKS"`
-	EndBlocks   []uint64 `mapstructure:"END_BLOCKS"`
-
 	// Retry configuration
 	RetryMaxAttempts int  `mapstructure:"RETRY_MAX_ATTEMPTS"`
 	RetryBaseDelay   int  `mapstructure:"RETRY_BASE_DELAY_MS"`
 	RetryMaxDelay    int  `mapstructure:"RETRY_MAX_DELAY_MS"`
 	RetryJitter      bool `mapstructure:"RETRY_JITTER"`
 
+	// Consecutive retryable failures after which an endpoint gets no calls for the cooldown
+	CircuitBreakerThreshold int `mapstructure:"CIRCUIT_BREAKER_THRESHOLD"`
+	CircuitBreakerCooldown  int `mapstructure:"CIRCUIT_BREAKER_COOLDOWN_MS"`
+
+	// Address to serve the expvar metrics on, at /debug/vars. Disabled if empty.
+	MetricsAddr string `mapstructure:"METRICS_ADDR"`
+
+	// Maximum number of eth_getCode calls per JSON-RPC batch
+	RPCBatchSize int `mapstructure:"RPC_BATCH_SIZE"`
+
+	// Requests per second and concurrent requests of each endpoint, either one value per RPC_URLS entry
+	// or a single value for all of them. 0 or empty means unlimited.
+	RPCRateLimit      []int `mapstructure:"RPC_RATE_LIMIT"`
+	RPCMaxConcurrency []int `mapstructure:"RPC_MAX_CONCURRENCY"`
+
 	ChunkSize  uint32 `mapstructure:"CHUNK_SIZE"`
 	SampleSize uint64 `mapstructure:"SAMPLE_SIZE"`
+
+	// Sampling configuration, see the sampler package for the strategies
+	SampleStrategy string `mapstructure:"SAMPLE_STRATEGY"`
+	SampleSeed     uint64 `mapstructure:"SAMPLE_SEED"`
+	SampleStrata   int    `mapstructure:"SAMPLE_STRATA"`
+	SampleFile     string `mapstructure:"SAMPLE_FILE"`
+
+	// Concurrent block stats requests of the stratified strategies, which look up 4 blocks per sampled block
+	SampleStatsConcurrency int `mapstructure:"SAMPLE_STATS_CONCURRENCY"`
+
+	// Extra chunk sizes computed from the same trace pass, each emitted as its own columns
+	ChunkSizes []uint32 `mapstructure:"CHUNK_SIZES"`
+
+	// Also write one row per (transaction, contract) next to the block-merged rows
+	PerTxOutput bool `mapstructure:"PER_TX_OUTPUT"`
+
+	// Format of the result files, the number of blocks per Parquet row group and of row groups per Parquet part
+	OutputFormat          string `mapstructure:"OUTPUT_FORMAT"`
+	ParquetRowGroupBlocks int    `mapstructure:"PARQUET_ROW_GROUP_BLOCKS"`
+	ParquetFileRowGroups  int    `mapstructure:"PARQUET_FILE_ROW_GROUPS"`
+
+	// Witness gas parameter table used to simulate code access costs, and the JSON file of the tables
+	// available on top of the built-in ones
+	GasSchedule     string `mapstructure:"GAS_SCHEDULE"`
+	GasScheduleFile string `mapstructure:"GAS_SCHEDULE_FILE"`
+
+	// Tracer used to get the code accesses of a block, the struct logs are the fallback of the code access tracer
+	Tracer string `mapstructure:"TRACER"`
+
+	// Skip the blocks recorded in the workers' checkpoints and roll their output files back to them, instead of starting over
+	Resume bool `mapstructure:"RESUME"`
 }
 
 func (c *Config) String() string {
-	return fmt.Sprintf("Config{RPCURLs: %v, TraceDir: %s, LogLevel: %s, LogFormat: %s, LogFile: %s, GlobalStartBlock: %d, GlobalEndBlock: %d, StartBlocks: %v, EndBlocks: %v, RetryMaxAttempts: %d, RetryBaseDelay: %d, RetryMaxDelay: %d, RetryJitter: %t, ChunkSize: %d, SampleSize: %d}",
-		c.RPCURLs, c.TraceDir, c.LogLevel, c.LogFormat, c.LogFile, c.GlobalStartBlock, c.GlobalEndBlock, c.StartBlocks, c.EndBlocks, c.RetryMaxAttempts, c.RetryBaseDelay, c.RetryMaxDelay, c.RetryJitter, c.ChunkSize, c.SampleSize)
+	return fmt.Sprintf("Config{RPCURLs: %v, TraceDir: %s, TraceCache: %t, TraceCacheMaxMB: %d, LogLevel: %s, LogFormat: %s, LogFile: %s, GlobalStartBlock: %d, GlobalEndBlock: %d, RetryMaxAttempts: %d, RetryBaseDelay: %d, RetryMaxDelay: %d, RetryJitter: %t, CircuitBreakerThreshold: %d, CircuitBreakerCooldown: %d, MetricsAddr: %s, RPCBatchSize: %d, RPCRateLimit: %v, RPCMaxConcurrency: %v, ChunkSize: %d, SampleSize: %d, SampleStrategy: %s, SampleSeed: %d, SampleStrata: %d, SampleFile: %s, SampleStatsConcurrency: %d, ChunkSizes: %v, PerTxOutput: %t, OutputFormat: %s, ParquetRowGroupBlocks: %d, ParquetFileRowGroups: %d, GasSchedule: %s, GasScheduleFile: %s, Tracer: %s, Resume: %t}",
+		c.RPCURLs, c.TraceDir, c.TraceCache, c.TraceCacheMaxMB, c.LogLevel, c.LogFormat, c.LogFile, c.GlobalStartBlock, c.GlobalEndBlock, c.RetryMaxAttempts, c.RetryBaseDelay, c.RetryMaxDelay, c.RetryJitter, c.CircuitBreakerThreshold, c.CircuitBreakerCooldown, c.MetricsAddr, c.RPCBatchSize, c.RPCRateLimit, c.RPCMaxConcurrency, c.ChunkSize, c.SampleSize, c.SampleStrategy, c.SampleSeed, c.SampleStrata, c.SampleFile, c.SampleStatsConcurrency, c.ChunkSizes, c.PerTxOutput, c.OutputFormat, c.ParquetRowGroupBlocks, c.ParquetFileRowGroups, c.GasSchedule, c.GasScheduleFile, c.Tracer, c.Resume)
 }
 
 func LoadConfig(path string) (config Config, err error) {
@@ -115,6 +164,13 @@ func validateConfig(config Config) error {
 		}
 	}
 
+	if config.TraceCacheMaxMB < 0 {
+		errors = append(errors, ValidationError{
+			Field:   "TRACE_CACHE_MAX_MB",
+			Message: "trace cache size cap must be non-negative",
+		})
+	}
+
 	// Retry configuration validation
 	if config.RetryMaxAttempts < 1 {
 		errors = append(errors, ValidationError{
@@ -137,10 +193,160 @@ func validateConfig(config Config) error {
 		})
 	}
 
-	if config.ChunkSize < 1 {
+	if config.CircuitBreakerThreshold < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "CIRCUIT_BREAKER_THRESHOLD",
+			Message: "circuit breaker threshold must be at least 1",
+		})
+	}
+
+	if config.CircuitBreakerCooldown < 0 {
+		errors = append(errors, ValidationError{
+			Field:   "CIRCUIT_BREAKER_COOLDOWN_MS",
+			Message: "circuit breaker cooldown must be non-negative",
+		})
+	}
+
+	if config.RPCBatchSize < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "RPC_BATCH_SIZE",
+			Message: "rpc batch size must be at least 1",
+		})
+	}
+
+	endpointLimits := []struct {
+		field  string
+		limits []int
+	}{
+		{"RPC_RATE_LIMIT", config.RPCRateLimit},
+		{"RPC_MAX_CONCURRENCY", config.RPCMaxConcurrency},
+	}
+	for _, l := range endpointLimits {
+		field, limits := l.field, l.limits
+		if len(limits) > 1 && len(limits) != len(config.RPCURLs) {
+			errors = append(errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("expected a single limit or one per rpc url (%d), got %d", len(config.RPCURLs), len(limits)),
+			})
+		}
+		if slices.ContainsFunc(limits, func(limit int) bool { return limit < 0 }) {
+			errors = append(errors, ValidationError{
+				Field:   field,
+				Message: "limits must be non-negative",
+			})
+		}
+	}
+
+	if config.GlobalEndBlock < config.GlobalStartBlock {
+		errors = append(errors, ValidationError{
+			Field:   "GLOBAL_END_BLOCK",
+			Message: "global end block must be greater than or equal to global start block",
+		})
+	}
+
+	if config.SampleSize < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "SAMPLE_SIZE",
+			Message: "sample size must be at least 1",
+		})
+	}
+
+	strategy := strings.ToLower(config.SampleStrategy)
+	if !slices.Contains(sampler.Strategies(), strategy) {
+		errors = append(errors, ValidationError{
+			Field:   "SAMPLE_STRATEGY",
+			Message: fmt.Sprintf("sample strategy must be one of: %s", strings.Join(sampler.Strategies(), ", ")),
+		})
+	}
+
+	if (strategy == sampler.Gas || strategy == sampler.TxCount) && config.SampleStrata < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "SAMPLE_STRATA",
+			Message: "number of strata must be at least 1",
+		})
+	}
+
+	if (strategy == sampler.Gas || strategy == sampler.TxCount) && config.SampleStatsConcurrency < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "SAMPLE_STATS_CONCURRENCY",
+			Message: "sample stats concurrency must be at least 1",
+		})
+	}
+
+	if strategy == sampler.File && config.SampleFile == "" {
+		errors = append(errors, ValidationError{
+			Field:   "SAMPLE_FILE",
+			Message: "sample file is required with the file strategy",
+		})
+	}
+
+	if config.ChunkSize < 1 || config.ChunkSize > maxChunkSize {
 		errors = append(errors, ValidationError{
 			Field:   "CHUNK_SIZE",
-			Message: "chunk size must be at least 1",
+			Message: fmt.Sprintf("chunk size must be between 1 and %d", maxChunkSize),
+		})
+	}
+
+	for _, size := range config.ChunkSizes {
+		if size < 1 || size > maxChunkSize {
+			errors = append(errors, ValidationError{
+				Field:   "CHUNK_SIZES",
+				Message: fmt.Sprintf("chunk size %d must be between 1 and %d", size, maxChunkSize),
+			})
+		}
+	}
+
+	if !slices.Contains(OutputFormats(), config.OutputFormat) {
+		errors = append(errors, ValidationError{
+			Field:   "OUTPUT_FORMAT",
+			Message: fmt.Sprintf("output format must be one of: %s", strings.Join(OutputFormats(), ", ")),
+		})
+	}
+
+	if config.OutputFormat == OutputParquet && config.ParquetRowGroupBlocks < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "PARQUET_ROW_GROUP_BLOCKS",
+			Message: "parquet row group must hold at least 1 block",
+		})
+	}
+
+	if config.OutputFormat == OutputParquet && config.ParquetFileRowGroups < 1 {
+		errors = append(errors, ValidationError{
+			Field:   "PARQUET_FILE_ROW_GROUPS",
+			Message: "parquet part must hold at least 1 row group",
+		})
+	}
+
+	if config.PerTxOutput && config.OutputFormat != OutputCSV {
+		errors = append(errors, ValidationError{
+			Field:   "PER_TX_OUTPUT",
+			Message: fmt.Sprintf("per-transaction rows are only written as CSV, not with output format %s", config.OutputFormat),
+		})
+	}
+
+	if schedules, err := witness.ReadSchedules(config.GasScheduleFile); err != nil {
+		errors = append(errors, ValidationError{
+			Field:   "GAS_SCHEDULE_FILE",
+			Message: err.Error(),
+		})
+	} else if _, err := schedules.Lookup(config.GasSchedule); err != nil {
+		errors = append(errors, ValidationError{
+			Field:   "GAS_SCHEDULE",
+			Message: err.Error(),
+		})
+	}
+
+	if !slices.Contains(Tracers(), config.Tracer) {
+		errors = append(errors, ValidationError{
+			Field:   "TRACER",
+			Message: fmt.Sprintf("tracer must be one of: %s", strings.Join(Tracers(), ", ")),
+		})
+	}
+
+	if config.Tracer == TracerReplay && config.TraceDir == "" {
+		errors = append(errors, ValidationError{
+			Field:   "TRACE_DIR",
+			Message: "trace directory is required to replay blocks from their replay files",
 		})
 	}
 
@@ -151,9 +357,20 @@ func validateConfig(config Config) error {
 	return nil
 }
 
+// Schedule returns the configured gas schedule, which may be defined in the gas schedule file
+func (c *Config) Schedule() (witness.Schedule, error) {
+	schedules, err := witness.ReadSchedules(c.GasScheduleFile)
+	if err != nil {
+		return witness.Schedule{}, err
+	}
+	return schedules.Lookup(c.GasSchedule)
+}
+
 func setDefaults() {
 	viper.SetDefault("RPC_URLS", []string{"http://localhost:8545"})
 	viper.SetDefault("DATA_DIR", "data")
+	viper.SetDefault("TRACE_CACHE", true)
+	viper.SetDefault("TRACE_CACHE_MAX_MB", 0)
 	viper.SetDefault("LOG_LEVEL", "info")
 	viper.SetDefault("LOG_FORMAT", "text")
 	viper.SetDefault("LOG_FILE", "")
@@ -161,8 +378,27 @@ func setDefaults() {
 	viper.SetDefault("RETRY_BASE_DELAY_MS", 1000)
 	viper.SetDefault("RETRY_MAX_DELAY_MS", 20000)
 	viper.SetDefault("RETRY_JITTER", true)
+	viper.SetDefault("CIRCUIT_BREAKER_THRESHOLD", 5)
+	viper.SetDefault("CIRCUIT_BREAKER_COOLDOWN_MS", 30000)
+	viper.SetDefault("METRICS_ADDR", "")
+	viper.SetDefault("RPC_BATCH_SIZE", 100)
+	viper.SetDefault("RPC_RATE_LIMIT", []int{})
+	viper.SetDefault("RPC_MAX_CONCURRENCY", []int{})
 	viper.SetDefault("CHUNK_SIZE", 31)
 	viper.SetDefault("SAMPLE_SIZE", 100000)
+	viper.SetDefault("SAMPLE_STRATEGY", sampler.Uniform)
+	viper.SetDefault("SAMPLE_SEED", 0)
+	viper.SetDefault("SAMPLE_STRATA", 10)
+	viper.SetDefault("SAMPLE_FILE", "")
+	viper.SetDefault("SAMPLE_STATS_CONCURRENCY", 16)
+	viper.SetDefault("PER_TX_OUTPUT", false)
+	viper.SetDefault("OUTPUT_FORMAT", OutputCSV)
+	viper.SetDefault("PARQUET_ROW_GROUP_BLOCKS", 1000)
+	viper.SetDefault("PARQUET_FILE_ROW_GROUPS", 10)
+	viper.SetDefault("GAS_SCHEDULE", witness.DefaultSchedule)
+	viper.SetDefault("GAS_SCHEDULE_FILE", "")
+	viper.SetDefault("TRACER", TracerStructLog)
+	viper.SetDefault("RESUME", false)
 }
 
 func expandPath(path string) string {
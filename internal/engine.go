@@ -2,10 +2,18 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"slices"
+	"time"
 
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/hashicorp/golang-lru"
 	"github.com/weiihann/chunk-analysis/internal/logger"
+	"github.com/weiihann/chunk-analysis/internal/sampler"
+	"github.com/weiihann/chunk-analysis/internal/witness"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -23,85 +31,139 @@ func NewEngine(config *Config) *Engine {
 }
 
 func (e *Engine) Run(ctx context.Context) {
-	// Set chunk size (definitely not a good practice)
-	chunkSize = e.config.ChunkSize
-	e.log.Info("chunk size", "chunk_size", chunkSize)
+	e.log.Info("chunk size", "chunk_size", e.config.ChunkSize)
 
-	analyzers := e.prepare(ctx)
+	if e.config.MetricsAddr != "" {
+		go e.serveMetrics()
+	}
 
-	// Split the analyzers into different chunks
-	// Calculate total blocks and distribute evenly among workers
-	var workers errgroup.Group
+	pool, err := NewRpcPool(e.config.RPCURLs, ctx, e.config)
+	if err != nil {
+		e.log.Error("no rpc client available", "error", err)
+		return
+	}
+	defer pool.Close()
+	defer pool.LogStats()
 
-	startBlocks := e.config.StartBlocks
-	endBlocks := e.config.EndBlocks
+	schedule, err := e.config.Schedule()
+	if err != nil {
+		e.log.Error("failed to load gas schedule", "error", err)
+		return
+	}
 
-	if len(startBlocks) != len(endBlocks) && len(startBlocks) != len(analyzers) {
-		panic("startBlocks and endBlocks must have the same length as analyzers")
+	if err := WriteRunManifest(e.config.ResultDir, NewRunManifest(e.config, schedule, pool.NodeVersions())); err != nil {
+		e.log.Error("failed to write run manifest", "error", err)
+		return
 	}
 
-	blockInc := (e.config.GlobalEndBlock - e.config.GlobalStartBlock + 1) / e.config.SampleSize
+	analyzers := e.prepare(pool, schedule)
 
-	for i := 0; i < len(analyzers); i++ {
-		workerIdx := i
-		worker := analyzers[i]
+	sinks := make([][]ResultSink, len(analyzers))
+	files := make([][]string, len(analyzers))
+	for i := range analyzers {
+		sinks[i], err = NewResultSinks(e.config, i)
+		if err != nil {
+			e.log.Error("failed to create result sinks", "error", err)
+			return
+		}
+		for _, sink := range sinks[i] {
+			defer sink.Close()
+			files[i] = append(files[i], sink.Files()...)
+		}
+	}
+
+	blocks, err := e.sample(pool)
+	if err != nil {
+		e.log.Error("failed to sample blocks", "error", err)
+		return
+	}
+
+	checkpoints, err := e.startCheckpoints(files)
+	if err != nil {
+		e.log.Error("failed to load checkpoint", "error", err)
+		return
+	}
+	isDone := func(block uint64) bool {
+		return slices.ContainsFunc(checkpoints, func(cp *Checkpoint) bool { return cp.IsDone(block) })
+	}
 
-		start := startBlocks[workerIdx]
-		end := endBlocks[workerIdx]
+	// Every analyzer pulls its next block from the same queue, so a slow block only holds up the worker that took it
+	queue := newBlockQueue(blocks, isDone, time.Duration(e.config.CircuitBreakerCooldown)*time.Millisecond)
+
+	flushBlocks := e.flushBlocks()
+	var workers errgroup.Group
+	for i, worker := range analyzers {
+		workerIdx := i
+		workerSinks := sinks[i]
+		progress := newProgress(e.config.ResultDir, i, checkpoints[i])
 
 		workers.Go(func() error {
-			e.log.Info("starting worker", "worker_idx", workerIdx, "start", start, "end", end)
-			writer := NewResultWriter(e.config.ResultDir, workerIdx)
-
-			var retrievers errgroup.Group
-			traces := make(chan traceResult, 10)
-			retrievers.Go(func() error {
-				defer close(traces)
-				for block := start; block <= end; block += blockInc {
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					default:
-						trace, err := worker.retriever.GetTrace(block)
-						if err != nil {
-							return err
-						}
-						select {
-						case traces <- traceResult{
-							blockNum: block,
-							trace:    trace,
-						}:
-						case <-ctx.Done():
-							return ctx.Err()
-						}
+			e.log.Info("starting worker", "worker_idx", workerIdx)
+
+			// Blocks written since the last flush, checkpointed once flushed
+			var pending []uint64
+			flush := func() error {
+				if len(pending) == 0 {
+					return nil
+				}
+				var workerFiles []string
+				for _, sink := range workerSinks {
+					if err := sink.Flush(); err != nil {
+						return err
 					}
+					workerFiles = append(workerFiles, sink.Files()...)
+				}
+				sizes, err := fileSizes(e.config.ResultDir, workerFiles)
+				if err != nil {
+					return err
+				}
+				if err := progress.Done(pending, sizes); err != nil {
+					return err
 				}
+				pending = pending[:0]
 				return nil
-			})
+			}
 
 			for {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				case traceResult, ok := <-traces:
-					if !ok {
-						// If we broke out of the for loop because channel closed, wait for retrievers
-						if err := retrievers.Wait(); err != nil {
-							return err
-						}
-						return nil
+				default:
+				}
+
+				block, ok := queue.Next(ctx)
+				if !ok {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					return flush()
+				}
+
+				result, err := e.analyzeBlock(worker, block)
+				if err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
 					}
-					result, err := worker.Analyze(traceResult.blockNum, traceResult.trace)
-					if err != nil {
+					e.log.Warn("failed to analyze block, retrying", "worker_idx", workerIdx, "block", block, "error", err)
+					if err := queue.Retry(block, err); err != nil {
 						return err
 					}
+					continue
+				}
 
-					if err := writer.Write(traceResult.blockNum, result.Results); err != nil {
+				for _, sink := range workerSinks {
+					if err := sink.WriteBlock(result); err != nil {
+						return err
+					}
+				}
+				pending = append(pending, block)
+				if len(pending) >= flushBlocks {
+					if err := flush(); err != nil {
 						return err
 					}
-
-					e.log.Info("worker finished", "idx", workerIdx, "block", traceResult.blockNum)
 				}
+
+				e.log.Info("worker finished", "idx", workerIdx, "block", block)
 			}
 		})
 	}
@@ -111,31 +173,166 @@ func (e *Engine) Run(ctx context.Context) {
 	}
 }
 
-func (e *Engine) prepare(ctx context.Context) []*Analyzer {
-	var analyzers []*Analyzer
+// flushBlocks is the number of blocks a worker writes between two flushes. CSV rows are flushed and SQLite
+// rows committed after every block, while each Parquet flush completes a part of several row groups.
+func (e *Engine) flushBlocks() int {
+	if e.config.OutputFormat == OutputParquet {
+		return e.config.ParquetRowGroupBlocks * e.config.ParquetFileRowGroups
+	}
+	return 1
+}
 
-	codeCache, err := lru.New(100000)
+// serveMetrics serves the expvar metrics, including the RPC counters, at /debug/vars
+func (e *Engine) serveMetrics() {
+	e.log.Info("serving metrics", "addr", e.config.MetricsAddr)
+	if err := http.ListenAndServe(e.config.MetricsAddr, nil); err != nil {
+		e.log.Error("failed to serve metrics", "addr", e.config.MetricsAddr, "error", err)
+	}
+}
+
+// analyzeBlock streams the trace of the block into the analyzer. With the code access tracer, the struct
+// logs are only fetched if the node fails to run the tracer. With replay, the block is executed locally.
+func (e *Engine) analyzeBlock(worker *Analyzer, block uint64) (BlockResult, error) {
+	if e.config.Tracer == TracerReplay {
+		replay, err := ReadReplayBlock(e.config.TraceDir, block)
+		if err != nil {
+			return BlockResult{}, err
+		}
+		return worker.Replay(replay)
+	}
+
+	if e.config.Tracer == TracerCodeAccess {
+		traces, err := worker.retriever.GetCodeAccess(block)
+		var rpcErr rpc.Error
+		switch {
+		case err == nil:
+			return worker.AnalyzeCodeAccess(block, traces)
+		case errors.As(err, &rpcErr):
+			// Endpoints rejecting the tracer warn once, when they first do
+			e.log.Debug("code access tracer failed, falling back to struct logs", "block", block, "error", err)
+		default:
+			return BlockResult{}, err
+		}
+	}
+
+	stream, err := worker.retriever.StreamTrace(block)
 	if err != nil {
-		panic(err)
+		return BlockResult{}, err
 	}
+	defer stream.Close()
+	return worker.AnalyzeStream(block, stream)
+}
 
-	for i := 0; i < len(e.config.RPCURLs); i++ {
-		client, err := NewRpcClient(e.config.RPCURLs[i], ctx, e.config)
+// sample returns the blocks of the run and records them in the sample manifest.
+// When resuming, the blocks of the existing manifest are reused as is.
+func (e *Engine) sample(source sampler.StatsSource) ([]uint64, error) {
+	if e.config.Resume {
+		manifest, err := sampler.ReadManifest(e.config.ResultDir)
 		if err != nil {
-			e.log.Error("failed to create rpc client", "error", err)
-			continue
+			return nil, err
+		}
+		if manifest != nil {
+			e.log.Info("reusing sample", "strategy", manifest.Strategy, "seed", manifest.Seed, "blocks", len(manifest.Blocks))
+			return manifest.Blocks, nil
 		}
+	}
 
-		retriever := NewTraceRetriever(client, e.config.TraceDir)
+	config := sampler.Config{
+		Strategy:         e.config.SampleStrategy,
+		StartBlock:       e.config.GlobalStartBlock,
+		EndBlock:         e.config.GlobalEndBlock,
+		Size:             e.config.SampleSize,
+		Seed:             e.config.SampleSeed,
+		Strata:           e.config.SampleStrata,
+		File:             e.config.SampleFile,
+		StatsConcurrency: e.config.SampleStatsConcurrency,
+	}
+	s, err := sampler.New(config, source)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := s.Sample()
+	if err != nil {
+		return nil, err
+	}
 
-		analyzer := NewAnalyzer(i, client, retriever, codeCache)
-		analyzers = append(analyzers, analyzer)
+	if err := sampler.WriteManifest(e.config.ResultDir, sampler.NewManifest(config, blocks)); err != nil {
+		return nil, err
 	}
+	e.log.Info("sampled blocks", "strategy", config.Strategy, "seed", config.Seed, "blocks", len(blocks))
+	return blocks, nil
+}
 
-	return analyzers
+// startCheckpoints returns the checkpoint each worker starts from, given the output files of each worker.
+// When resuming, every worker's files are rolled back to its last checkpoint, and the blocks any worker
+// recorded as written are skipped. Otherwise a new checkpoint is taken before the first block, with the
+// files as they currently are.
+func (e *Engine) startCheckpoints(files [][]string) ([]*Checkpoint, error) {
+	checkpoints := make([]*Checkpoint, len(files))
+	if e.config.Resume {
+		var found, done int
+		for worker := range files {
+			checkpoint, err := LoadCheckpoint(e.config.ResultDir, worker)
+			if err != nil {
+				return nil, fmt.Errorf("worker %d: %w", worker, err)
+			}
+			if checkpoint != nil {
+				checkpoints[worker] = checkpoint
+				found++
+				done += len(checkpoint.Done)
+			}
+		}
+		if found == len(files) {
+			for worker, checkpoint := range checkpoints {
+				if err := checkpoint.Restore(e.config.ResultDir, files[worker]); err != nil {
+					return nil, fmt.Errorf("failed to restore the checkpoint of worker %d: %w", worker, err)
+				}
+			}
+			e.log.Info("resuming", "workers", len(files), "done", done)
+			return checkpoints, nil
+		}
+		// Every checkpoint is taken before the first block, so a missing one means the files don't match the run
+		if found > 0 {
+			return nil, fmt.Errorf("found the checkpoints of %d workers out of %d", found, len(files))
+		}
+		e.log.Warn("no checkpoint to resume from, starting over")
+	}
+
+	for worker := range files {
+		sizes, err := fileSizes(e.config.ResultDir, files[worker])
+		if err != nil {
+			return nil, err
+		}
+		checkpoints[worker] = &Checkpoint{Files: sizes}
+		if err := SaveCheckpoint(e.config.ResultDir, worker, checkpoints[worker]); err != nil {
+			return nil, err
+		}
+	}
+	return checkpoints, nil
 }
 
-type traceResult struct {
-	blockNum uint64
-	trace    []TransactionTrace
+// prepare creates one analyzer per RPC URL, all sharing the pool. The workers aren't tied to an endpoint: every
+// call goes through the pool, which picks the endpoint and fails over. Their number, and so the number of output
+// files, only follows the configured URLs rather than those that are up, for a resumed run to find the same files.
+func (e *Engine) prepare(pool *RpcPool, schedule witness.Schedule) []*Analyzer {
+	var analyzers []*Analyzer
+
+	codeCache, err := lru.New(100000)
+	if err != nil {
+		panic(err)
+	}
+
+	// Traces fetched over RPC are written through to the trace directory
+	var traceCache *TraceCache
+	if e.config.TraceDir != "" && e.config.TraceCache {
+		traceCache = NewTraceCache(e.config.TraceDir, e.config.TraceCacheMaxMB<<20)
+	}
+
+	retriever := NewTraceRetriever(pool, e.config.TraceDir, traceCache)
+	for i := 0; i < len(e.config.RPCURLs); i++ {
+		analyzer := NewAnalyzer(i, pool, retriever, codeCache, schedule, e.config.ChunkSize)
+		analyzers = append(analyzers, analyzer)
+	}
+
+	return analyzers
 }
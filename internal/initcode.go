@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// blockInitCodes provides, for every transaction of a block, the initcode of its CREATE/CREATE2 frames
+// in execution order. The struct logs are traced without memory, so the initcode is taken from the
+// callTracer instead, which is only queried once a transaction actually executes CREATE/CREATE2.
+type blockInitCodes struct {
+	retriever *TraceRetriever
+	blockNum  uint64
+	frames    []CallFrameTrace // nil until fetched
+}
+
+func (a *Analyzer) newBlockInitCodes(blockNum uint64) *blockInitCodes {
+	return &blockInitCodes{
+		retriever: a.retriever,
+		blockNum:  blockNum,
+	}
+}
+
+// forTx returns the initcode of the CREATE/CREATE2 frames of the transaction at index txIndex
+func (b *blockInitCodes) forTx(txIndex int, tx *TransactionTrace) ([][]byte, error) {
+	if !hasCreate(tx) {
+		return nil, nil
+	}
+
+	if b.frames == nil {
+		frames, err := b.retriever.GetCallFrames(b.blockNum)
+		if err != nil {
+			return nil, err
+		}
+		b.frames = frames
+	}
+
+	if txIndex >= len(b.frames) {
+		return nil, fmt.Errorf("call frames mismatch for block %d: %d frames, tx %d", b.blockNum, len(b.frames), txIndex)
+	}
+	frame := b.frames[txIndex]
+	if frame.TxHash != "" && frame.TxHash != tx.TxHash {
+		return nil, fmt.Errorf("call frames mismatch for block %d: tx %d is %s, expected %s", b.blockNum, txIndex, frame.TxHash, tx.TxHash)
+	}
+
+	// The top frame is the transaction itself, whose initcode comes from the transaction input
+	return collectCreateInitCodes(frame.Result.Calls, nil)
+}
+
+// checkCount verifies that the call frames, if they were fetched, cover exactly the transactions of the block
+func (b *blockInitCodes) checkCount(txCount int) error {
+	if b.frames != nil && len(b.frames) != txCount {
+		return fmt.Errorf("call frames mismatch for block %d: %d frames, %d traces", b.blockNum, len(b.frames), txCount)
+	}
+	return nil
+}
+
+// collectCreateInitCodes walks the call frames depth-first, which is the order their CREATE/CREATE2
+// opcodes were executed in.
+func collectCreateInitCodes(frames []CallFrame, initCodes [][]byte) ([][]byte, error) {
+	for _, frame := range frames {
+		if frame.Type == OpCreate || frame.Type == OpCreate2 {
+			initCode, err := hexutil.Decode(frame.Input)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode initcode: %w", err)
+			}
+			initCodes = append(initCodes, initCode)
+		}
+
+		var err error
+		initCodes, err = collectCreateInitCodes(frame.Calls, initCodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return initCodes, nil
+}
+
+// hasCreate reports whether the transaction executes CREATE or CREATE2.
+func hasCreate(tx *TransactionTrace) bool {
+	for _, step := range tx.Result.Steps {
+		if step.Op == OpCreate || step.Op == OpCreate2 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCollectCreateInitCodes(t *testing.T) {
+	frames := []CallFrame{
+		{
+			Type: "CALL",
+			Calls: []CallFrame{
+				{Type: OpCreate, Input: "0x6001", Calls: []CallFrame{
+					{Type: OpCreate2, Input: "0x6002"},
+				}},
+				{Type: "STATICCALL", Input: "0xdeadbeef"},
+			},
+		},
+		{Type: OpCreate2, Input: "0x6003"},
+	}
+
+	initCodes, err := collectCreateInitCodes(frames, nil)
+	if err != nil {
+		t.Fatalf("collectCreateInitCodes() failed: %v", err)
+	}
+
+	expected := [][]byte{{0x60, 0x01}, {0x60, 0x02}, {0x60, 0x03}}
+	if len(initCodes) != len(expected) {
+		t.Fatalf("Expected %d initcodes, got %d", len(expected), len(initCodes))
+	}
+	for i := range expected {
+		if !bytes.Equal(initCodes[i], expected[i]) {
+			t.Errorf("initcode %d: got %x, want %x", i, initCodes[i], expected[i])
+		}
+	}
+}
+
+func TestNewInitCodeBitSet(t *testing.T) {
+	bs := NewInitCodeBitSet(maxInitCodeBytes, 32)
+	bs.Set(maxInitCodeBytes - 1)
+	if bs.Count() != 1 {
+		t.Errorf("Count() = %d, expected 1", bs.Count())
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("NewInitCodeBitSet() should have panicked above the initcode limit")
+		}
+	}()
+	NewInitCodeBitSet(maxInitCodeBytes+1, 32)
+}
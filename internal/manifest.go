@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+// SchemaVersion is the version of the columns of the result files, bumped whenever they change
+const SchemaVersion = 1
+
+// RunManifestFile is the name of the run manifest in the result directory
+const RunManifestFile = "manifest.json"
+
+// Version is the version of the tool, set from the build flags
+var Version = "dev"
+
+// RunManifest describes how the result files of a directory were produced. The chunks of every file are only
+// comparable with those of files produced with the same chunk sizes.
+type RunManifest struct {
+	SchemaVersion int      `json:"schema_version"`
+	ToolVersion   string   `json:"tool_version"`
+	ConfigHash    string   `json:"config_hash"`
+	ChunkSize     uint32   `json:"chunk_size"`
+	ChunkSizes    []uint32 `json:"chunk_sizes,omitempty"` // Extra chunk sizes, in the order of their columns
+	OutputFormat  string   `json:"output_format"`
+	Tracer        string   `json:"tracer"`
+	GasSchedule   string   `json:"gas_schedule"`
+	BranchCost    uint64   `json:"witness_branch_cost"` // Parameters of the gas schedule, which may come from a file
+	ChunkCost     uint64   `json:"witness_chunk_cost"`
+
+	// Sampling parameters, the sampled blocks are in the sample manifest
+	StartBlock     uint64 `json:"start_block"`
+	EndBlock       uint64 `json:"end_block"`
+	SampleStrategy string `json:"sample_strategy"`
+	SampleSize     uint64 `json:"sample_size"`
+	SampleSeed     uint64 `json:"sample_seed"`
+	SampleStrata   int    `json:"sample_strata,omitempty"`
+	SampleFile     string `json:"sample_file,omitempty"`
+
+	Nodes []NodeVersion `json:"nodes,omitempty"`
+
+	// Earlier runs with another config whose results are in the same files, oldest first
+	PreviousRuns []RunManifest `json:"previous_runs,omitempty"`
+}
+
+// NodeVersion is the web3_clientVersion of an RPC endpoint, empty if it didn't answer
+type NodeVersion struct {
+	Endpoint      string `json:"endpoint"`
+	ClientVersion string `json:"client_version"`
+}
+
+// NewRunManifest returns the manifest of a run with the given config and its gas schedule
+func NewRunManifest(config *Config, schedule witness.Schedule, nodes []NodeVersion) *RunManifest {
+	return &RunManifest{
+		SchemaVersion:  SchemaVersion,
+		ToolVersion:    Version,
+		ConfigHash:     configHash(config),
+		ChunkSize:      config.ChunkSize,
+		ChunkSizes:     config.ChunkSizes,
+		OutputFormat:   config.OutputFormat,
+		Tracer:         config.Tracer,
+		GasSchedule:    config.GasSchedule,
+		BranchCost:     schedule.BranchCost,
+		ChunkCost:      schedule.ChunkCost,
+		StartBlock:     config.GlobalStartBlock,
+		EndBlock:       config.GlobalEndBlock,
+		SampleStrategy: config.SampleStrategy,
+		SampleSize:     config.SampleSize,
+		SampleSeed:     config.SampleSeed,
+		SampleStrata:   config.SampleStrata,
+		SampleFile:     config.SampleFile,
+		Nodes:          nodes,
+	}
+}
+
+// configHash is the SHA-256 of the config, which doesn't change when a run is resumed
+func configHash(config *Config) string {
+	c := *config
+	c.Resume = false
+	sum := sha256.Sum256([]byte(c.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckCompatible returns an error if the result files described by the manifests can't be mixed, because
+// they have different columns or chunk sizes, or their accesses or witness gas were computed differently
+func (m *RunManifest) CheckCompatible(other *RunManifest) error {
+	if m.SchemaVersion != other.SchemaVersion {
+		return fmt.Errorf("schema version %d differs from %d", other.SchemaVersion, m.SchemaVersion)
+	}
+	if m.ChunkSize != other.ChunkSize {
+		return fmt.Errorf("chunk size %d differs from %d", other.ChunkSize, m.ChunkSize)
+	}
+	if !slices.Equal(m.ChunkSizes, other.ChunkSizes) {
+		return fmt.Errorf("extra chunk sizes %v differ from %v", other.ChunkSizes, m.ChunkSizes)
+	}
+	if m.GasSchedule != other.GasSchedule {
+		return fmt.Errorf("gas schedule %q differs from %q", other.GasSchedule, m.GasSchedule)
+	}
+	if m.BranchCost != other.BranchCost || m.ChunkCost != other.ChunkCost {
+		return fmt.Errorf("gas schedule %q costs %d/%d differ from %d/%d", other.GasSchedule, other.BranchCost, other.ChunkCost, m.BranchCost, m.ChunkCost)
+	}
+	if m.Tracer != other.Tracer {
+		return fmt.Errorf("tracer %q differs from %q", other.Tracer, m.Tracer)
+	}
+	return nil
+}
+
+// ReadRunManifest reads the run manifest from the directory, returning nil if there is none
+func ReadRunManifest(dir string) (*RunManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, RunManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run manifest: %w", err)
+	}
+
+	var m RunManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode run manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// WriteRunManifest writes the manifest to the directory. It refuses to if the directory already holds the
+// results of a run they can't be mixed with. The results of a compatible run with another config stay in the
+// same files, so its manifest is kept in the history of the new one.
+func WriteRunManifest(dir string, m *RunManifest) error {
+	existing, err := ReadRunManifest(dir)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if err := existing.CheckCompatible(m); err != nil {
+			return fmt.Errorf("%s holds results of another run: %w", dir, err)
+		}
+		m.PreviousRuns = existing.PreviousRuns
+		if existing.ConfigHash != m.ConfigHash {
+			previous := *existing
+			previous.PreviousRuns = nil
+			m.PreviousRuns = append(slices.Clone(existing.PreviousRuns), previous)
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run manifest: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	path := filepath.Join(dir, RunManifestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write run manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace run manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+func TestRunManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := ReadRunManifest(dir)
+	if err != nil || m != nil {
+		t.Fatalf("Expected no manifest, got %v, %v", m, err)
+	}
+
+	node := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		return "Geth/v1.15.11-stable/linux-amd64/go1.24.1", nil
+	})
+	schedule := witness.Schedules[witness.DefaultSchedule]
+	config := &Config{ChunkSize: 32, ChunkSizes: []uint32{64}, GlobalStartBlock: 1, GlobalEndBlock: 100, SampleSize: 10, OutputFormat: OutputCSV, GasSchedule: "eip4762", Tracer: TracerCodeAccess}
+	want := NewRunManifest(config, schedule, newRpcPool([]*RpcClient{node}).NodeVersions())
+	if err := WriteRunManifest(dir, want); err != nil {
+		t.Fatalf("WriteRunManifest() failed: %v", err)
+	}
+
+	got, err := ReadRunManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadRunManifest() failed: %v", err)
+	}
+	if got.SchemaVersion != SchemaVersion || got.ChunkSize != 32 || !slices.Equal(got.ChunkSizes, []uint32{64}) || got.EndBlock != 100 {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if len(got.Nodes) != 1 || got.Nodes[0].Endpoint != node.Endpoint() || !strings.HasPrefix(got.Nodes[0].ClientVersion, "Geth/") {
+		t.Errorf("Unexpected nodes %+v", got.Nodes)
+	}
+
+	// Resuming doesn't change the config hash
+	resumed := *config
+	resumed.Resume = true
+	if configHash(&resumed) != got.ConfigHash {
+		t.Errorf("Expected the config hash to ignore resuming")
+	}
+
+	// Resuming keeps the manifest of the run
+	if err := WriteRunManifest(dir, NewRunManifest(&resumed, schedule, nil)); err != nil {
+		t.Errorf("WriteRunManifest() failed: %v", err)
+	}
+	if got, _ := ReadRunManifest(dir); len(got.PreviousRuns) != 0 {
+		t.Errorf("Expected no previous run, got %+v", got.PreviousRuns)
+	}
+
+	// Another sample with the same chunk sizes can be added to the directory, the first run is kept in the history
+	resumed.SampleSeed = 42
+	if err := WriteRunManifest(dir, NewRunManifest(&resumed, schedule, nil)); err != nil {
+		t.Errorf("WriteRunManifest() failed: %v", err)
+	}
+	got, err = ReadRunManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadRunManifest() failed: %v", err)
+	}
+	if got.SampleSeed != 42 || len(got.PreviousRuns) != 1 || got.PreviousRuns[0].SampleSeed != 0 || got.PreviousRuns[0].ConfigHash != configHash(config) {
+		t.Errorf("Unexpected history %+v", got)
+	}
+	resumed.SampleSeed = 43
+	if err := WriteRunManifest(dir, NewRunManifest(&resumed, schedule, nil)); err != nil {
+		t.Errorf("WriteRunManifest() failed: %v", err)
+	}
+	if got, _ := ReadRunManifest(dir); len(got.PreviousRuns) != 2 || got.PreviousRuns[1].SampleSeed != 42 || got.PreviousRuns[1].PreviousRuns != nil {
+		t.Errorf("Unexpected history %+v", got.PreviousRuns)
+	}
+
+	// Results of another chunk size can't
+	other := *config
+	other.ChunkSize = 31
+	if err := WriteRunManifest(dir, NewRunManifest(&other, schedule, nil)); err == nil || !strings.Contains(err.Error(), "chunk size") {
+		t.Errorf("Expected a chunk size mismatch, got %v", err)
+	}
+	other = *config
+	other.ChunkSizes = nil
+	if err := WriteRunManifest(dir, NewRunManifest(&other, schedule, nil)); err == nil {
+		t.Errorf("Expected an extra chunk sizes mismatch")
+	}
+
+	// Nor results of another gas schedule or tracer
+	other = *config
+	other.GasSchedule = "other"
+	if err := WriteRunManifest(dir, NewRunManifest(&other, schedule, nil)); err == nil || !strings.Contains(err.Error(), "gas schedule") {
+		t.Errorf("Expected a gas schedule mismatch, got %v", err)
+	}
+	cheaper := schedule
+	cheaper.ChunkCost--
+	if err := WriteRunManifest(dir, NewRunManifest(config, cheaper, nil)); err == nil || !strings.Contains(err.Error(), "costs") {
+		t.Errorf("Expected a gas schedule costs mismatch, got %v", err)
+	}
+	other = *config
+	other.Tracer = TracerStructLog
+	if err := WriteRunManifest(dir, NewRunManifest(&other, schedule, nil)); err == nil || !strings.Contains(err.Error(), "tracer") {
+		t.Errorf("Expected a tracer mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/weiihann/chunk-analysis/internal/treekey"
+)
+
+// parquetContractRow has the columns of the CSV result rows, typed, with the chunks as lists of the number
+// of bytes accessed in each chunk instead of base64
+type parquetContractRow struct {
+	BlockNumber     uint64              `parquet:"block_number"`
+	Address         *string             `parquet:"address,optional"` // nil for initcode
+	BytecodeSize    uint32              `parquet:"bytecode_size"`
+	Chunks          []int32             `parquet:"chunks,list"`
+	CodeSizeCount   int32               `parquet:"code_size_count"`
+	CodeCopyCount   int32               `parquet:"code_copy_count"`
+	CodeCopyChunks  []int32             `parquet:"code_copy_chunks,list"`
+	StemsCount      int32               `parquet:"stems_count"`
+	HeaderStem      bool                `parquet:"header_stem"`
+	WitnessGas      uint64              `parquet:"witness_gas"`
+	CodeType        string              `parquet:"code_type"`
+	InitCodeHash    *string             `parquet:"initcode_hash,optional"` // nil for runtime code
+	ExtraChunkSizes []parquetChunkSizes `parquet:"extra_chunk_sizes,list"`
+}
+
+// parquetChunkSizes are the chunks of a contract for one of the extra chunk sizes
+type parquetChunkSizes struct {
+	ChunkSize  uint32  `parquet:"chunk_size"`
+	Chunks     []int32 `parquet:"chunks,list"`
+	StemsCount int32   `parquet:"stems_count"`
+}
+
+type parquetBlockRow struct {
+	BlockNumber      uint64 `parquet:"block_number"`
+	ContractsCount   int32  `parquet:"contracts_count"`
+	ChunksCount      int32  `parquet:"chunks_count"`
+	StemsCount       int32  `parquet:"stems_count"`
+	HeaderStemsCount int32  `parquet:"header_stems_count"`
+	WitnessGas       uint64 `parquet:"witness_gas"`
+}
+
+type parquetTxRow struct {
+	BlockNumber    uint64 `parquet:"block_number"`
+	TxHash         string `parquet:"tx_hash"`
+	TxIndex        int32  `parquet:"tx_index"`
+	TxType         int32  `parquet:"tx_type"`
+	ContractsCount int32  `parquet:"contracts_count"`
+	ChunksCount    int32  `parquet:"chunks_count"`
+	StemsCount     int32  `parquet:"stems_count"`
+	WitnessGas     uint64 `parquet:"witness_gas"`
+}
+
+// Prefixes of the part files, matching the names of the CSV files
+const (
+	parquetContractsPrefix = "analysis"
+	parquetBlocksPrefix    = "blocks"
+	parquetTxsPrefix       = "txs"
+)
+
+// ParquetWriter writes the contracts, blocks and transactions of a worker as parts of one file each, e.g.
+// analysis-0-00003.parquet. A part is written through a single parquet writer, ending a row group every
+// rowGroupBlocks blocks, and is only completed by the flush, which writes its footer. Until then it has a
+// temporary name, as a part without its footer can't be read: a part is never modified once complete, so
+// the checkpoint only has to drop the parts completed after it, and the incomplete ones are removed.
+type ParquetWriter struct {
+	dir            string
+	id             int
+	chunkSizes     []uint32 // Extra chunk sizes to emit, on top of the configured one
+	rowGroupBlocks int
+	nextPart       int
+	parts          []string // Names of the complete part files, including those written by previous runs
+
+	contracts *parquetFile[parquetContractRow] // Parts being written, nil until the first block after a flush
+	blocks    *parquetFile[parquetBlockRow]
+	txs       *parquetFile[parquetTxRow]
+	rowGroup  int // Blocks written since the last row group
+}
+
+func NewParquetWriter(dir string, id int, rowGroupBlocks int, chunkSizes ...uint32) (*ParquetWriter, error) {
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	w := &ParquetWriter{
+		dir:            dir,
+		id:             id,
+		chunkSizes:     chunkSizes,
+		rowGroupBlocks: rowGroupBlocks,
+	}
+
+	// Number the parts after those of previous runs, and drop the incomplete ones of an interrupted run
+	for _, prefix := range []string{parquetContractsPrefix, parquetBlocksPrefix, parquetTxsPrefix} {
+		matches, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%s-%d-*.parquet", prefix, id)))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			var partID, part int
+			if _, err := fmt.Sscanf(name, prefix+"-%d-%d.parquet", &partID, &part); err != nil {
+				continue
+			}
+			w.parts = append(w.parts, name)
+			w.nextPart = max(w.nextPart, part+1)
+		}
+
+		incomplete, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%s-%d-*.parquet.tmp-*", prefix, id)))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range incomplete {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove incomplete part: %w", err)
+			}
+		}
+	}
+	return w, nil
+}
+
+// WriteBlock writes the rows of the block to the current parts, which are complete once flushed
+func (w *ParquetWriter) WriteBlock(result BlockResult) error {
+	if w.blocks == nil {
+		if err := w.openParts(); err != nil {
+			return err
+		}
+	}
+
+	var contracts []parquetContractRow
+	blockNum := result.BlockNum
+	for address, res := range result.Results {
+		stems := res.Stems()
+		hex := address.Hex()
+		row := parquetContractRow{
+			BlockNumber:    blockNum,
+			Address:        &hex,
+			BytecodeSize:   res.Bits.Size(),
+			Chunks:         chunkCounts(res.Bits.Chunks()),
+			CodeSizeCount:  int32(res.CodeSizeCount),
+			CodeCopyCount:  int32(res.CodeCopyCount),
+			CodeCopyChunks: copyChunkCounts(res.CopyBits),
+			StemsCount:     int32(stems.Count),
+			HeaderStem:     stems.HeaderHit,
+			WitnessGas:     res.WitnessGas,
+			CodeType:       codeTypeRuntime,
+		}
+		for _, size := range w.chunkSizes {
+			row.ExtraChunkSizes = append(row.ExtraChunkSizes, parquetChunkSizes{
+				ChunkSize:  size,
+				Chunks:     chunkCounts(res.Bits.ChunksFor(size)),
+				StemsCount: int32(treekey.CountStems(res.AccessedChunksFor(size)).Count),
+			})
+		}
+		contracts = append(contracts, row)
+	}
+
+	// Initcode isn't part of the state tree, so it has no stems and no witness gas
+	for hash, res := range result.InitCodes {
+		hex := hash.Hex()
+		row := parquetContractRow{
+			BlockNumber:    blockNum,
+			BytecodeSize:   res.Bits.Size(),
+			Chunks:         chunkCounts(res.Bits.Chunks()),
+			CodeSizeCount:  int32(res.CodeSizeCount),
+			CodeCopyCount:  int32(res.CodeCopyCount),
+			CodeCopyChunks: copyChunkCounts(res.CopyBits),
+			CodeType:       codeTypeInitCode,
+			InitCodeHash:   &hex,
+		}
+		for _, size := range w.chunkSizes {
+			row.ExtraChunkSizes = append(row.ExtraChunkSizes, parquetChunkSizes{
+				ChunkSize: size,
+				Chunks:    chunkCounts(res.Bits.ChunksFor(size)),
+			})
+		}
+		contracts = append(contracts, row)
+	}
+
+	summary := summarizeBlock(result.Results)
+	block := parquetBlockRow{
+		BlockNumber:      blockNum,
+		ContractsCount:   int32(len(result.Results)),
+		ChunksCount:      int32(summary.chunksCount),
+		StemsCount:       int32(summary.stemsCount),
+		HeaderStemsCount: int32(summary.headerStemsCount),
+		WitnessGas:       summary.witnessGas,
+	}
+
+	var txs []parquetTxRow
+	for _, tx := range result.Txs {
+		summary := summarizeTx(tx)
+		txs = append(txs, parquetTxRow{
+			BlockNumber:    blockNum,
+			TxHash:         tx.TxHash,
+			TxIndex:        int32(tx.TxIndex),
+			TxType:         int32(tx.TxType),
+			ContractsCount: int32(summary.contractsCount),
+			ChunksCount:    int32(summary.chunksCount),
+			StemsCount:     int32(summary.stemsCount),
+			WitnessGas:     tx.WitnessGas,
+		})
+	}
+
+	if err := w.contracts.write(contracts); err != nil {
+		return err
+	}
+	if err := w.blocks.write([]parquetBlockRow{block}); err != nil {
+		return err
+	}
+	if err := w.txs.write(txs); err != nil {
+		return err
+	}
+
+	w.rowGroup++
+	if w.rowGroup < w.rowGroupBlocks {
+		return nil
+	}
+	w.rowGroup = 0
+	if err := w.contracts.endRowGroup(); err != nil {
+		return err
+	}
+	if err := w.blocks.endRowGroup(); err != nil {
+		return err
+	}
+	return w.txs.endRowGroup()
+}
+
+// Flush completes the current parts, if any blocks were written to them
+func (w *ParquetWriter) Flush() error {
+	if w.blocks == nil {
+		return nil
+	}
+
+	err := w.contracts.complete()
+	if err == nil {
+		err = w.blocks.complete()
+	}
+	if err == nil {
+		err = w.txs.complete()
+	}
+	if err != nil {
+		w.abortParts()
+		return err
+	}
+	w.parts = append(w.parts, w.contracts.name, w.blocks.name, w.txs.name)
+	w.nextPart++
+	w.contracts, w.blocks, w.txs = nil, nil, nil
+	w.rowGroup = 0
+	return nil
+}
+
+// Close completes the blocks that weren't flushed yet
+func (w *ParquetWriter) Close() error {
+	return w.Flush()
+}
+
+// Files returns the names of the complete part files, relative to the result directory
+func (w *ParquetWriter) Files() []string {
+	return w.parts
+}
+
+func (w *ParquetWriter) partName(prefix string) string {
+	return fmt.Sprintf("%s-%d-%05d.parquet", prefix, w.id, w.nextPart)
+}
+
+// openParts starts the next parts
+func (w *ParquetWriter) openParts() (err error) {
+	if w.contracts, err = newParquetFile[parquetContractRow](w.dir, w.partName(parquetContractsPrefix)); err != nil {
+		return err
+	}
+	if w.blocks, err = newParquetFile[parquetBlockRow](w.dir, w.partName(parquetBlocksPrefix)); err != nil {
+		w.abortParts()
+		return err
+	}
+	if w.txs, err = newParquetFile[parquetTxRow](w.dir, w.partName(parquetTxsPrefix)); err != nil {
+		w.abortParts()
+		return err
+	}
+	return nil
+}
+
+// abortParts removes the current parts
+func (w *ParquetWriter) abortParts() {
+	if w.contracts != nil {
+		w.contracts.abort()
+	}
+	if w.blocks != nil {
+		w.blocks.abort()
+	}
+	if w.txs != nil {
+		w.txs.abort()
+	}
+	w.contracts, w.blocks, w.txs = nil, nil, nil
+}
+
+// parquetFile is a parquet file being written under a temporary name, renamed once complete
+type parquetFile[T any] struct {
+	dir    string
+	name   string
+	tmp    *os.File
+	writer *parquet.GenericWriter[T]
+}
+
+func newParquetFile[T any](dir, name string) (*parquetFile[T], error) {
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &parquetFile[T]{
+		dir:    dir,
+		name:   name,
+		tmp:    tmp,
+		writer: parquet.NewGenericWriter[T](tmp, parquet.Compression(&parquet.Zstd)),
+	}, nil
+}
+
+func (f *parquetFile[T]) write(rows []T) error {
+	if _, err := f.writer.Write(rows); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.name, err)
+	}
+	return nil
+}
+
+func (f *parquetFile[T]) endRowGroup() error {
+	if err := f.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.name, err)
+	}
+	return nil
+}
+
+// complete ends the last row group, writes the footer and atomically renames the file to its name
+func (f *parquetFile[T]) complete() error {
+	if err := f.writer.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.name, err)
+	}
+	if err := f.tmp.Sync(); err != nil {
+		return err
+	}
+	if err := f.tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.tmp.Name(), filepath.Join(f.dir, f.name))
+}
+
+// abort removes the file, which is a no-op once renamed
+func (f *parquetFile[T]) abort() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
+
+// chunkCounts converts the per-chunk byte counts of BitSet.Chunks to a list column
+func chunkCounts(chunks []byte) []int32 {
+	counts := make([]int32, len(chunks))
+	for i, count := range chunks {
+		counts[i] = int32(count)
+	}
+	return counts
+}
+
+// copyChunkCounts is the same as chunkCounts for the bytes copied by CODECOPY/EXTCODECOPY, empty if none
+// were recorded
+func copyChunkCounts(bits *BitSet) []int32 {
+	if bits == nil {
+		return nil
+	}
+	return chunkCounts(bits.Chunks())
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetWriter(t *testing.T) {
+	tempDir := t.TempDir()
+	writer, err := NewParquetWriter(tempDir, 0, 1, 64)
+	if err != nil {
+		t.Fatalf("NewParquetWriter() failed: %v", err)
+	}
+
+	addr := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	bitSet := NewBitSet(100, 32)
+	bitSet.Set(10).Set(20).Set(40)
+	initCode := NewBitSet(40, 32)
+	initCode.SetRange(0, 5)
+
+	for _, blockNum := range []uint64{1, 2} {
+		err := writer.WriteBlock(BlockResult{
+			BlockNum:  blockNum,
+			Results:   map[common.Address]*MergedTraceResult{addr: {Bits: bitSet, CodeSizeCount: 2}},
+			InitCodes: map[common.Hash]*MergedTraceResult{common.HexToHash("0xaa"): {Bits: initCode}},
+			Txs:       []TxResult{{TxHash: "0x01", TxIndex: 0, TxType: 2}},
+		})
+		if err != nil {
+			t.Fatalf("WriteBlock() failed: %v", err)
+		}
+	}
+	if len(writer.Files()) != 0 {
+		t.Fatalf("Expected no complete part before the flush, got %v", writer.Files())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	expected := []string{"analysis-0-00000.parquet", "blocks-0-00000.parquet", "txs-0-00000.parquet"}
+	if !slices.Equal(writer.Files(), expected) {
+		t.Fatalf("Expected files %v, got %v", expected, writer.Files())
+	}
+
+	// Each block is a row group of the same file
+	file, err := os.Open(filepath.Join(tempDir, expected[1]))
+	if err != nil {
+		t.Fatalf("Failed to open blocks: %v", err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat blocks: %v", err)
+	}
+	pf, err := parquet.OpenFile(file, stat.Size())
+	if err != nil {
+		t.Fatalf("Failed to open blocks: %v", err)
+	}
+	if groups := len(pf.RowGroups()); groups != 2 {
+		t.Errorf("Expected 2 row groups, got %d", groups)
+	}
+
+	rows, err := parquet.ReadFile[parquetContractRow](filepath.Join(tempDir, expected[0]))
+	if err != nil {
+		t.Fatalf("Failed to read contracts: %v", err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 contract rows, got %d", len(rows))
+	}
+	for _, row := range rows {
+		switch row.CodeType {
+		case codeTypeRuntime:
+			if row.Address == nil || *row.Address != addr.Hex() || row.InitCodeHash != nil {
+				t.Errorf("Unexpected runtime code row %+v", row)
+			}
+			if !slices.Equal(row.Chunks, []int32{2, 1, 0, 0}) || row.CodeSizeCount != 2 || row.BytecodeSize != 100 {
+				t.Errorf("Unexpected runtime code row %+v", row)
+			}
+			if len(row.ExtraChunkSizes) != 1 || !slices.Equal(row.ExtraChunkSizes[0].Chunks, []int32{3, 0}) {
+				t.Errorf("Unexpected extra chunk sizes %+v", row.ExtraChunkSizes)
+			}
+		case codeTypeInitCode:
+			if row.Address != nil || row.InitCodeHash == nil || *row.InitCodeHash != common.HexToHash("0xaa").Hex() {
+				t.Errorf("Unexpected initcode row %+v", row)
+			}
+			if !slices.Equal(row.Chunks, []int32{5, 0}) {
+				t.Errorf("Unexpected initcode chunks %v", row.Chunks)
+			}
+		default:
+			t.Errorf("Unexpected code type %s", row.CodeType)
+		}
+	}
+
+	blocks, err := parquet.ReadFile[parquetBlockRow](filepath.Join(tempDir, expected[1]))
+	if err != nil {
+		t.Fatalf("Failed to read blocks: %v", err)
+	}
+	if len(blocks) != 2 || blocks[1].BlockNumber != 2 || blocks[1].ContractsCount != 1 || blocks[1].ChunksCount != 2 {
+		t.Errorf("Unexpected blocks %+v", blocks)
+	}
+
+	txs, err := parquet.ReadFile[parquetTxRow](filepath.Join(tempDir, expected[2]))
+	if err != nil {
+		t.Fatalf("Failed to read txs: %v", err)
+	}
+	if len(txs) != 2 || txs[0].TxHash != "0x01" || txs[0].TxType != 2 {
+		t.Errorf("Unexpected txs %+v", txs)
+	}
+
+	// Nothing buffered, nothing written
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if len(writer.Files()) != 3 {
+		t.Errorf("Expected no new part, got %v", writer.Files())
+	}
+
+	// A part interrupted before its flush is left incomplete
+	writer, err = NewParquetWriter(tempDir, 0, 1)
+	if err != nil {
+		t.Fatalf("NewParquetWriter() failed: %v", err)
+	}
+	if err := writer.WriteBlock(BlockResult{BlockNum: 3}); err != nil {
+		t.Fatalf("WriteBlock() failed: %v", err)
+	}
+	incomplete, err := filepath.Glob(filepath.Join(tempDir, "*.tmp-*"))
+	if err != nil || len(incomplete) != 3 {
+		t.Fatalf("Expected 3 incomplete parts, got %v (%v)", incomplete, err)
+	}
+
+	// A new writer removes the incomplete parts and numbers its parts after the complete ones
+	writer, err = NewParquetWriter(tempDir, 0, 1)
+	if err != nil {
+		t.Fatalf("NewParquetWriter() failed: %v", err)
+	}
+	if incomplete, _ := filepath.Glob(filepath.Join(tempDir, "*.tmp-*")); len(incomplete) != 0 {
+		t.Errorf("Expected the incomplete parts to be removed, got %v", incomplete)
+	}
+	if err := writer.WriteBlock(BlockResult{BlockNum: 3}); err != nil {
+		t.Fatalf("WriteBlock() failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	files := writer.Files()
+	if len(files) != 6 || !slices.Contains(files, "blocks-0-00001.parquet") {
+		t.Errorf("Unexpected files %v", files)
+	}
+}
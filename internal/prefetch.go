@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// codeLookup is the code of an address as seen by the transaction of the view
+type codeLookup struct {
+	addr     string
+	view     stateView
+	executed bool // Called rather than inspected, so the delegate of an EIP-7702 delegation is looked up too
+}
+
+// readWindow reads up to n transactions from the stream. The transactions of a window have their RPC
+// lookups batched together and are all held in memory until then, so n stays in the order of the
+// analysis concurrency.
+func readWindow(stream TraceStream, n int) ([]*TransactionTrace, error) {
+	var window []*TransactionTrace
+	for len(window) < n {
+		tx, err := stream.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		window = append(window, tx)
+	}
+	return window, nil
+}
+
+// prefetch fetches every code the transactions of the window execute or inspect that isn't cached yet,
+// in as few batches as possible. The block transactions are in window order.
+func (a *Analyzer) prefetch(window []*TransactionTrace, views []stateView, txs []BlockTx) error {
+	var lookups []codeLookup
+	for i, tx := range window {
+		if txs[i].To != "" {
+			lookups = append(lookups, codeLookup{txs[i].To, views[i], true})
+		}
+		lookups = appendStepLookups(lookups, tx.Result.Steps, views[i])
+	}
+	return a.prefetchCodes(lookups)
+}
+
+// lookupBlockTx returns the block transaction traced at the given index
+func lookupBlockTx(blockTxs map[common.Hash]BlockTx, txHash string, blockNum uint64, txIndex int) (BlockTx, error) {
+	blockTx, ok := blockTxs[common.HexToHash(txHash)]
+	if !ok {
+		return BlockTx{}, fmt.Errorf("transaction %s not found in block %d", txHash, blockNum)
+	}
+	if int(blockTx.Index) != txIndex {
+		return BlockTx{}, fmt.Errorf("transaction %s of block %d is at index %d, traced at %d", txHash, blockNum, blockTx.Index, txIndex)
+	}
+	return blockTx, nil
+}
+
+// appendStepLookups appends the code the steps read through getCode: the callee of the calls that enter
+// a frame, and the address of EXTCODESIZE/EXTCODECOPY
+func appendStepLookups(lookups []codeLookup, steps []TraceStep, view stateView) []codeLookup {
+	created := createdAddresses(steps)
+	for i, step := range steps {
+		if addr, ok := created[i]; ok {
+			view = view.withCode(addr)
+		}
+		stack := step.Stack
+		switch step.Op {
+		case OpExtCodeSize, OpExtCodeCopy:
+			if len(stack) > 0 {
+				lookups = append(lookups, codeLookup{stack[len(stack)-1], view, false})
+			}
+		case OpCall, OpCallCode, OpDelegateCall, OpStaticCall:
+			if i+1 < len(steps) && steps[i+1].Depth == step.Depth+1 && len(stack) > 1 {
+				lookups = append(lookups, codeLookup{stack[len(stack)-2], view, true})
+			}
+		}
+	}
+	return lookups
+}
+
+// prefetchCodes fetches the code that isn't cached yet in batches, and adds it to the code cache and to the
+// code read by the block. The delegates of the accounts called are only known once their code is fetched,
+// so they are fetched in a second batch.
+func (a *Analyzer) prefetchCodes(lookups []codeLookup) error {
+	if err := a.fetchCodes(lookups); err != nil {
+		return err
+	}
+
+	var delegates []codeLookup
+	for _, lookup := range lookups {
+		if !lookup.executed {
+			continue
+		}
+		code, ok := lookup.view.codes.get(lookup.view.codeRequest(common.HexToAddress(lookup.addr)))
+		if !ok {
+			continue
+		}
+		if target, ok := types.ParseDelegation(code.code); ok {
+			delegates = append(delegates, codeLookup{target.Hex(), lookup.view, false})
+		}
+	}
+	return a.fetchCodes(delegates)
+}
+
+// fetchCodes fetches the given code that isn't cached yet, in batches
+func (a *Analyzer) fetchCodes(lookups []codeLookup) error {
+	var (
+		reqs  []CodeRequest
+		views []stateView
+		seen  = make(map[CodeRequest]bool)
+	)
+	for _, lookup := range lookups {
+		req := lookup.view.codeRequest(common.HexToAddress(lookup.addr))
+		if seen[req] {
+			continue
+		}
+		seen[req] = true
+		if _, ok := lookup.view.codes.get(req); ok {
+			continue
+		}
+		if cached, ok := a.codeCache.Get(codeCacheKey(req.Address, req.BlockNum)); ok {
+			lookup.view.codes.add(req, cached.(*Code))
+			continue
+		}
+		reqs = append(reqs, req)
+		views = append(views, lookup.view)
+	}
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	codes, err := a.client.Codes(reqs)
+	if err != nil {
+		return err
+	}
+	for i, req := range reqs {
+		code, err := hexutil.Decode(codes[i])
+		if err != nil {
+			return err
+		}
+		result := newCode(req.Address, code)
+		a.codeCache.Add(codeCacheKey(req.Address, req.BlockNum), result)
+		views[i].codes.add(req, result)
+	}
+	return nil
+}
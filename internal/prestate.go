@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// stateView identifies the state a transaction executes against: the state right before the block,
+// plus the code set by the transactions of the same block that ran before it, and by the transaction
+// itself so far: its EIP-7702 delegations from the start, and the contracts it created once created.
+//
+// eth_getCode at the block itself returns the state after the whole block, which is wrong for contracts
+// created, upgraded or self-destructed within the block.
+//
+// Only the state before and after the block can be fetched, so some changes within the block are missed:
+// an account whose code is set by several transactions of the block (e.g. delegated twice under EIP-7702)
+// is seen with its last code, and a contract created and self-destructed by the same transaction
+// (EIP-6780) has no code after the block, so its accesses are dropped.
+type stateView struct {
+	blockNum    uint64
+	txIndex     int
+	deployments map[common.Address]int  // Accounts whose code is set in the block, mapped to the index of the first transaction setting it
+	current     map[common.Address]bool // Accounts whose code the transaction has set so far
+	codes       *blockCodes             // Code read by the analysis of the block
+}
+
+// newStateView returns the view of the transaction at txIndex, given the deployments of the block up to
+// the transaction included. The delegations of the transaction are set before it executes.
+func newStateView(blockNum uint64, txIndex int, deployments map[common.Address]int, tx BlockTx, codes *blockCodes) stateView {
+	current := make(map[common.Address]bool)
+	for _, authority := range txAuthorities(tx) {
+		current[authority] = true
+	}
+	return stateView{
+		blockNum:    blockNum,
+		txIndex:     txIndex,
+		deployments: maps.Clone(deployments),
+		current:     current,
+		codes:       codes,
+	}
+}
+
+// withCode returns the view once the transaction set the code of addr, e.g. after creating it
+func (v stateView) withCode(addr common.Address) stateView {
+	current := maps.Clone(v.current)
+	if current == nil {
+		current = make(map[common.Address]bool)
+	}
+	current[addr] = true
+	v.current = current
+	return v
+}
+
+// codeBlock returns the block number whose state should be used to fetch the code of addr.
+func (v stateView) codeBlock(addr common.Address) uint64 {
+	// Set earlier in the block, or earlier in the same transaction: the post-block code is the
+	// code set then, unless the block changes it again.
+	if txIndex, ok := v.deployments[addr]; ok && (txIndex < v.txIndex || txIndex == v.txIndex && v.current[addr]) {
+		return v.blockNum
+	}
+	if v.blockNum == 0 {
+		return 0
+	}
+	return v.blockNum - 1
+}
+
+// codeRequest returns the code of addr as seen by the transaction of the view
+func (v stateView) codeRequest(addr common.Address) CodeRequest {
+	return CodeRequest{Address: addr, BlockNum: v.codeBlock(addr)}
+}
+
+// addDeployments adds the accounts whose code is set by the transaction, unless an earlier transaction set it first:
+// the contract of a creation transaction, the ones created by its CREATE/CREATE2 frames and its EIP-7702 delegations.
+func addDeployments(deployments map[common.Address]int, txIndex int, tx BlockTx, trace *InnerResult) {
+	created := slices.Collect(maps.Values(createdAddresses(trace.Steps)))
+	addCreated(deployments, txIndex, append(txCodeChanges(tx, trace.Failed), created...))
+}
+
+// txCodeChanges returns the accounts whose code is set by the transaction itself rather than by its frames:
+// the created contract of a successful creation transaction, and the authorities of its EIP-7702 delegations,
+// which are applied even if the transaction fails. Authorizations the node skipped as invalid are included
+// too, which is harmless: their code is the same before and after the block, unless the block changes it.
+func txCodeChanges(tx BlockTx, failed bool) []common.Address {
+	var changed []common.Address
+	if tx.To == "" && !failed {
+		changed = append(changed, crypto.CreateAddress(tx.From, uint64(tx.Nonce)))
+	}
+	return append(changed, txAuthorities(tx)...)
+}
+
+// txAuthorities returns the accounts delegated by the EIP-7702 authorizations of the transaction
+func txAuthorities(tx BlockTx) []common.Address {
+	var authorities []common.Address
+	for _, auth := range tx.AuthorizationList {
+		if authority, err := auth.Authority(); err == nil {
+			authorities = append(authorities, authority)
+		}
+	}
+	return authorities
+}
+
+// addCreated adds the given contracts created by the transaction, unless an earlier transaction deployed them first.
+func addCreated(deployments map[common.Address]int, txIndex int, created []common.Address) {
+	for _, addr := range created {
+		if _, ok := deployments[addr]; !ok {
+			deployments[addr] = txIndex
+		}
+	}
+}
+
+// createdAddresses returns the addresses of the contracts successfully created by CREATE/CREATE2 in a
+// transaction, mapped to the index of the step from which they have code. The created address is pushed
+// on the caller's stack once the creation frame returns, so it is the stack top of the next step back at
+// the depth of the CREATE.
+func createdAddresses(steps []TraceStep) map[int]common.Address {
+	created := make(map[int]common.Address)
+	for i, step := range steps {
+		if step.Op != OpCreate && step.Op != OpCreate2 {
+			continue
+		}
+		for j := i + 1; j < len(steps); j++ {
+			if steps[j].Depth > step.Depth {
+				continue
+			}
+			if steps[j].Depth == step.Depth && len(steps[j].Stack) > 0 {
+				addr := common.HexToAddress(steps[j].Stack[len(steps[j].Stack)-1])
+				if addr != (common.Address{}) { // Zero means the creation failed
+					created[j] = addr
+				}
+			}
+			break
+		}
+	}
+	return created
+}
@@ -0,0 +1,385 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+func TestAddDeployments(t *testing.T) {
+	created := common.HexToAddress("0x5fbdb2315678afecb367f032d93f642f64180aa3")
+
+	trace := []TransactionTrace{
+		{
+			TxHash: "0xaa",
+			Result: InnerResult{Steps: []TraceStep{
+				{PC: 0, Op: "PUSH1", Depth: 1},
+				{PC: 2, Op: "CREATE2", Depth: 1, Stack: []string{"0x0", "0x20", "0x0", "0x0"}},
+				{PC: 0, Op: "PUSH1", Depth: 2},
+				{PC: 2, Op: "RETURN", Depth: 2, Stack: []string{"0x0", "0x20"}},
+				{PC: 3, Op: "POP", Depth: 1, Stack: []string{created.Hex()}},
+				// Failed creation pushes zero
+				{PC: 4, Op: "CREATE", Depth: 1, Stack: []string{"0x0", "0x0", "0x0"}},
+				{PC: 5, Op: "POP", Depth: 1, Stack: []string{"0x0"}},
+			}},
+		},
+		{
+			TxHash: "0xbb",
+			Result: InnerResult{Steps: []TraceStep{
+				{PC: 0, Op: "STOP", Depth: 1},
+			}},
+		},
+		{
+			TxHash: "0xcc",
+			Result: InnerResult{Steps: []TraceStep{
+				{PC: 0, Op: "STOP", Depth: 1},
+			}},
+		},
+	}
+
+	// The second transaction creates a contract, the third one fails to
+	sender := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	txs := []BlockTx{
+		{To: "0x4444444444444444444444444444444444444444"},
+		{From: sender, Nonce: 7},
+		{From: sender, Nonce: 8},
+	}
+	trace[2].Result.Failed = true
+
+	deployments := make(map[common.Address]int)
+	for i := range trace {
+		addDeployments(deployments, i, txs[i], &trace[i].Result)
+	}
+	if len(deployments) != 2 {
+		t.Fatalf("Expected 2 deployments, got %d", len(deployments))
+	}
+	if txIndex, ok := deployments[created]; !ok || txIndex != 0 {
+		t.Errorf("Expected %s deployed by tx 0, got %d (found %t)", created.Hex(), txIndex, ok)
+	}
+	if txIndex, ok := deployments[crypto.CreateAddress(sender, 7)]; !ok || txIndex != 1 {
+		t.Errorf("Expected the contract of the creation transaction deployed by tx 1, got %d (found %t)", txIndex, ok)
+	}
+}
+
+func TestTxCodeChanges_Delegation(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := types.SignSetCode(key, types.SetCodeAuthorization{Address: common.HexToAddress("0x5555555555555555555555555555555555555555")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delegations apply even if the transaction fails
+	tx := BlockTx{To: "0x4444444444444444444444444444444444444444", AuthorizationList: []types.SetCodeAuthorization{auth}}
+	changed := txCodeChanges(tx, true)
+	if len(changed) != 1 || changed[0] != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Errorf("Expected the authority to be changed, got %v", changed)
+	}
+}
+
+// deployAndCallNode answers for block 100, whose first transaction deploys a contract that the second one
+// calls. The contract only has code after the block.
+func deployAndCallNode(t *testing.T, sender, deployed common.Address) *RpcClient {
+	t.Helper()
+	return newTestRpcClient(t, deployAndCallHandler(sender, deployed))
+}
+
+func deployAndCallHandler(sender, deployed common.Address) func(method string, params []json.RawMessage) (any, error) {
+	return func(method string, params []json.RawMessage) (any, error) {
+		switch method {
+		case "eth_getBlockByNumber":
+			return map[string]any{"transactions": []map[string]any{
+				{"hash": common.HexToHash("0x01"), "from": sender, "nonce": "0x0", "to": nil, "input": "0x600a600c600039600a6000f3", "type": "0x2", "transactionIndex": "0x0"},
+				{"hash": common.HexToHash("0x02"), "from": sender, "nonce": "0x1", "to": deployed, "type": "0x2", "transactionIndex": "0x1"},
+			}}, nil
+		case "eth_getCode":
+			var blockNum hexutil.Uint64
+			if err := json.Unmarshal(params[1], &blockNum); err != nil {
+				return nil, err
+			}
+			if blockNum == 100 {
+				return "0x6001600201", nil
+			}
+			return "0x", nil
+		}
+		return nil, fmt.Errorf("unexpected call %s", method)
+	}
+}
+
+// newTestAnalyzer returns an analyzer of the node, with the given trace cache if not nil
+func newTestAnalyzer(t *testing.T, client *RpcClient, cache *TraceCache) *Analyzer {
+	t.Helper()
+	codeCache, err := lru.New(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule, err := witness.LookupSchedule(witness.DefaultSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newRpcPool([]*RpcClient{client})
+	return NewAnalyzer(0, pool, NewTraceRetriever(pool, "", cache), codeCache, schedule, 4)
+}
+
+func TestAnalyze_CallDeployedByCreationTx(t *testing.T) {
+	sender := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	deployed := crypto.CreateAddress(sender, 0)
+	analyzer := newTestAnalyzer(t, deployAndCallNode(t, sender, deployed), nil)
+
+	trace := []TransactionTrace{
+		{TxHash: "0x01", Result: InnerResult{Steps: []TraceStep{
+			{PC: 0, Op: "PUSH1", Depth: 1},
+			{PC: 2, Op: "RETURN", Depth: 1, Stack: []string{"0x0", "0xa"}},
+		}}},
+		{TxHash: "0x02", Result: InnerResult{Steps: []TraceStep{
+			{PC: 0, Op: "PUSH1", Depth: 1},
+			{PC: 2, Op: "PUSH1", Depth: 1},
+			{PC: 4, Op: "ADD", Depth: 1},
+		}}},
+	}
+	result, err := analyzer.Analyze(100, trace)
+	if err != nil {
+		t.Fatalf("Analyze() failed: %v", err)
+	}
+	if res := result.Results[deployed]; res == nil || res.Bits.Count() != 5 {
+		t.Errorf("Expected the call to the deployed contract to be recorded, got %v", result.Results)
+	}
+}
+
+func TestAnalyzeCodeAccess_CallDeployedByCreationTx(t *testing.T) {
+	sender := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	deployed := crypto.CreateAddress(sender, 0)
+	analyzer := newTestAnalyzer(t, deployAndCallNode(t, sender, deployed), nil)
+
+	traces := []CodeAccessTrace{
+		{TxHash: "0x01", Result: CodeAccessResult{Codes: []CodeAccess{
+			{InitCode: "0x600a600c600039600a6000f3", Ranges: [][2]uint64{{0, 13}}},
+		}}},
+		{TxHash: "0x02", Result: CodeAccessResult{Codes: []CodeAccess{
+			{Address: deployed.Hex(), Ranges: [][2]uint64{{0, 5}}},
+		}}},
+	}
+	result, err := analyzer.AnalyzeCodeAccess(100, traces)
+	if err != nil {
+		t.Fatalf("AnalyzeCodeAccess() failed: %v", err)
+	}
+	if res := result.Results[deployed]; res == nil || res.Bits.Count() != 5 {
+		t.Errorf("Expected the call to the deployed contract to be recorded, got %v", result.Results)
+	}
+}
+
+func TestStateView_CodeBlock(t *testing.T) {
+	deployed := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	other := common.HexToAddress("0x2222222222222222222222222222222222222222")
+	deployments := map[common.Address]int{deployed: 3}
+
+	tests := []struct {
+		name     string
+		view     stateView
+		addr     common.Address
+		expected uint64
+	}{
+		{"existing contract uses pre-block state", stateView{blockNum: 100, txIndex: 5, deployments: deployments}, other, 99},
+		{"deployed before the tx uses post-block state", stateView{blockNum: 100, txIndex: 5, deployments: deployments}, deployed, 100},
+		{"deployed later in the same tx uses pre-block state", stateView{blockNum: 100, txIndex: 3, deployments: deployments}, deployed, 99},
+		{"deployed earlier in the same tx uses post-block state", stateView{blockNum: 100, txIndex: 3, deployments: deployments}.withCode(deployed), deployed, 100},
+		{"deployed after the tx uses pre-block state", stateView{blockNum: 100, txIndex: 2, deployments: deployments}.withCode(deployed), deployed, 99},
+		{"genesis block", stateView{}, other, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.view.codeBlock(tt.addr); got != tt.expected {
+				t.Errorf("codeBlock() = %d, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+// delegatedNode answers for block 100, whose only transaction calls eoa, delegated to delegate under EIP-7702
+// before the block. The delegate has 30 JUMPDEST followed by a STOP.
+func delegatedNode(t *testing.T, eoa, delegate common.Address) *RpcClient {
+	t.Helper()
+	delegateCode := append(bytes.Repeat([]byte{0x5b}, 30), 0x00)
+	return newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		switch method {
+		case "eth_getBlockByNumber":
+			return map[string]any{"transactions": []map[string]any{
+				{"hash": common.HexToHash("0x01"), "to": eoa, "input": "0x", "type": "0x2", "transactionIndex": "0x0"},
+			}}, nil
+		case "eth_getCode":
+			var addr common.Address
+			if err := json.Unmarshal(params[0], &addr); err != nil {
+				return nil, err
+			}
+			switch addr {
+			case eoa:
+				return hexutil.Bytes(types.AddressToDelegation(delegate)), nil
+			case delegate:
+				return hexutil.Bytes(delegateCode), nil
+			}
+			return "0x", nil
+		}
+		return nil, fmt.Errorf("unexpected call %s", method)
+	})
+}
+
+func TestAnalyze_DelegatedCall(t *testing.T) {
+	eoa := common.HexToAddress("0x4444444444444444444444444444444444444444")
+	delegate := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	analyzer := newTestAnalyzer(t, delegatedNode(t, eoa, delegate), nil)
+
+	var steps []TraceStep
+	for pc := range uint64(30) {
+		steps = append(steps, TraceStep{PC: pc, Op: "JUMPDEST", Depth: 1})
+	}
+	// EXTCODESIZE reads the delegation designator
+	steps[25] = TraceStep{PC: 25, Op: "EXTCODESIZE", Depth: 1, Stack: []string{eoa.Hex()}}
+	steps = append(steps, TraceStep{PC: 30, Op: "STOP", Depth: 1})
+
+	result, err := analyzer.Analyze(100, []TransactionTrace{{TxHash: "0x01", Result: InnerResult{Steps: steps}}})
+	if err != nil {
+		t.Fatalf("Analyze() failed: %v", err)
+	}
+	if res := result.Results[delegate]; res == nil || res.Bits.Size() != 31 || res.Bits.Count() != 31 {
+		t.Errorf("Expected the delegate's code to be executed, got %v", res)
+	}
+	if res := result.Results[eoa]; res == nil || res.Bits.Size() != 23 || res.Bits.Count() != 0 || res.CodeSizeCount != 1 {
+		t.Errorf("Expected the delegation designator to be inspected, got %v", res)
+	}
+}
+
+func TestAnalyze_PCPastCode(t *testing.T) {
+	eoa := common.HexToAddress("0x4444444444444444444444444444444444444444")
+	delegate := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	analyzer := newTestAnalyzer(t, delegatedNode(t, eoa, delegate), nil)
+
+	trace := []TransactionTrace{{TxHash: "0x01", Result: InnerResult{Steps: []TraceStep{
+		{PC: 0, Op: "JUMPDEST", Depth: 1},
+		{PC: 40, Op: "JUMPDEST", Depth: 1},
+	}}}}
+	if _, err := analyzer.Analyze(100, trace); err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Errorf("Expected an error for a pc past the end of the code, got %v", err)
+	}
+}
+
+func TestAnalyzeCodeAccess_DelegatedCall(t *testing.T) {
+	eoa := common.HexToAddress("0x4444444444444444444444444444444444444444")
+	delegate := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	analyzer := newTestAnalyzer(t, delegatedNode(t, eoa, delegate), nil)
+
+	traces := []CodeAccessTrace{{TxHash: "0x01", Result: CodeAccessResult{Codes: []CodeAccess{
+		{Address: eoa.Hex(), Ranges: [][2]uint64{{0, 31}}},
+		{Address: eoa.Hex(), External: true, SizeCount: 1},
+	}}}}
+	result, err := analyzer.AnalyzeCodeAccess(100, traces)
+	if err != nil {
+		t.Fatalf("AnalyzeCodeAccess() failed: %v", err)
+	}
+	if res := result.Results[delegate]; res == nil || res.Bits.Size() != 31 || res.Bits.Count() != 31 {
+		t.Errorf("Expected the delegate's code to be executed, got %v", res)
+	}
+	if res := result.Results[eoa]; res == nil || res.Bits.Size() != 23 || res.CodeSizeCount != 1 {
+		t.Errorf("Expected the delegation designator to be inspected, got %v", res)
+	}
+}
+
+// createInTxNode answers for block 100, whose only transaction calls factory, which checks the code size of
+// created before creating it with CREATE2, then calls it. The created contract only has code after the block.
+func createInTxNode(t *testing.T, factory, created common.Address) *RpcClient {
+	t.Helper()
+	return newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		switch method {
+		case "eth_getBlockByNumber":
+			return map[string]any{"transactions": []map[string]any{
+				{"hash": common.HexToHash("0x01"), "to": factory, "input": "0x", "type": "0x2", "transactionIndex": "0x0"},
+			}}, nil
+		case "debug_traceBlockByNumber":
+			return []map[string]any{{"txHash": common.HexToHash("0x01"), "result": map[string]any{
+				"type": "CALL", "to": factory, "calls": []map[string]any{{"type": "CREATE2", "to": created, "input": "0x60006000f3"}},
+			}}}, nil
+		case "eth_getCode":
+			var (
+				addr     common.Address
+				blockNum hexutil.Uint64
+			)
+			if err := json.Unmarshal(params[0], &addr); err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(params[1], &blockNum); err != nil {
+				return nil, err
+			}
+			switch {
+			case addr == factory:
+				return "0x3bf580f10000", nil
+			case addr == created && blockNum == 100:
+				return "0x6001600201", nil
+			}
+			return "0x", nil
+		}
+		return nil, fmt.Errorf("unexpected call %s", method)
+	})
+}
+
+func TestAnalyze_AccessBeforeCreateInTx(t *testing.T) {
+	factory := common.HexToAddress("0x6666666666666666666666666666666666666666")
+	created := common.HexToAddress("0x7777777777777777777777777777777777777777")
+	analyzer := newTestAnalyzer(t, createInTxNode(t, factory, created), nil)
+
+	trace := []TransactionTrace{{TxHash: common.HexToHash("0x01").Hex(), Result: InnerResult{Steps: []TraceStep{
+		// Before the creation, the contract has no code yet
+		{PC: 0, Op: "EXTCODESIZE", Depth: 1, Stack: []string{created.Hex()}},
+		// CREATE2(value, offset, size, salt)
+		{PC: 1, Op: "CREATE2", Depth: 1, Stack: []string{"0x0", "0x5", "0x0", "0x0"}},
+		{PC: 0, Op: "PUSH1", Depth: 2},
+		{PC: 2, Op: "PUSH1", Depth: 2},
+		{PC: 4, Op: "RETURN", Depth: 2, Stack: []string{"0x0", "0x0"}},
+		{PC: 2, Op: "DUP1", Depth: 1, Stack: []string{created.Hex()}},
+		{PC: 3, Op: "CALL", Depth: 1, Stack: []string{created.Hex(), "0x5208"}},
+		{PC: 0, Op: "PUSH1", Depth: 2},
+		{PC: 2, Op: "PUSH1", Depth: 2},
+		{PC: 4, Op: "ADD", Depth: 2},
+		{PC: 4, Op: "STOP", Depth: 1},
+	}}}}
+	result, err := analyzer.Analyze(100, trace)
+	if err != nil {
+		t.Fatalf("Analyze() failed: %v", err)
+	}
+	if res := result.Results[created]; res == nil || res.Bits.Count() != 5 || res.CodeSizeCount != 0 {
+		t.Errorf("Expected only the call after the creation to be recorded, got %v", res)
+	}
+}
+
+func TestAnalyzeCodeAccess_AccessBeforeCreateInTx(t *testing.T) {
+	factory := common.HexToAddress("0x6666666666666666666666666666666666666666")
+	created := common.HexToAddress("0x7777777777777777777777777777777777777777")
+	analyzer := newTestAnalyzer(t, createInTxNode(t, factory, created), nil)
+
+	traces := []CodeAccessTrace{{TxHash: common.HexToHash("0x01").Hex(), Result: CodeAccessResult{
+		Created: []string{created.Hex()},
+		Codes: []CodeAccess{
+			{Address: factory.Hex(), Ranges: [][2]uint64{{0, 5}}},
+			{Address: created.Hex(), External: true, SizeCount: 1},
+			{InitCode: "0x60006000f3", Ranges: [][2]uint64{{0, 5}}},
+			{Address: created.Hex(), Deployed: true, Ranges: [][2]uint64{{0, 5}}},
+		},
+	}}}
+	result, err := analyzer.AnalyzeCodeAccess(100, traces)
+	if err != nil {
+		t.Fatalf("AnalyzeCodeAccess() failed: %v", err)
+	}
+	if res := result.Results[created]; res == nil || res.Bits.Count() != 5 || res.CodeSizeCount != 0 {
+		t.Errorf("Expected only the call after the creation to be recorded, got %v", res)
+	}
+}
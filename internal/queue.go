@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Number of times a block may fail before the run gives up on it
+const maxBlockAttempts = 3
+
+// blockQueue hands out the sampled blocks of a run to whichever worker asks first. A block that fails is
+// handed out again, to any worker: the workers share the RPC pool, which already fails every call over to
+// the other endpoints, so which worker failed a block says nothing about the endpoint it failed on.
+type blockQueue struct {
+	mu         sync.Mutex
+	blocks     []uint64
+	next       int               // Index of the next block never handed out
+	skip       func(uint64) bool // Blocks already written by a previous run
+	retries    []blockRetry      // Failed blocks waiting to be handed out again
+	attempts   map[uint64]int    // Block -> number of failures
+	retryDelay time.Duration     // Wait before the first retry of a block, doubled on every failure
+}
+
+type blockRetry struct {
+	block uint64
+	at    time.Time // When it may be handed out again
+}
+
+// newBlockQueue returns the queue of the given blocks. Failed blocks are retried after retryDelay, the
+// circuit breaker cooldown, so that a failure of every endpoint doesn't burn the attempts of a block
+// before one of them recovers.
+func newBlockQueue(blocks []uint64, skip func(uint64) bool, retryDelay time.Duration) *blockQueue {
+	if skip == nil {
+		skip = func(uint64) bool { return false }
+	}
+	return &blockQueue{
+		blocks:     blocks,
+		skip:       skip,
+		attempts:   make(map[uint64]int),
+		retryDelay: retryDelay,
+	}
+}
+
+// Next returns the next block, or false once there is nothing left to hand out or the context is done.
+// The blocks never handed out come first, then the failed ones, waiting for their retry delay if needed.
+func (q *blockQueue) Next(ctx context.Context) (uint64, bool) {
+	for {
+		block, wait, ok := q.take()
+		if !ok || wait == 0 {
+			return block, ok
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, false
+		case <-timer.C:
+		}
+	}
+}
+
+// take returns the next block, or how long to wait for the first retry to be due
+func (q *blockQueue) take() (uint64, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.next < len(q.blocks) {
+		block := q.blocks[q.next]
+		q.next++
+		if !q.skip(block) {
+			return block, 0, true
+		}
+	}
+
+	if len(q.retries) == 0 {
+		return 0, 0, false
+	}
+	first := 0
+	for i, retry := range q.retries {
+		if retry.at.Before(q.retries[first].at) {
+			first = i
+		}
+	}
+	retry := q.retries[first]
+	if wait := time.Until(retry.at); wait > 0 {
+		return 0, wait, true
+	}
+	q.retries = append(q.retries[:first], q.retries[first+1:]...)
+	return retry.block, 0, true
+}
+
+// Retry puts a block that failed back in the queue.
+// It returns an error once the block has failed too many times.
+func (q *blockQueue) Retry(block uint64, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.attempts[block]++
+	if q.attempts[block] >= maxBlockAttempts {
+		return fmt.Errorf("block %d failed %d times: %w", block, q.attempts[block], err)
+	}
+
+	delay := q.retryDelay << (q.attempts[block] - 1)
+	q.retries = append(q.retries, blockRetry{block: block, at: time.Now().Add(delay)})
+	return nil
+}
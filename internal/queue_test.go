@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func drain(q *blockQueue) []uint64 {
+	var blocks []uint64
+	for {
+		block, ok := q.Next(context.Background())
+		if !ok {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func TestBlockQueue_Next(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   []uint64
+		skip     func(uint64) bool
+		expected []uint64
+	}{
+		{
+			name:     "every block",
+			blocks:   []uint64{10, 17, 24},
+			expected: []uint64{10, 17, 24},
+		},
+		{
+			name:     "skips written blocks",
+			blocks:   []uint64{10, 11, 12, 13, 14},
+			skip:     func(block uint64) bool { return block%2 == 0 },
+			expected: []uint64{11, 13},
+		},
+		{
+			name: "empty sample",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newBlockQueue(tt.blocks, tt.skip, 0)
+			if got := drain(q); !slices.Equal(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBlockQueue_Retry(t *testing.T) {
+	q := newBlockQueue([]uint64{1, 2, 3}, nil, 0)
+	errFailed := errors.New("failed")
+
+	block, _ := q.Next(context.Background())
+	if err := q.Retry(block, errFailed); err != nil {
+		t.Fatalf("Retry() failed: %v", err)
+	}
+
+	// The failed block is handed out again after the fresh ones
+	if got := drain(q); !slices.Equal(got, []uint64{2, 3, 1}) {
+		t.Errorf("Expected [2 3 1], got %v", got)
+	}
+
+	if err := q.Retry(1, errFailed); err != nil {
+		t.Fatalf("Retry() failed: %v", err)
+	}
+	if got := drain(q); !slices.Equal(got, []uint64{1}) {
+		t.Errorf("Expected [1], got %v", got)
+	}
+
+	if err := q.Retry(1, errFailed); !errors.Is(err, errFailed) {
+		t.Errorf("Expected Retry() to give up after %d attempts, got %v", maxBlockAttempts, err)
+	}
+}
+
+func TestBlockQueue_RetryDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	q := newBlockQueue([]uint64{1}, nil, delay)
+	errFailed := errors.New("failed")
+
+	block, _ := q.Next(context.Background())
+	if err := q.Retry(block, errFailed); err != nil {
+		t.Fatalf("Retry() failed: %v", err)
+	}
+
+	// With nothing else to hand out, the retry waits for its delay
+	start := time.Now()
+	if block, ok := q.Next(context.Background()); !ok || block != 1 {
+		t.Fatalf("Expected block 1, got %d (%t)", block, ok)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Expected the retry to wait %v, got %v", delay, elapsed)
+	}
+
+	// The second failure waits twice as long, unless the context is done first
+	if err := q.Retry(1, errFailed); err != nil {
+		t.Fatalf("Retry() failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), delay)
+	defer cancel()
+	if block, ok := q.Next(ctx); ok {
+		t.Errorf("Expected no block before the context is done, got %d", block)
+	}
+	start = time.Now()
+	if block, ok := q.Next(context.Background()); !ok || block != 1 {
+		t.Fatalf("Expected block 1, got %d (%t)", block, ok)
+	}
+	if elapsed := time.Since(start); elapsed > 2*delay {
+		t.Errorf("Expected the rest of the %v delay, waited %v", 2*delay, elapsed)
+	}
+}
@@ -0,0 +1,121 @@
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal"
+)
+
+// Files returns the result files of the directory, sorted by name. Only CSV results can be read, so it
+// fails if the manifest of the directory says they were written in another format.
+func Files(dir string) ([]string, error) {
+	manifest, err := internal.ReadRunManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil && manifest.OutputFormat != "" && manifest.OutputFormat != internal.OutputCSV {
+		return nil, fmt.Errorf("%s holds %s results, only CSV results can be read", dir, manifest.OutputFormat)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "analysis-*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// Walk calls fn with every record of the files, in order. It refuses to mix files whose manifests aren't
+// compatible, and returns the manifest of the first file.
+func Walk(paths []string, fn func(rec *Record) error) (*internal.RunManifest, error) {
+	var manifest *internal.RunManifest
+	for _, path := range paths {
+		r, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if manifest == nil {
+			manifest = r.Manifest()
+		} else if err := manifest.CheckCompatible(r.Manifest()); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("can't mix %s with %s: %w", path, paths[0], err)
+		}
+
+		err = walkFile(r, fn)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func walkFile(r *Reader, fn func(rec *Record) error) error {
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Key identifies the code of a record: its address, or its hash for initcode. Code redeployed at an address
+// with another size gets a key of its own.
+type Key struct {
+	Address      common.Address
+	InitCodeHash common.Hash
+	BytecodeSize uint32
+}
+
+// Aggregate is the merge of the records of a code over every block it was accessed in
+type Aggregate struct {
+	Blocks int
+	Result *internal.MergedTraceResult
+}
+
+// Aggregates are the per-contract aggregates of result files
+type Aggregates struct {
+	Manifest  *internal.RunManifest
+	Contracts map[Key]*Aggregate
+}
+
+// ReadAggregates merges the records of the files per contract, the way the analyzer merges the transactions
+// of a block. The chunks accessed are exact, the bytes accessed are a lower bound as the bytes accessed within
+// a chunk aren't recorded.
+func ReadAggregates(paths ...string) (*Aggregates, error) {
+	a := &Aggregates{Contracts: make(map[Key]*Aggregate)}
+	manifest, err := Walk(paths, a.Add)
+	if err != nil {
+		return nil, err
+	}
+	a.Manifest = manifest
+	return a, nil
+}
+
+// Add merges the record into the aggregate of its code
+func (a *Aggregates) Add(rec *Record) error {
+	result, err := rec.Result()
+	if err != nil {
+		return fmt.Errorf("block %d: %w", rec.BlockNumber, err)
+	}
+
+	key := Key{Address: rec.Address, InitCodeHash: rec.InitCodeHash, BytecodeSize: rec.BytecodeSize}
+	if existing, ok := a.Contracts[key]; ok {
+		existing.Blocks++
+		existing.Result.Merge(result)
+		return nil
+	}
+	a.Contracts[key] = &Aggregate{Blocks: 1, Result: result}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package reader streams the rows of the analysis-N.csv result files back as typed records, and merges them
+// into per-contract aggregates.
+package reader
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal"
+)
+
+// Record is a row of a result file
+type Record struct {
+	BlockNumber   uint64
+	Address       common.Address // Zero for initcode
+	InitCodeHash  common.Hash    // Zero for runtime code
+	BytecodeSize  uint32
+	ChunkSize     uint32 // Chunk size of the manifest
+	Chunks        []byte // Number of bytes executed in each chunk
+	CopyChunks    []byte // Number of bytes copied by CODECOPY/EXTCODECOPY in each chunk, nil if none were recorded
+	CodeSizeCount int
+	CodeCopyCount int
+	StemsCount    int
+	HeaderStem    bool
+	WitnessGas    uint64
+	Extra         []ChunkSizeData // One per extra chunk size of the manifest, in the same order
+}
+
+// ChunkSizeData are the chunks of a record for one of the extra chunk sizes
+type ChunkSizeData struct {
+	ChunkSize  uint32
+	Chunks     []byte
+	StemsCount int
+}
+
+// IsInitCode reports whether the record belongs to initcode rather than deployed code
+func (r *Record) IsInitCode() bool {
+	return r.InitCodeHash != (common.Hash{})
+}
+
+// Reader reads the records of a result file. The file must have the run manifest of the current schema version
+// next to it.
+type Reader struct {
+	path     string
+	file     *os.File
+	csv      *csv.Reader
+	manifest *internal.RunManifest
+}
+
+// Open opens the result file and checks its header against the run manifest of its directory
+func Open(path string) (*Reader, error) {
+	manifest, err := internal.ReadRunManifest(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s has no %s next to it", path, internal.RunManifestFile)
+	}
+	if manifest.SchemaVersion != internal.SchemaVersion {
+		return nil, fmt.Errorf("%s has schema version %d, only %d is supported", path, manifest.SchemaVersion, internal.SchemaVersion)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{
+		path:     path,
+		file:     file,
+		csv:      csv.NewReader(file),
+		manifest: manifest,
+	}
+
+	header, err := r.csv.Read()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read the header of %s: %w", path, err)
+	}
+	if expected := internal.ResultColumns(manifest.ChunkSizes...); !slices.Equal(header, expected) {
+		file.Close()
+		return nil, fmt.Errorf("%s has columns %v, expected %v", path, header, expected)
+	}
+	return r, nil
+}
+
+// Manifest returns the run manifest of the file
+func (r *Reader) Manifest() *internal.RunManifest {
+	return r.manifest
+}
+
+// Next returns the next record, or io.EOF at the end of the file
+func (r *Reader) Next() (*Record, error) {
+	row, err := r.csv.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", r.path, err)
+	}
+	rec, err := r.parse(row)
+	if err != nil {
+		line, _ := r.csv.FieldPos(0)
+		return nil, fmt.Errorf("%s line %d: %w", r.path, line, err)
+	}
+	return rec, nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// parse converts a row, which has the columns of internal.ResultColumns
+func (r *Reader) parse(row []string) (*Record, error) {
+	rec := Record{ChunkSize: r.manifest.ChunkSize}
+	p := parser{row: row}
+	rec.BlockNumber = p.uint("block_number", 0, 64)
+	if row[1] != "" {
+		if !common.IsHexAddress(row[1]) {
+			return nil, fmt.Errorf("invalid address %q", row[1])
+		}
+		rec.Address = common.HexToAddress(row[1])
+	}
+	rec.BytecodeSize = uint32(p.uint("bytecode_size", 2, 32))
+	rec.Chunks = p.chunks("chunks_data", 3)
+	rec.CodeSizeCount = p.int("code_size_count", 4)
+	rec.CodeCopyCount = p.int("code_copy_count", 5)
+	if row[6] != "" {
+		rec.CopyChunks = p.chunks("code_copy_data", 6)
+	}
+	rec.StemsCount = p.int("stems_count", 7)
+	rec.HeaderStem = p.bool("header_stem", 8)
+	rec.WitnessGas = p.uint("witness_gas", 9, 64)
+
+	switch codeType := row[10]; codeType {
+	case "runtime":
+		if rec.Address == (common.Address{}) {
+			return nil, errors.New("runtime code without an address")
+		}
+	case "initcode":
+		hash, err := common.ParseHexOrString(row[11])
+		if err != nil || len(hash) != common.HashLength {
+			return nil, fmt.Errorf("invalid initcode hash %q", row[11])
+		}
+		rec.InitCodeHash = common.BytesToHash(hash)
+	default:
+		return nil, fmt.Errorf("invalid code type %q", codeType)
+	}
+
+	for i, size := range r.manifest.ChunkSizes {
+		column := 12 + 2*i
+		rec.Extra = append(rec.Extra, ChunkSizeData{
+			ChunkSize:  size,
+			Chunks:     p.chunks(fmt.Sprintf("chunks_data_%d", size), column),
+			StemsCount: p.int(fmt.Sprintf("stems_count_%d", size), column+1),
+		})
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &rec, nil
+}
+
+// Result rebuilds the merged result the record was written from. The bytes accessed within a chunk aren't
+// recorded, so only the counts at the chunk size of the record are exact.
+func (r *Record) Result() (*internal.MergedTraceResult, error) {
+	bits, err := internal.NewBitSetFromChunks(r.BytecodeSize, r.ChunkSize, r.Chunks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunks data: %w", err)
+	}
+	result := &internal.MergedTraceResult{
+		Bits:          bits,
+		CodeSizeCount: r.CodeSizeCount,
+		CodeCopyCount: r.CodeCopyCount,
+		WitnessGas:    r.WitnessGas,
+	}
+	if r.CopyChunks != nil {
+		result.CopyBits, err = internal.NewBitSetFromChunks(r.BytecodeSize, r.ChunkSize, r.CopyChunks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid code copy data: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// parser parses the columns of a row, keeping the first error
+type parser struct {
+	row []string
+	err error
+}
+
+func (p *parser) fail(column string, i int, err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q: %w", column, p.row[i], err)
+	}
+}
+
+func (p *parser) uint(column string, i int, bitSize int) uint64 {
+	v, err := strconv.ParseUint(p.row[i], 10, bitSize)
+	if err != nil {
+		p.fail(column, i, err)
+	}
+	return v
+}
+
+func (p *parser) int(column string, i int) int {
+	v, err := strconv.Atoi(p.row[i])
+	if err != nil {
+		p.fail(column, i, err)
+	}
+	return v
+}
+
+func (p *parser) bool(column string, i int) bool {
+	v, err := strconv.ParseBool(p.row[i])
+	if err != nil {
+		p.fail(column, i, err)
+	}
+	return v
+}
+
+func (p *parser) chunks(column string, i int) []byte {
+	v, err := base64.StdEncoding.DecodeString(p.row[i])
+	if err != nil {
+		p.fail(column, i, err)
+	}
+	return v
+}
@@ -0,0 +1,183 @@
+package reader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal"
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+var (
+	addr         = common.HexToAddress("0x1234567890123456789012345678901234567890")
+	initCodeHash = common.HexToHash("0xaa")
+)
+
+// writeResults writes two blocks accessing the same contract and initcode, with the manifest of the chunk size
+func writeResults(t *testing.T, dir string, chunkSize uint32) string {
+	t.Helper()
+
+	config := &internal.Config{ChunkSize: chunkSize, ChunkSizes: []uint32{64}}
+	if err := internal.WriteRunManifest(dir, internal.NewRunManifest(config, witness.Schedule{}, nil)); err != nil {
+		t.Fatalf("WriteRunManifest() failed: %v", err)
+	}
+
+	writer := internal.NewResultWriter(dir, 0, 64)
+	for i, blockNum := range []uint64{1, 2} {
+		bits := internal.NewBitSet(100, chunkSize)
+		bits.Set(uint32(10 + 40*i))
+		copyBits := internal.NewBitSet(100, chunkSize)
+		copyBits.SetRange(90, 100)
+		initCode := internal.NewInitCodeBitSet(40, chunkSize)
+		initCode.SetRange(0, 5)
+
+		err := writer.WriteBlock(internal.BlockResult{
+			BlockNum:  blockNum,
+			Results:   map[common.Address]*internal.MergedTraceResult{addr: {Bits: bits, CopyBits: copyBits, CodeCopyCount: 1, WitnessGas: 100}},
+			InitCodes: map[common.Hash]*internal.MergedTraceResult{initCodeHash: {Bits: initCode, CodeSizeCount: 1}},
+		})
+		if err != nil {
+			t.Fatalf("WriteBlock() failed: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	return filepath.Join(dir, "analysis-0.csv")
+}
+
+func TestReader(t *testing.T) {
+	path := writeResults(t, t.TempDir(), 32)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer r.Close()
+
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() failed: %v", err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(records))
+	}
+
+	runtime, initCode := records[0], records[1]
+	if runtime.BlockNumber != 1 || runtime.Address != addr || runtime.IsInitCode() || runtime.BytecodeSize != 100 {
+		t.Errorf("Unexpected runtime record %+v", runtime)
+	}
+	if !slices.Equal(runtime.Chunks, []byte{1, 0, 0, 0}) || !slices.Equal(runtime.CopyChunks, []byte{0, 0, 6, 4}) || runtime.CodeCopyCount != 1 {
+		t.Errorf("Unexpected runtime chunks %+v", runtime)
+	}
+	if runtime.StemsCount != 1 || !runtime.HeaderStem || runtime.WitnessGas != 100 {
+		t.Errorf("Unexpected runtime stems %+v", runtime)
+	}
+	if len(runtime.Extra) != 1 || runtime.Extra[0].ChunkSize != 64 || !slices.Equal(runtime.Extra[0].Chunks, []byte{1, 0}) {
+		t.Errorf("Unexpected extra chunk sizes %+v", runtime.Extra)
+	}
+	if !initCode.IsInitCode() || initCode.InitCodeHash != initCodeHash || initCode.Address != (common.Address{}) || initCode.CodeSizeCount != 1 {
+		t.Errorf("Unexpected initcode record %+v", initCode)
+	}
+
+	// The rebuilt result has the chunks of the original one
+	result, err := runtime.Result()
+	if err != nil {
+		t.Fatalf("Result() failed: %v", err)
+	}
+	if !slices.Equal(result.AccessedChunks(), []uint32{0, 2, 3}) || result.Bits.Count() != 1 || result.CopyBits.Count() != 10 {
+		t.Errorf("Unexpected result chunks %v", result.AccessedChunks())
+	}
+}
+
+func TestReadAggregates(t *testing.T) {
+	dir := t.TempDir()
+	path := writeResults(t, dir, 32)
+
+	files, err := Files(dir)
+	if err != nil || !slices.Equal(files, []string{path}) {
+		t.Fatalf("Expected %s, got %v (%v)", path, files, err)
+	}
+
+	aggregates, err := ReadAggregates(files...)
+	if err != nil {
+		t.Fatalf("ReadAggregates() failed: %v", err)
+	}
+	if aggregates.Manifest.ChunkSize != 32 || len(aggregates.Contracts) != 2 {
+		t.Fatalf("Unexpected aggregates %+v", aggregates)
+	}
+
+	contract := aggregates.Contracts[Key{Address: addr, BytecodeSize: 100}]
+	if contract == nil || contract.Blocks != 2 {
+		t.Fatalf("Unexpected contract aggregate %+v", contract)
+	}
+	if !slices.Equal(contract.Result.Bits.AccessedChunks(), []uint32{0, 1}) || contract.Result.CodeCopyCount != 2 || contract.Result.WitnessGas != 200 {
+		t.Errorf("Unexpected contract result %v", contract.Result.Bits.AccessedChunks())
+	}
+	if initCode := aggregates.Contracts[Key{InitCodeHash: initCodeHash, BytecodeSize: 40}]; initCode == nil || initCode.Result.CodeSizeCount != 2 {
+		t.Errorf("Unexpected initcode aggregate %+v", initCode)
+	}
+}
+
+func TestReadAggregates_MixedChunkSizes(t *testing.T) {
+	first := writeResults(t, t.TempDir(), 32)
+	second := writeResults(t, t.TempDir(), 31)
+
+	if _, err := ReadAggregates(first, second); err == nil || !strings.Contains(err.Error(), "chunk size") {
+		t.Errorf("Expected a chunk size mismatch, got %v", err)
+	}
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "analysis-0.csv")
+	if err := os.WriteFile(path, []byte("block_number,address\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Errorf("Expected a missing manifest to fail")
+	}
+
+	// Columns that don't match the manifest
+	if err := internal.WriteRunManifest(dir, internal.NewRunManifest(&internal.Config{ChunkSize: 32}, witness.Schedule{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "columns") {
+		t.Errorf("Expected a column mismatch, got %v", err)
+	}
+
+	// Another schema version
+	manifest, _ := internal.ReadRunManifest(dir)
+	manifest.SchemaVersion = internal.SchemaVersion + 1
+	os.Remove(filepath.Join(dir, internal.RunManifestFile))
+	if err := internal.WriteRunManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "schema version") {
+		t.Errorf("Expected a schema version mismatch, got %v", err)
+	}
+}
+
+func TestFiles_NotCSV(t *testing.T) {
+	dir := t.TempDir()
+	config := &internal.Config{ChunkSize: 32, OutputFormat: internal.OutputParquet}
+	if err := internal.WriteRunManifest(dir, internal.NewRunManifest(config, witness.Schedule{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Files(dir); err == nil || !strings.Contains(err.Error(), "only CSV") {
+		t.Errorf("Expected parquet results to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+)
+
+// ReplayBlock holds everything needed to replay a block without a node: the block itself and the state
+// of every account it touches, as of right before the block.
+type ReplayBlock struct {
+	Header       *types.Header        `json:"header"`
+	Transactions []*types.Transaction `json:"transactions"`
+	Prestate     Prestate             `json:"prestate"`
+}
+
+// Prestate is the state of the accounts touched by a block, in the format of the prestateTracer
+type Prestate map[common.Address]*PrestateAccount
+
+type PrestateAccount struct {
+	Balance *hexutil.Big                `json:"balance,omitempty"`
+	Nonce   uint64                      `json:"nonce,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// PrestateTrace is the prestateTracer trace of a single transaction
+type PrestateTrace struct {
+	TxHash string   `json:"txHash"`
+	Result Prestate `json:"result"`
+}
+
+// MergePrestates merges the prestates of the transactions of a block into the state before the block.
+// An account or storage slot is first seen by the transaction that first touches it, before which it
+// can't have changed, so the first value seen is kept.
+//
+// An account created by a transaction is left out of its prestate, so the first prestate it is seen in is
+// the state after its creation. The call frames of the transactions tell the accounts they create, which
+// are left out of the merged state unless they existed before, e.g. with a balance sent ahead of the creation.
+func MergePrestates(traces []PrestateTrace, frames []CallFrameTrace) Prestate {
+	merged := make(Prestate)
+	created := make(map[common.Address]bool)
+	for i, trace := range traces {
+		for addr, account := range trace.Result {
+			if created[addr] {
+				continue
+			}
+			existing, ok := merged[addr]
+			if !ok {
+				existing = &PrestateAccount{
+					Balance: account.Balance,
+					Nonce:   account.Nonce,
+					Code:    account.Code,
+					Storage: make(map[common.Hash]common.Hash),
+				}
+				merged[addr] = existing
+			}
+			for slot, value := range account.Storage {
+				if _, ok := existing.Storage[slot]; !ok {
+					existing.Storage[slot] = value
+				}
+			}
+		}
+
+		if i < len(frames) {
+			for _, addr := range createdAccounts(&frames[i].Result, nil) {
+				if _, ok := merged[addr]; !ok {
+					created[addr] = true
+				}
+			}
+		}
+	}
+	return merged
+}
+
+// createdAccounts appends the accounts created by the frame and its subcalls to created
+func createdAccounts(frame *CallFrame, created []common.Address) []common.Address {
+	if frame.Type == "CREATE" || frame.Type == "CREATE2" {
+		created = append(created, common.HexToAddress(frame.To))
+	}
+	for i := range frame.Calls {
+		created = createdAccounts(&frame.Calls[i], created)
+	}
+	return created
+}
+
+func replayFile(dir string, blockNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("block_%d_replay.json", blockNum))
+}
+
+// ReadReplayBlock reads the replay file of the block from dir
+func ReadReplayBlock(dir string, blockNum uint64) (*ReplayBlock, error) {
+	data, err := os.ReadFile(replayFile(dir, blockNum))
+	if err != nil {
+		return nil, err
+	}
+	var block ReplayBlock
+	if err := json.Unmarshal(data, &block); err != nil {
+		return nil, fmt.Errorf("failed to decode replay file of block %d: %w", blockNum, err)
+	}
+	if block.Header == nil {
+		return nil, fmt.Errorf("replay file of block %d has no header", blockNum)
+	}
+	return &block, nil
+}
+
+// WriteReplayBlock atomically writes the replay file of the block to dir
+func WriteReplayBlock(dir string, block *ReplayBlock) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+
+	path := replayFile(dir, block.Header.Number.Uint64())
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// replayChain is the chain the block is replayed on. Only the ancestors' hashes would be read from it,
+// for BLOCKHASH, and only the parent hash is known from the header: older ones read as zero.
+type replayChain struct{}
+
+func (replayChain) Engine() consensus.Engine                    { return nil }
+func (replayChain) GetHeader(common.Hash, uint64) *types.Header { return nil }
+func (replayChain) Config() *params.ChainConfig                 { return params.MainnetChainConfig }
+
+// Replay executes the block locally on top of its prestate, recording the code accessed by every
+// transaction the same way as from a trace. The pre-block system calls (EIP-4788, EIP-2935) are not
+// replayed, as they are not part of any transaction trace either.
+func (a *Analyzer) Replay(block *ReplayBlock) (BlockResult, error) {
+	statedb, err := state.New(types.EmptyRootHash, state.NewDatabaseForTesting())
+	if err != nil {
+		return BlockResult{}, err
+	}
+	for addr, account := range block.Prestate {
+		if account.Balance != nil {
+			statedb.SetBalance(addr, uint256.MustFromBig(account.Balance.ToInt()), tracing.BalanceChangeUnspecified)
+		}
+		statedb.SetNonce(addr, account.Nonce, tracing.NonceChangeUnspecified)
+		statedb.SetCode(addr, account.Code)
+		for slot, value := range account.Storage {
+			statedb.SetState(addr, slot, value)
+		}
+	}
+	statedb.Finalise(true)
+
+	header := block.Header
+	config := params.MainnetChainConfig
+	tracer := &replayTracer{chunkSize: a.chunkSize}
+	evm := vm.NewEVM(core.NewEVMBlockContext(header, replayChain{}, &header.Coinbase), statedb, config, vm.Config{Tracer: tracer.hooks()})
+
+	var (
+		signer  = types.MakeSigner(config, header.Number, header.Time)
+		gp      = new(core.GasPool).AddGas(header.GasLimit)
+		usedGas uint64
+		txs     = make([]TxResult, len(block.Transactions))
+	)
+	for i, tx := range block.Transactions {
+		msg, err := core.TransactionToMessage(tx, signer, header.BaseFee)
+		if err != nil {
+			return BlockResult{}, fmt.Errorf("could not replay tx %d [%s]: %w", i, tx.Hash().Hex(), err)
+		}
+		statedb.SetTxContext(tx.Hash(), i)
+		if _, err := core.ApplyTransactionWithEVM(msg, gp, statedb, header.Number, header.Hash(), tx, &usedGas, evm); err != nil {
+			return BlockResult{}, fmt.Errorf("could not replay tx %d [%s]: %w", i, tx.Hash().Hex(), err)
+		}
+		if tracer.err != nil {
+			return BlockResult{}, tracer.err
+		}
+		txs[i] = a.newTxResult(tx.Hash().Hex(), i, tx.Type(), tracer.access)
+	}
+
+	return newBlockResult(header.Number.Uint64(), txs), nil
+}
+
+// replayFrame is the code executed by a call frame, resolved on its first step
+type replayFrame struct {
+	typ    vm.OpCode
+	addr   common.Address // Code address, which is the callee even for DELEGATECALL/CALLCODE
+	result *TraceResult   // nil until the first step, or if the code isn't recorded
+}
+
+// replayTracer records the code accessed by a transaction into its txAccess as the EVM executes it
+type replayTracer struct {
+	chunkSize uint32
+	state     tracing.StateDB
+	frames    []replayFrame
+	access    txAccess
+	err       error
+}
+
+func (t *replayTracer) hooks() *tracing.Hooks {
+	return &tracing.Hooks{
+		OnTxStart: t.onTxStart,
+		OnEnter:   t.onEnter,
+		OnExit:    t.onExit,
+		OnOpcode:  t.onOpcode,
+	}
+}
+
+func (t *replayTracer) onTxStart(vmContext *tracing.VMContext, tx *types.Transaction, from common.Address) {
+	t.state = vmContext.StateDB
+	t.frames = t.frames[:0]
+	t.access = txAccess{
+		results:   make(map[common.Address]*TraceResult),
+		initCodes: make(map[common.Hash]*TraceResult),
+	}
+}
+
+func (t *replayTracer) onEnter(depth int, typ byte, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	t.frames = append(t.frames, replayFrame{typ: vm.OpCode(typ), addr: to})
+}
+
+func (t *replayTracer) onExit(depth int, output []byte, gasUsed uint64, err error, reverted bool) {
+	if len(t.frames) > 0 {
+		t.frames = t.frames[:len(t.frames)-1]
+	}
+}
+
+func (t *replayTracer) onOpcode(pc uint64, op byte, gas, cost uint64, scope tracing.OpContext, rData []byte, depth int, err error) {
+	if len(t.frames) == 0 {
+		if t.err == nil {
+			t.err = errors.New("opcode executed outside of a call frame")
+		}
+		return
+	}
+	frame := &t.frames[len(t.frames)-1]
+	if frame.result == nil {
+		frame.result = t.frameResult(frame, scope.ContractCode())
+	}
+	res := frame.result
+	if res == nil {
+		return
+	}
+
+	opCode := vm.OpCode(op)
+	end := pc + 1
+	if opCode.IsPush() {
+		end += uint64(opCode - vm.PUSH0)
+	}
+	// The implicit STOP past the end of the code is executed too
+	if size := uint64(res.Bits.Size()); pc < size {
+		res.Bits.SetRange(uint32(pc), uint32(min(end, size)))
+	}
+
+	stack := scope.StackData()
+	switch opCode {
+	case vm.CODESIZE:
+		res.CodeSizeCount++
+	case vm.CODECOPY:
+		// CODECOPY(destOffset, offset, size)
+		res.CodeCopyCount++
+		markCopyRange(res.CopyBits, stack[len(stack)-2].Hex(), stack[len(stack)-3].Hex())
+	case vm.EXTCODESIZE, vm.EXTCODECOPY:
+		addr := common.Address(stack[len(stack)-1].Bytes20())
+		ext := t.codeResult(addr, t.state.GetCode(addr))
+		if ext == nil {
+			return
+		}
+		if opCode == vm.EXTCODESIZE {
+			ext.CodeSizeCount++
+		} else {
+			// EXTCODECOPY(address, destOffset, offset, size)
+			ext.CodeCopyCount++
+			markCopyRange(ext.CopyBits, stack[len(stack)-3].Hex(), stack[len(stack)-4].Hex())
+		}
+	}
+}
+
+// frameResult returns the result the frame's code is recorded in. A frame of an account delegated under
+// EIP-7702 executes the code of the delegate, which is recorded as the delegate's.
+func (t *replayTracer) frameResult(frame *replayFrame, code []byte) *TraceResult {
+	if frame.typ != vm.CREATE && frame.typ != vm.CREATE2 {
+		if target, ok := types.ParseDelegation(t.state.GetCode(frame.addr)); ok {
+			return t.codeResult(target, code)
+		}
+		return t.codeResult(frame.addr, code)
+	}
+
+	if len(code) == 0 || len(code) > maxInitCodeBytes {
+		return nil
+	}
+	initCode := newInitCode(code)
+	if _, ok := t.access.initCodes[initCode.initCodeHash]; !ok {
+		t.access.initCodes[initCode.initCodeHash] = newTraceResult(initCode, t.chunkSize)
+	}
+	return t.access.initCodes[initCode.initCodeHash]
+}
+
+// codeResult returns the result the runtime code of addr is recorded in, or nil if it has no code
+func (t *replayTracer) codeResult(addr common.Address, code []byte) *TraceResult {
+	if len(code) == 0 || len(code) > maxInitCodeBytes {
+		return nil
+	}
+	if _, ok := t.access.results[addr]; !ok {
+		t.access.results[addr] = newTraceResult(newCode(addr, code), t.chunkSize)
+	}
+	return t.access.results[addr]
+}
@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+func TestReplay(t *testing.T) {
+	a, b := common.HexToAddress("0xaa"), common.HexToAddress("0xbb")
+
+	// a calls b, then executes CODESIZE. The trailing bytes are never executed.
+	codeA := append([]byte{0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x73}, b.Bytes()...)
+	codeA = append(codeA, 0x5a, 0xf1, 0x50, 0x38, 0x50, 0x00, 0xfe, 0xfe, 0xfe)
+	// b copies its first 2 bytes to memory: CODECOPY(0, 0, 2)
+	codeB := []byte{0x60, 0x02, 0x60, 0x00, 0x60, 0x00, 0x39, 0x00, 0xfe, 0xfe}
+	// Deploys empty code: RETURN(0, 0)
+	initCode := []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	signer := types.LatestSignerForChainID(params.MainnetChainConfig.ChainID)
+	baseFee := big.NewInt(params.GWei)
+
+	var txs []*types.Transaction
+	for nonce, to := range []*common.Address{&a, nil} {
+		tx := &types.DynamicFeeTx{
+			ChainID:   params.MainnetChainConfig.ChainID,
+			Nonce:     uint64(nonce),
+			GasFeeCap: baseFee,
+			Gas:       100_000,
+			To:        to,
+		}
+		if to == nil {
+			tx.Data = initCode
+		}
+		signed, err := types.SignNewTx(key, signer, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, signed)
+	}
+
+	block := &ReplayBlock{
+		Header: &types.Header{
+			Number:     big.NewInt(20_000_000),
+			Time:       1_720_000_000, // Cancun
+			GasLimit:   30_000_000,
+			BaseFee:    baseFee,
+			Difficulty: new(big.Int),
+		},
+		Transactions: txs,
+		Prestate: MergePrestates([]PrestateTrace{
+			{Result: Prestate{
+				sender: {Balance: (*hexutil.Big)(big.NewInt(params.Ether))},
+				a:      {Code: codeA},
+				b:      {Code: codeB},
+			}},
+			// A later transaction seeing a different balance doesn't override the state before the block
+			{Result: Prestate{sender: {Balance: (*hexutil.Big)(big.NewInt(1)), Nonce: 1}}},
+		}, nil),
+	}
+
+	// Round trip through the replay file
+	dir := t.TempDir()
+	if err := WriteReplayBlock(dir, block); err != nil {
+		t.Fatalf("WriteReplayBlock() failed: %v", err)
+	}
+	block, err = ReadReplayBlock(dir, 20_000_000)
+	if err != nil {
+		t.Fatalf("ReadReplayBlock() failed: %v", err)
+	}
+	if len(block.Transactions) != 2 || block.Prestate[sender].Nonce != 0 {
+		t.Fatalf("Unexpected replay block %+v", block)
+	}
+
+	schedule, err := witness.LookupSchedule(witness.DefaultSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer := NewAnalyzer(0, nil, nil, nil, schedule, 4)
+
+	result, err := analyzer.Replay(block)
+	if err != nil {
+		t.Fatalf("Replay() failed: %v", err)
+	}
+	if len(result.Txs) != 2 || result.Txs[0].TxHash != txs[0].Hash().Hex() {
+		t.Fatalf("Unexpected transactions %+v", result.Txs)
+	}
+
+	call := result.Txs[0]
+	if res := call.Results[a]; res == nil || res.Bits.Count() != len(codeA)-3 || res.CodeSizeCount != 1 {
+		t.Errorf("Unexpected result for a: %v", res)
+	}
+	if res := call.Results[b]; res == nil || res.Bits.Count() != 8 || res.CopyBits.Count() != 2 || res.CodeCopyCount != 1 {
+		t.Errorf("Unexpected result for b: %v", res)
+	}
+	if call.WitnessGas == 0 {
+		t.Error("Expected witness gas for the call")
+	}
+
+	create := result.Txs[1]
+	if res := create.InitCodes[crypto.Keccak256Hash(initCode)]; res == nil || res.Bits.Count() != len(initCode) {
+		t.Errorf("Unexpected initcode result %v", res)
+	}
+}
+
+// A contract created in the block is seen by the prestates of the later transactions with its code, which
+// isn't the state before the block: replaying the creation on top of it would fail on an address collision
+func TestReplay_CreateThenCall(t *testing.T) {
+	// Deploys PUSH1 1 POP STOP: MSTORE(0, code) RETURN(28, 4)
+	runtime := []byte{0x60, 0x01, 0x50, 0x00}
+	initCode := append([]byte{0x63}, runtime...)
+	initCode = append(initCode, 0x60, 0x00, 0x52, 0x60, 0x04, 0x60, 0x1c, 0xf3)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	created := crypto.CreateAddress(sender, 0)
+	signer := types.LatestSignerForChainID(params.MainnetChainConfig.ChainID)
+	baseFee := big.NewInt(params.GWei)
+
+	var txs []*types.Transaction
+	for nonce, to := range []*common.Address{nil, &created} {
+		tx := &types.DynamicFeeTx{
+			ChainID:   params.MainnetChainConfig.ChainID,
+			Nonce:     uint64(nonce),
+			GasFeeCap: baseFee,
+			Gas:       100_000,
+			To:        to,
+		}
+		if to == nil {
+			tx.Data = initCode
+		}
+		signed, err := types.SignNewTx(key, signer, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, signed)
+	}
+
+	prestate := MergePrestates([]PrestateTrace{
+		{Result: Prestate{sender: {Balance: (*hexutil.Big)(big.NewInt(params.Ether))}}},
+		{Result: Prestate{
+			sender:  {Balance: (*hexutil.Big)(big.NewInt(params.Ether / 2)), Nonce: 1},
+			created: {Code: runtime, Nonce: 1},
+		}},
+	}, []CallFrameTrace{
+		{Result: CallFrame{Type: "CREATE", To: created.Hex()}},
+		{Result: CallFrame{Type: "CALL", To: created.Hex()}},
+	})
+	if _, ok := prestate[created]; ok {
+		t.Fatalf("Expected the created contract to be left out of the prestate, got %+v", prestate[created])
+	}
+
+	block := &ReplayBlock{
+		Header: &types.Header{
+			Number:     big.NewInt(20_000_000),
+			Time:       1_720_000_000, // Cancun
+			GasLimit:   30_000_000,
+			BaseFee:    baseFee,
+			Difficulty: new(big.Int),
+		},
+		Transactions: txs,
+		Prestate:     prestate,
+	}
+
+	schedule, err := witness.LookupSchedule(witness.DefaultSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewAnalyzer(0, nil, nil, nil, schedule, 4).Replay(block)
+	if err != nil {
+		t.Fatalf("Replay() failed: %v", err)
+	}
+	if res := result.Txs[0].InitCodes[crypto.Keccak256Hash(initCode)]; res == nil || res.Bits.Count() != len(initCode) {
+		t.Errorf("Unexpected initcode result %v", res)
+	}
+	if res := result.Txs[1].Results[created]; res == nil || int(res.Bits.Size()) != len(runtime) || res.Bits.Count() != len(runtime) {
+		t.Errorf("Unexpected result for the created contract: %v", res)
+	}
+}
+
+func TestMergePrestates_PrefundedCreation(t *testing.T) {
+	addr := common.HexToAddress("0xcc")
+	prestate := MergePrestates([]PrestateTrace{
+		{Result: Prestate{addr: {Balance: (*hexutil.Big)(big.NewInt(5))}}},
+		{Result: Prestate{addr: {Balance: (*hexutil.Big)(big.NewInt(5)), Nonce: 1, Code: []byte{0x00}}}},
+	}, []CallFrameTrace{
+		{Result: CallFrame{Type: "CALL", Calls: []CallFrame{{Type: "CREATE2", To: addr.Hex()}}}},
+		{Result: CallFrame{Type: "CALL", To: addr.Hex()}},
+	})
+	// The account existed before its creation, so its state before the block is kept
+	if account := prestate[addr]; account == nil || account.Nonce != 0 || len(account.Code) != 0 {
+		t.Errorf("Unexpected prestate %+v", account)
+	}
+}
+
+// A call to an account delegated under EIP-7702 executes the delegate's code, recorded as the delegate's
+func TestReplay_DelegatedCall(t *testing.T) {
+	eoa, delegate := common.HexToAddress("0xaa"), common.HexToAddress("0xbb")
+	// 30 JUMPDEST then STOP, longer than the 23 bytes of the delegation designator
+	delegateCode := append(bytes.Repeat([]byte{0x5b}, 30), 0x00)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	signer := types.LatestSignerForChainID(params.MainnetChainConfig.ChainID)
+	baseFee := big.NewInt(params.GWei)
+	tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+		ChainID:   params.MainnetChainConfig.ChainID,
+		GasFeeCap: baseFee,
+		Gas:       100_000,
+		To:        &eoa,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &ReplayBlock{
+		Header: &types.Header{
+			Number:     big.NewInt(22_500_000),
+			Time:       1_747_000_000, // Prague
+			GasLimit:   30_000_000,
+			BaseFee:    baseFee,
+			Difficulty: new(big.Int),
+		},
+		Transactions: []*types.Transaction{tx},
+		Prestate: Prestate{
+			sender:   {Balance: (*hexutil.Big)(big.NewInt(params.Ether))},
+			eoa:      {Code: types.AddressToDelegation(delegate)},
+			delegate: {Code: delegateCode},
+		},
+	}
+
+	schedule, err := witness.LookupSchedule(witness.DefaultSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewAnalyzer(0, nil, nil, nil, schedule, 4).Replay(block)
+	if err != nil {
+		t.Fatalf("Replay() failed: %v", err)
+	}
+	if res := result.Txs[0].Results[delegate]; res == nil || res.Bits.Size() != 31 || res.Bits.Count() != 31 {
+		t.Errorf("Expected the delegate's code to be executed, got %v", res)
+	}
+	if res, ok := result.Txs[0].Results[eoa]; ok {
+		t.Errorf("Expected no code recorded for the delegated account, got %v", res)
+	}
+}
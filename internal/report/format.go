@@ -0,0 +1,135 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats of a report
+const (
+	FormatTable    = "table"
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+)
+
+// Formats returns the supported output formats
+func Formats() []string {
+	return []string{FormatTable, FormatJSON, FormatMarkdown}
+}
+
+// Write writes the report in the given format
+func Write(w io.Writer, r *Report, format string) error {
+	switch format {
+	case FormatTable:
+		return writeTables(w, r)
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case FormatMarkdown:
+		return writeMarkdown(w, r)
+	default:
+		return fmt.Errorf("unknown report format %q, must be one of: %s", format, strings.Join(Formats(), ", "))
+	}
+}
+
+// table is a section of the report, rendered as text or markdown
+type table struct {
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// tables lays out the report as one table per metric, with a row per size bucket and the overall one last
+func (r *Report) tables() []table {
+	groups := append(r.Buckets[:len(r.Buckets):len(r.Buckets)], r.Overall)
+
+	usage := table{
+		title:  "Code opcodes",
+		header: []string{"Size", "Contracts", "CODESIZE", "CODECOPY"},
+	}
+	for _, g := range groups {
+		usage.rows = append(usage.rows, []string{g.Bucket.Name, fmt.Sprint(g.Contracts), percent(g.CodeSizeShare), percent(g.CodeCopyShare)})
+	}
+	tables := []table{usage}
+
+	metrics := []struct {
+		name string
+		dist func(g Group) Distribution
+	}{
+		{"Bytes accessed", func(g Group) Distribution { return g.BytesRatio }},
+		{"Chunks accessed", func(g Group) Distribution { return g.ChunksRatio }},
+		{"Chunk efficiency", func(g Group) Distribution { return g.Efficiency }},
+	}
+	for _, m := range metrics {
+		stats := table{title: m.name, header: []string{"Size", "Count", "Mean"}}
+		for _, p := range Percentiles {
+			stats.header = append(stats.header, fmt.Sprintf("P%d", p))
+		}
+		histogram := table{title: m.name + " histogram", header: []string{"Size"}}
+		for i := range HistogramBins {
+			histogram.header = append(histogram.header, fmt.Sprintf("%d-%d%%", i*100/HistogramBins, (i+1)*100/HistogramBins))
+		}
+
+		for _, g := range groups {
+			d := m.dist(g)
+			row := []string{g.Bucket.Name, fmt.Sprint(d.Count), percent(d.Mean)}
+			for _, v := range d.Percentiles {
+				row = append(row, percent(v))
+			}
+			stats.rows = append(stats.rows, row)
+
+			row = []string{g.Bucket.Name}
+			for _, count := range d.Histogram {
+				row = append(row, fmt.Sprint(count))
+			}
+			histogram.rows = append(histogram.rows, row)
+		}
+		tables = append(tables, stats, histogram)
+	}
+	return tables
+}
+
+// summary describes what the report was computed from
+func (r *Report) summary() string {
+	unit := "contract accesses, counted once per block"
+	if r.Merged {
+		unit = "contracts, merged over the blocks"
+	}
+	return fmt.Sprintf("Chunk size %d bytes, %d %s", r.ChunkSize, r.Overall.Contracts, unit)
+}
+
+func writeTables(w io.Writer, r *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, r.summary())
+	for _, t := range r.tables() {
+		fmt.Fprintf(tw, "\n%s\n", t.title)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t")+"\t")
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t")+"\t")
+		}
+	}
+	return tw.Flush()
+}
+
+func writeMarkdown(w io.Writer, r *Report) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", r.summary())
+	for _, t := range r.tables() {
+		fmt.Fprintf(&b, "\n### %s\n\n", t.title)
+		fmt.Fprintf(&b, "| %s |\n", strings.Join(t.header, " | "))
+		fmt.Fprintf(&b, "|%s\n", strings.Repeat("---|", len(t.header)))
+		for _, row := range t.rows {
+			fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func percent(v float64) string {
+	return fmt.Sprintf("%.1f%%", v*100)
+}
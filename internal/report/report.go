@@ -0,0 +1,230 @@
+// Package report computes the summary statistics of result files: the proportion of the code accessed, in bytes
+// and chunks, its distribution by contract size, the use of CODESIZE/CODECOPY and the chunk efficiency.
+package report
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal"
+	"github.com/weiihann/chunk-analysis/internal/reader"
+)
+
+// Percentiles reported for every distribution
+var Percentiles = []int{10, 25, 50, 75, 90, 99}
+
+// HistogramBins is the number of bins of the histograms, evenly splitting [0, 1]
+const HistogramBins = 10
+
+// SizeBucket is a range of contract sizes, in bytes. Max is exclusive, 0 for no upper bound.
+type SizeBucket struct {
+	Name string `json:"name"`
+	Min  uint32 `json:"min"`
+	Max  uint32 `json:"max,omitempty"`
+}
+
+// SizeBuckets are the contract size categories of the notebook
+var SizeBuckets = []SizeBucket{
+	{Name: "<1KiB", Min: 0, Max: 1024},
+	{Name: "1-5KiB", Min: 1024, Max: 5120},
+	{Name: "5-10KiB", Min: 5120, Max: 10240},
+	{Name: "10-20KiB", Min: 10240, Max: 20480},
+	{Name: ">=20KiB", Min: 20480},
+}
+
+func (b SizeBucket) contains(size uint32) bool {
+	return size >= b.Min && (b.Max == 0 || size < b.Max)
+}
+
+// Report are the statistics of the runtime code in the result files, overall and by contract size. Initcode
+// isn't part of the state, so it isn't chunked and is left out.
+type Report struct {
+	ChunkSize uint32  `json:"chunk_size"`
+	Merged    bool    `json:"merged"` // Whether a contract is counted once, merged over every block it was accessed in
+	Overall   Group   `json:"overall"`
+	Buckets   []Group `json:"buckets"`
+}
+
+// Group are the statistics of the contracts of a size bucket. Unless merged, a contract accessed in several
+// blocks is counted once per block.
+type Group struct {
+	Bucket        SizeBucket   `json:"bucket"`
+	Contracts     int          `json:"contracts"`
+	CodeSizeShare float64      `json:"code_size_share"` // Share of the contracts using CODESIZE or EXTCODESIZE
+	CodeCopyShare float64      `json:"code_copy_share"` // Share of the contracts using CODECOPY or EXTCODECOPY
+	BytesRatio    Distribution `json:"bytes_accessed_ratio"`
+	ChunksRatio   Distribution `json:"chunks_accessed_ratio"`
+	Efficiency    Distribution `json:"chunk_efficiency"` // Of the contracts with at least one chunk accessed
+}
+
+// Distribution summarizes values in [0, 1]
+type Distribution struct {
+	Count       int       `json:"count"`
+	Mean        float64   `json:"mean"`
+	Percentiles []float64 `json:"percentiles"` // One per entry of Percentiles
+	Histogram   []int     `json:"histogram"`   // Number of values in each of the HistogramBins bins
+}
+
+// sample is the access of a contract, in a block or merged over the blocks
+type sample struct {
+	size         uint32
+	bytesRatio   float64 // Bytes accessed / code size
+	chunksRatio  float64 // Chunks accessed / chunks of the code
+	efficiency   float64 // Bytes accessed / (chunks accessed * chunk size), NaN if no chunk is accessed
+	usesCodeSize bool
+	usesCodeCopy bool
+}
+
+// newSample measures the access of a result. The bytes copied by CODECOPY/EXTCODECOPY are accessed too, as
+// they end up in the witness. Which of the executed and copied bytes of a chunk overlap isn't recorded, so
+// the larger of the two counts is taken.
+func newSample(result *internal.MergedTraceResult, chunkSize uint32) sample {
+	executed := result.Bits.ChunksFor(chunkSize)
+	var copied []byte
+	if result.CopyBits != nil {
+		copied = result.CopyBits.ChunksFor(chunkSize)
+	}
+
+	var bytes, chunks int
+	for i, count := range executed {
+		if copied != nil {
+			count = max(count, copied[i])
+		}
+		if count > 0 {
+			chunks++
+		}
+		bytes += int(count)
+	}
+
+	s := sample{
+		size:         result.Bits.Size(),
+		bytesRatio:   float64(bytes) / float64(result.Bits.Size()),
+		chunksRatio:  float64(chunks) / float64(len(executed)),
+		efficiency:   math.NaN(),
+		usesCodeSize: result.CodeSizeCount > 0,
+		usesCodeCopy: result.CodeCopyCount > 0,
+	}
+	if chunks > 0 {
+		s.efficiency = float64(bytes) / float64(chunks*int(chunkSize))
+	}
+	return s
+}
+
+// Build reads the result files and computes their report. When merged, every contract is measured once over
+// all the blocks it was accessed in, rather than once per block.
+func Build(paths []string, merged bool) (*Report, error) {
+	var (
+		samples  []sample
+		manifest *internal.RunManifest
+		err      error
+	)
+	if merged {
+		aggregates, err := reader.ReadAggregates(paths...)
+		if err != nil {
+			return nil, err
+		}
+		manifest = aggregates.Manifest
+		for key, aggregate := range aggregates.Contracts {
+			if key.InitCodeHash == (common.Hash{}) {
+				samples = append(samples, newSample(aggregate.Result, manifest.ChunkSize))
+			}
+		}
+	} else {
+		manifest, err = reader.Walk(paths, func(rec *reader.Record) error {
+			if rec.IsInitCode() {
+				return nil
+			}
+			result, err := rec.Result()
+			if err != nil {
+				return fmt.Errorf("block %d, %s: %w", rec.BlockNumber, rec.Address.Hex(), err)
+			}
+			samples = append(samples, newSample(result, rec.ChunkSize))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("no result file")
+	}
+	return newReport(samples, manifest.ChunkSize, merged), nil
+}
+
+func newReport(samples []sample, chunkSize uint32, merged bool) *Report {
+	r := &Report{
+		ChunkSize: chunkSize,
+		Merged:    merged,
+		Overall:   newGroup(SizeBucket{Name: "all"}, samples),
+	}
+	for _, bucket := range SizeBuckets {
+		var inBucket []sample
+		for _, s := range samples {
+			if bucket.contains(s.size) {
+				inBucket = append(inBucket, s)
+			}
+		}
+		r.Buckets = append(r.Buckets, newGroup(bucket, inBucket))
+	}
+	return r
+}
+
+func newGroup(bucket SizeBucket, samples []sample) Group {
+	g := Group{Bucket: bucket, Contracts: len(samples)}
+
+	var bytesRatios, chunksRatios, efficiencies []float64
+	var codeSize, codeCopy int
+	for _, s := range samples {
+		bytesRatios = append(bytesRatios, s.bytesRatio)
+		chunksRatios = append(chunksRatios, s.chunksRatio)
+		if !math.IsNaN(s.efficiency) {
+			efficiencies = append(efficiencies, s.efficiency)
+		}
+		if s.usesCodeSize {
+			codeSize++
+		}
+		if s.usesCodeCopy {
+			codeCopy++
+		}
+	}
+	if len(samples) > 0 {
+		g.CodeSizeShare = float64(codeSize) / float64(len(samples))
+		g.CodeCopyShare = float64(codeCopy) / float64(len(samples))
+	}
+	g.BytesRatio = newDistribution(bytesRatios)
+	g.ChunksRatio = newDistribution(chunksRatios)
+	g.Efficiency = newDistribution(efficiencies)
+	return g
+}
+
+func newDistribution(values []float64) Distribution {
+	d := Distribution{
+		Count:       len(values),
+		Percentiles: make([]float64, len(Percentiles)),
+		Histogram:   make([]int, HistogramBins),
+	}
+	if len(values) == 0 {
+		return d
+	}
+
+	slices.Sort(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+		// The last bin includes 1
+		d.Histogram[min(int(v*HistogramBins), HistogramBins-1)]++
+	}
+	d.Mean = sum / float64(len(values))
+	for i, p := range Percentiles {
+		d.Percentiles[i] = percentile(values, p)
+	}
+	return d
+}
+
+// percentile returns the nearest-rank percentile of the sorted values
+func percentile(sorted []float64, p int) float64 {
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
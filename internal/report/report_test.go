@@ -0,0 +1,154 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal"
+	"github.com/weiihann/chunk-analysis/internal/witness"
+)
+
+// writeResults writes a 100-byte contract accessed in two blocks, a 2KiB one using CODECOPY and an initcode
+func writeResults(t *testing.T, dir string) string {
+	t.Helper()
+
+	if err := internal.WriteRunManifest(dir, internal.NewRunManifest(&internal.Config{ChunkSize: 32}, witness.Schedule{}, nil)); err != nil {
+		t.Fatalf("WriteRunManifest() failed: %v", err)
+	}
+
+	small := common.HexToAddress("0x01")
+	large := common.HexToAddress("0x02")
+	writer := internal.NewResultWriter(dir, 0)
+	for _, blockNum := range []uint64{1, 2} {
+		smallBits := internal.NewBitSet(100, 32)
+		smallBits.SetRange(uint32(blockNum-1)*32, uint32(blockNum-1)*32+16) // Half of the first or second chunk
+		results := map[common.Address]*internal.MergedTraceResult{small: {Bits: smallBits}}
+
+		if blockNum == 1 {
+			largeBits := internal.NewBitSet(2048, 32)
+			largeBits.SetRange(0, 64)
+			copyBits := internal.NewBitSet(2048, 32)
+			copyBits.SetRange(2016, 2048)
+			results[large] = &internal.MergedTraceResult{Bits: largeBits, CopyBits: copyBits, CodeCopyCount: 1, CodeSizeCount: 1}
+		}
+
+		initCode := internal.NewInitCodeBitSet(40, 32)
+		initCode.SetRange(0, 40)
+		err := writer.WriteBlock(internal.BlockResult{
+			BlockNum:  blockNum,
+			Results:   results,
+			InitCodes: map[common.Hash]*internal.MergedTraceResult{common.HexToHash("0xaa"): {Bits: initCode}},
+		})
+		if err != nil {
+			t.Fatalf("WriteBlock() failed: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	return filepath.Join(dir, "analysis-0.csv")
+}
+
+func TestBuild(t *testing.T) {
+	path := writeResults(t, t.TempDir())
+
+	r, err := Build([]string{path}, false)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if r.ChunkSize != 32 || r.Overall.Contracts != 3 {
+		t.Fatalf("Expected 3 contract accesses, got %+v", r.Overall)
+	}
+	if r.Overall.CodeCopyShare != 1.0/3 || r.Overall.CodeSizeShare != 1.0/3 {
+		t.Errorf("Unexpected opcode shares %+v", r.Overall)
+	}
+
+	small, large := r.Buckets[0], r.Buckets[1]
+	if small.Contracts != 2 || large.Contracts != 1 {
+		t.Fatalf("Unexpected buckets %+v", r.Buckets)
+	}
+	// 16 bytes of 100, in one chunk of 4, half used
+	if small.BytesRatio.Mean != 0.16 || small.ChunksRatio.Mean != 0.25 || small.Efficiency.Mean != 0.5 {
+		t.Errorf("Unexpected small contracts %+v", small)
+	}
+	// 64 executed and 32 copied bytes of 2048, in 3 full chunks of 64
+	if large.BytesRatio.Mean != 96.0/2048 || large.ChunksRatio.Mean != 3.0/64 || large.Efficiency.Mean != 1 {
+		t.Errorf("Unexpected large contracts %+v", large)
+	}
+	if large.Efficiency.Histogram[HistogramBins-1] != 1 {
+		t.Errorf("Expected a full efficiency in the last bin, got %v", large.Efficiency.Histogram)
+	}
+
+	// Merged, the small contract accessed two chunks over the two blocks
+	r, err = Build([]string{path}, true)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if r.Overall.Contracts != 2 || r.Buckets[0].Contracts != 1 || r.Buckets[0].ChunksRatio.Mean != 0.5 || r.Buckets[0].BytesRatio.Mean != 0.32 {
+		t.Errorf("Unexpected merged report %+v", r.Buckets[0])
+	}
+
+	if _, err := Build(nil, false); err == nil {
+		t.Errorf("Expected no result file to fail")
+	}
+}
+
+func TestNewDistribution(t *testing.T) {
+	d := newDistribution([]float64{1, 0.05, 0.55, 0.25})
+	if d.Count != 4 || math.Abs(d.Mean-0.4625) > 1e-9 {
+		t.Errorf("Unexpected distribution %+v", d)
+	}
+	// Nearest rank: P10 and P25 are the first value, P50 the second, the others the last ones
+	if expected := []float64{0.05, 0.05, 0.25, 0.55, 1, 1}; !slices.Equal(d.Percentiles, expected) {
+		t.Errorf("Expected percentiles %v, got %v", expected, d.Percentiles)
+	}
+	if expected := []int{1, 0, 1, 0, 0, 1, 0, 0, 0, 1}; !slices.Equal(d.Histogram, expected) {
+		t.Errorf("Expected histogram %v, got %v", expected, d.Histogram)
+	}
+
+	if empty := newDistribution(nil); empty.Count != 0 || len(empty.Histogram) != HistogramBins {
+		t.Errorf("Unexpected empty distribution %+v", empty)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	r, err := Build([]string{writeResults(t, t.TempDir())}, false)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Write(&out, r, FormatJSON); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || decoded.Overall.Contracts != 3 {
+		t.Errorf("Unexpected JSON report %s (%v)", out.String(), err)
+	}
+
+	out.Reset()
+	if err := Write(&out, r, FormatMarkdown); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "### Chunk efficiency\n\n| Size | Count | Mean | P10 |") || !strings.Contains(out.String(), "| all | 3 | 33.3% | 33.3% |") {
+		t.Errorf("Unexpected markdown report:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := Write(&out, r, FormatTable); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Chunk size 32 bytes, 3 contract accesses") {
+		t.Errorf("Unexpected table report:\n%s", out.String())
+	}
+
+	if err := Write(&out, r, "csv"); err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+}
@@ -1,50 +1,237 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
 type TraceRetriever struct {
-	rpcClient *RpcClient
+	rpcClient *RpcPool
 	TraceDir  string
+	cache     *TraceCache // nil if traces aren't cached
 }
 
-func NewTraceRetriever(rpcClient *RpcClient, TraceDir string) *TraceRetriever {
+func NewTraceRetriever(rpcClient *RpcPool, TraceDir string, cache *TraceCache) *TraceRetriever {
 	return &TraceRetriever{
 		rpcClient: rpcClient,
 		TraceDir:  TraceDir,
+		cache:     cache,
 	}
 }
 
 func (r *TraceRetriever) GetTrace(blockNumber uint64) ([]TransactionTrace, error) {
+	stream, err := r.StreamTrace(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllTraces(stream)
+}
+
+// StreamTrace returns the trace of the block as a stream of transaction traces, read from the trace
+// directory if present. Traces fetched over RPC are written through to the cache as they are read.
+func (r *TraceRetriever) StreamTrace(blockNumber uint64) (TraceStream, error) {
 	traceFile := fmt.Sprintf("%s/block_%d_trace.json", r.TraceDir, blockNumber)
-	if _, err := os.Stat(traceFile); err == nil {
-		return r.getTraceFromFile(traceFile)
+	if file, err := os.Open(traceFile); err == nil {
+		return newJSONTraceStream(file), nil
+	}
+
+	binaryFile := fmt.Sprintf("%s/block_%d_trace%s", r.TraceDir, blockNumber, binaryTraceExt)
+	if file, err := os.Open(binaryFile); err == nil {
+		stream, err := newBinaryTraceStream(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	name := fmt.Sprintf("block_%d_trace", blockNumber)
+	if r.cache != nil {
+		reader, ok, err := r.cache.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return newJSONTraceStream(reader), nil
+		}
 	}
 
-	trace, err := r.rpcClient.TraceBlockByNumber(blockNumber)
+	stream, err := r.rpcClient.StreamTraceBlockByNumber(blockNumber)
 	if err != nil {
 		return nil, err
 	}
+	if r.cache == nil {
+		return stream, nil
+	}
 
-	return trace, nil
+	entry, err := r.cache.Create(name)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return newCachingTraceStream(stream, entry), nil
 }
 
-type JSONTrace struct {
-	Result []TransactionTrace `json:"result"`
+// GetCallFrames returns the callTracer trace of the block, from the cache if present
+func (r *TraceRetriever) GetCallFrames(blockNumber uint64) ([]CallFrameTrace, error) {
+	name := fmt.Sprintf("block_%d_calls", blockNumber)
+	var cached JSONCallFrames
+	if ok, err := r.getCached(name, &cached); err != nil || ok {
+		return cached.Result, err
+	}
+
+	frames, err := r.rpcClient.TraceBlockCallFrames(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.putCached(name, JSONCallFrames{Result: frames}); err != nil {
+		return nil, err
+	}
+
+	return frames, nil
 }
 
-func (r *TraceRetriever) getTraceFromFile(filepath string) ([]TransactionTrace, error) {
-	trace, err := os.ReadFile(filepath)
+// GetCodeAccess returns the codeAccessTracer trace of the block, from the cache if present
+func (r *TraceRetriever) GetCodeAccess(blockNumber uint64) ([]CodeAccessTrace, error) {
+	// Versioned, as the traces of the earlier tracer don't tell the accesses made before a contract's creation
+	name := fmt.Sprintf("block_%d_access_v2", blockNumber)
+	var cached JSONCodeAccess
+	if ok, err := r.getCached(name, &cached); err != nil || ok {
+		return cached.Result, err
+	}
+
+	traces, err := r.rpcClient.TraceBlockCodeAccess(blockNumber)
 	if err != nil {
 		return nil, err
 	}
-	var jsonTrace JSONTrace
-	err = json.Unmarshal(trace, &jsonTrace)
+
+	if err := r.putCached(name, JSONCodeAccess{Result: traces}); err != nil {
+		return nil, err
+	}
+
+	return traces, nil
+}
+
+// GetBlockTxs returns the transactions of the block keyed by hash, from the cache if present
+func (r *TraceRetriever) GetBlockTxs(blockNumber uint64) (map[common.Hash]BlockTx, error) {
+	name := fmt.Sprintf("block_%d_txs", blockNumber)
+	var cached JSONBlockTxs
+	if ok, err := r.getCached(name, &cached); err != nil || ok {
+		return cached.Result, err
+	}
+
+	txs, err := r.rpcClient.BlockByNumber(blockNumber)
 	if err != nil {
 		return nil, err
 	}
-	return jsonTrace.Result, nil
+
+	if err := r.putCached(name, JSONBlockTxs{Result: txs}); err != nil {
+		return nil, err
+	}
+
+	return txs, nil
+}
+
+// GetCodes returns the code read by an earlier analysis of the block, from the cache if present.
+// Otherwise the returned codes are empty, and are filled in as the analysis fetches them.
+func (r *TraceRetriever) GetCodes(blockNumber uint64) (*blockCodes, error) {
+	codes := &blockCodes{codes: make(map[CodeRequest]*Code)}
+	var cached JSONCodes
+	if ok, err := r.getCached(fmt.Sprintf("block_%d_codes", blockNumber), &cached); err != nil || !ok {
+		return codes, err
+	}
+	for _, code := range cached.Result {
+		codes.codes[CodeRequest{Address: code.Address, BlockNum: code.BlockNumber}] = newCode(code.Address, code.Code)
+	}
+	return codes, nil
+}
+
+// PutCodes caches the code read by the analysis of the block, unless it was all read from the cache
+func (r *TraceRetriever) PutCodes(blockNumber uint64, codes *blockCodes) error {
+	codes.mu.Lock()
+	defer codes.mu.Unlock()
+	if !codes.added {
+		return nil
+	}
+
+	cached := JSONCodes{Result: make([]CachedCode, 0, len(codes.codes))}
+	for req, code := range codes.codes {
+		cached.Result = append(cached.Result, CachedCode{Address: req.Address, BlockNumber: req.BlockNum, Code: code.code})
+	}
+	if err := r.putCached(fmt.Sprintf("block_%d_codes", blockNumber), cached); err != nil {
+		return err
+	}
+	codes.added = false
+	return nil
+}
+
+func (r *TraceRetriever) getCached(name string, v any) (bool, error) {
+	if r.cache == nil {
+		return false, nil
+	}
+	return r.cache.Get(name, v)
+}
+
+func (r *TraceRetriever) putCached(name string, v any) error {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache.Put(name, v)
+}
+
+type JSONTrace struct {
+	Result []TransactionTrace `json:"result"`
+}
+
+type JSONCallFrames struct {
+	Result []CallFrameTrace `json:"result"`
+}
+
+type JSONCodeAccess struct {
+	Result []CodeAccessTrace `json:"result"`
+}
+
+type JSONBlockTxs struct {
+	Result map[common.Hash]BlockTx `json:"result"`
+}
+
+type JSONCodes struct {
+	Result []CachedCode `json:"result"`
+}
+
+// CachedCode is the code of an address at the state after a block
+type CachedCode struct {
+	Address     common.Address `json:"address"`
+	BlockNumber uint64         `json:"blockNumber"`
+	Code        hexutil.Bytes  `json:"code"`
+}
+
+// blockCodes is the code read by the analysis of a block, keyed by address and block like the code cache.
+// It is cached next to the traces of the block, so that a re-run, e.g. with another chunk size, doesn't
+// need the node.
+type blockCodes struct {
+	mu    sync.Mutex
+	codes map[CodeRequest]*Code
+	added bool // Whether code was added since it was read from the cache
+}
+
+func (c *blockCodes) get(req CodeRequest) (*Code, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	code, ok := c.codes[req]
+	return code, ok
+}
+
+func (c *blockCodes) add(req CodeRequest, code *Code) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.codes[req]; !ok {
+		c.codes[req] = code
+		c.added = true
+	}
 }
@@ -1,17 +1,28 @@
 package internal
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"math"
 	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/weiihann/chunk-analysis/internal/logger"
+	"github.com/weiihann/chunk-analysis/internal/sampler"
 )
 
 type RetryConfig struct {
@@ -24,12 +35,23 @@ type RetryConfig struct {
 type RpcClient struct {
 	ctx         context.Context
 	client      *rpc.Client
+	url         string
+	httpClient  *http.Client
 	retryConfig RetryConfig
+	batchSize   int // Maximum number of calls per JSON-RPC batch
+	breaker     *circuitBreaker
+	limiter     *endpointLimiter
+	failFast    bool // Give up once the breaker opens, for the pool to fail over, instead of retrying
+	metrics     endpointMetrics
 	log         *slog.Logger
+
+	codeAccessErr atomic.Pointer[error] // Set once the node rejected the codeAccessTracer, which isn't tried again
 }
 
 func NewRpcClient(url string, ctx context.Context, config *Config) (*RpcClient, error) {
-	client, err := rpc.DialContext(ctx, url)
+	// The streamed traces are requested with the same HTTP client, so they share its transport
+	httpClient := &http.Client{}
+	client, err := rpc.DialOptions(ctx, url, rpc.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +66,13 @@ func NewRpcClient(url string, ctx context.Context, config *Config) (*RpcClient,
 	return &RpcClient{
 		ctx:         ctx,
 		client:      client,
+		url:         url,
+		httpClient:  httpClient,
 		retryConfig: retryConfig,
+		batchSize:   config.RPCBatchSize,
+		breaker:     newCircuitBreaker(config.CircuitBreakerThreshold, time.Duration(config.CircuitBreakerCooldown)*time.Millisecond),
+		limiter:     newEndpointLimiter(0, 0),
+		metrics:     newEndpointMetrics(url),
 		log:         logger.GetLogger("rpcclient"),
 	}, nil
 }
@@ -95,23 +123,313 @@ func (c *RpcClient) TraceBlockByNumber(blockNum uint64) ([]TransactionTrace, err
 	return result, nil
 }
 
-// Only get the to address, which is the contract address to be analyzed
-type TxByHash struct {
-	To string `json:"to"`
+// StreamTraceBlockByNumber is the same as TraceBlockByNumber, but decodes the response one transaction at a time,
+// instead of holding the whole block in memory. Only HTTP endpoints can be streamed, the others fall back to
+// TraceBlockByNumber.
+//
+// The response is spooled to a temporary file before it is decoded: the analysis of every transaction makes
+// other calls to the node, and reading the response that slowly would let the node time out writing it.
+// A response cut short is then a failed call, which is retried.
+func (c *RpcClient) StreamTraceBlockByNumber(blockNum uint64) (TraceStream, error) {
+	if !strings.HasPrefix(c.url, "http://") && !strings.HasPrefix(c.url, "https://") {
+		trace, err := c.TraceBlockByNumber(blockNum)
+		if err != nil {
+			return nil, err
+		}
+		return NewSliceTraceStream(trace), nil
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "debug_traceBlockByNumber",
+		"params": []any{hexutil.EncodeUint64(blockNum), TraceConfig{
+			DisableMemory:  true,
+			DisableStorage: true,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var spool *spoolFile
+	err = c.withRetry(func() error {
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return rpc.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+
+		spool, err = newSpoolFile(resp.Body, fmt.Sprintf("block_%d_trace", blockNum))
+		return err
+	}, fmt.Sprintf("StreamTraceBlockByNumber(%d)", blockNum))
+	if err != nil {
+		return nil, err
+	}
+
+	return newJSONTraceStream(spool), nil
+}
+
+// spoolFile is a temporary file holding a response, removed once closed
+type spoolFile struct {
+	*os.File
+}
+
+// newSpoolFile copies r to a new temporary file, and rewinds it to be read
+func newSpoolFile(r io.Reader, name string) (*spoolFile, error) {
+	file, err := os.CreateTemp("", name+"-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the spool file: %w", err)
+	}
+	spool := &spoolFile{File: file}
+
+	if _, err := io.Copy(file, r); err != nil {
+		spool.Close()
+		return nil, fmt.Errorf("failed to read the response: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, fmt.Errorf("failed to rewind the spool file: %w", err)
+	}
+	return spool, nil
+}
+
+func (f *spoolFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// CallTracerConfig represents the tracer configuration for the callTracer
+type CallTracerConfig struct {
+	Tracer string `json:"tracer"`
+}
+
+// CallFrameTrace represents the raw JSON structure of a transaction traced with the callTracer
+type CallFrameTrace struct {
+	TxHash string    `json:"txHash"`
+	Result CallFrame `json:"result"`
+}
+
+// CallFrame is a single call frame, only keeping the fields needed to identify initcode
+type CallFrame struct {
+	Type  string      `json:"type"`
+	To    string      `json:"to"`
+	Input string      `json:"input"`
+	Calls []CallFrame `json:"calls"`
+}
+
+// TraceBlockCallFrames traces the block with the callTracer, which unlike the struct logger
+// exposes the input of every frame, including the initcode of CREATE/CREATE2 frames
+func (c *RpcClient) TraceBlockCallFrames(blockNum uint64) ([]CallFrameTrace, error) {
+	bnHex := hexutil.EncodeUint64(blockNum)
+
+	var result []CallFrameTrace
+	err := c.withRetry(func() error {
+		return c.client.CallContext(c.ctx, &result, "debug_traceBlockByNumber", bnHex, CallTracerConfig{
+			Tracer: "callTracer",
+		})
+	}, fmt.Sprintf("TraceBlockCallFrames(%d)", blockNum))
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
-func (c *RpcClient) TransactionByHash(hash string) (TxByHash, error) {
-	var result TxByHash
+// TraceBlockCodeAccess traces the block with the codeAccessTracer. An error returned by the node, such as
+// JS tracers not being supported, isn't retried and is returned as an rpc.Error, for the caller to fall back
+// to the struct logs. Once the node rejected the tracer itself, rather than failed on the block, the error
+// is returned right away for every block, without asking the node again.
+func (c *RpcClient) TraceBlockCodeAccess(blockNum uint64) ([]CodeAccessTrace, error) {
+	if err := c.codeAccessErr.Load(); err != nil {
+		return nil, *err
+	}
+	bnHex := hexutil.EncodeUint64(blockNum)
+
+	var (
+		result []CodeAccessTrace
+		rpcErr rpc.Error
+	)
 	err := c.withRetry(func() error {
-		return c.client.CallContext(c.ctx, &result, "eth_getTransactionByHash", hash)
-	}, fmt.Sprintf("TransactionByHash(%s)", hash))
+		err := c.client.CallContext(c.ctx, &result, "debug_traceBlockByNumber", bnHex, CallTracerConfig{
+			Tracer: codeAccessTracer,
+		})
+		// The node answered, so the call counts as a success for the circuit breaker: the endpoint is
+		// healthy even if it rejects the tracer, and the pool fails over to another one on the error
+		if errors.As(err, &rpcErr) {
+			return nil
+		}
+		return err
+	}, fmt.Sprintf("TraceBlockCodeAccess(%d)", blockNum))
 	if err != nil {
-		return TxByHash{}, err
+		return nil, err
+	}
+	if rpcErr != nil {
+		if err := error(rpcErr); tracerUnsupported(err) && c.codeAccessErr.CompareAndSwap(nil, &err) {
+			c.log.Warn("code access tracer not supported by the endpoint, falling back to struct logs",
+				"endpoint", c.Endpoint(),
+				"error", err,
+			)
+		}
+		return nil, rpcErr
 	}
 
 	return result, nil
 }
 
+// tracerUnsupported reports whether the node rejected the tracer itself, rather than failed to trace the
+// block, e.g. on missing state or a timeout, which another block may not run into
+func tracerUnsupported(err error) bool {
+	classified := classifyError(err)
+	return !errors.Is(classified, ErrMissingState) &&
+		!errors.Is(classified, ErrBlockNotFound) &&
+		!errors.Is(classified, ErrRateLimited) &&
+		!strings.Contains(strings.ToLower(err.Error()), "timeout")
+}
+
+// ReplayBlock fetches what's needed to replay the block offline: the block with its transactions,
+// and the state it touches, traced with the prestateTracer. The block is traced with the callTracer too,
+// to leave the accounts created in the block out of its prestate.
+func (c *RpcClient) ReplayBlock(blockNum uint64) (*ReplayBlock, error) {
+	bnHex := hexutil.EncodeUint64(blockNum)
+
+	var raw json.RawMessage
+	err := c.withRetry(func() error {
+		return c.client.CallContext(c.ctx, &raw, "eth_getBlockByNumber", bnHex, true)
+	}, fmt.Sprintf("ReplayBlock(%d)", blockNum))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, fmt.Errorf("block %d not found", blockNum)
+	}
+
+	var block ReplayBlock
+	if err := json.Unmarshal(raw, &block.Header); err != nil {
+		return nil, fmt.Errorf("failed to decode header of block %d: %w", blockNum, err)
+	}
+	var body struct {
+		Transactions []*types.Transaction `json:"transactions"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("failed to decode transactions of block %d: %w", blockNum, err)
+	}
+	block.Transactions = body.Transactions
+
+	var prestates []PrestateTrace
+	err = c.withRetry(func() error {
+		return c.client.CallContext(c.ctx, &prestates, "debug_traceBlockByNumber", bnHex, CallTracerConfig{
+			Tracer: "prestateTracer",
+		})
+	}, fmt.Sprintf("ReplayBlock(%d)", blockNum))
+	if err != nil {
+		return nil, err
+	}
+	frames, err := c.TraceBlockCallFrames(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) != len(prestates) {
+		return nil, fmt.Errorf("block %d has %d prestate traces but %d call traces", blockNum, len(prestates), len(frames))
+	}
+	block.Prestate = MergePrestates(prestates, frames)
+
+	return &block, nil
+}
+
+// BlockTx is a transaction of a block, only keeping the fields the analyzer reads
+type BlockTx struct {
+	Hash              common.Hash                  `json:"hash"`
+	From              common.Address               `json:"from"`
+	Nonce             hexutil.Uint64               `json:"nonce"`
+	To                string                       `json:"to"`
+	Input             string                       `json:"input"`
+	Type              hexutil.Uint64               `json:"type"`
+	Index             hexutil.Uint64               `json:"transactionIndex"`
+	AuthorizationList []types.SetCodeAuthorization `json:"authorizationList"`
+}
+
+// BlockByNumber returns the transactions of the block keyed by hash, in a single call
+func (c *RpcClient) BlockByNumber(blockNum uint64) (map[common.Hash]BlockTx, error) {
+	var result *struct {
+		Transactions []BlockTx `json:"transactions"`
+	}
+	err := c.withRetry(func() error {
+		return c.client.CallContext(c.ctx, &result, "eth_getBlockByNumber", hexutil.EncodeUint64(blockNum), true)
+	}, fmt.Sprintf("BlockByNumber(%d)", blockNum))
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, fmt.Errorf("block %d not found", blockNum)
+	}
+
+	txs := make(map[common.Hash]BlockTx, len(result.Transactions))
+	for _, tx := range result.Transactions {
+		txs[tx.Hash] = tx
+	}
+	return txs, nil
+}
+
+// CodeRequest is the code of an address at the state after a block
+type CodeRequest struct {
+	Address  common.Address
+	BlockNum uint64
+}
+
+// Codes fetches the code of every request in batches, the results are in the order of the requests
+func (c *RpcClient) Codes(reqs []CodeRequest) ([]string, error) {
+	results := make([]string, len(reqs))
+	elems := make([]rpc.BatchElem, len(reqs))
+	for i, req := range reqs {
+		elems[i] = rpc.BatchElem{
+			Method: "eth_getCode",
+			Args:   []any{req.Address, hexutil.EncodeUint64(req.BlockNum)},
+			Result: &results[i],
+		}
+	}
+	if err := c.batchCall(elems, fmt.Sprintf("Codes(%d)", len(reqs))); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// BlockHeader only keeps the fields used to stratify the sample, with the transactions as hashes
+type BlockHeader struct {
+	GasUsed      hexutil.Uint64 `json:"gasUsed"`
+	Transactions []common.Hash  `json:"transactions"`
+}
+
+// BlockStats returns the gas used and transaction count of the block
+func (c *RpcClient) BlockStats(blockNum uint64) (sampler.Stats, error) {
+	var result *BlockHeader
+	err := c.withRetry(func() error {
+		return c.client.CallContext(c.ctx, &result, "eth_getBlockByNumber", hexutil.EncodeUint64(blockNum), false)
+	}, fmt.Sprintf("BlockStats(%d)", blockNum))
+	if err != nil {
+		return sampler.Stats{}, err
+	}
+	if result == nil {
+		return sampler.Stats{}, fmt.Errorf("block %d not found", blockNum)
+	}
+
+	return sampler.Stats{
+		GasUsed: uint64(result.GasUsed),
+		TxCount: uint64(len(result.Transactions)),
+	}, nil
+}
+
 func (c *RpcClient) Code(address common.Address, blockNum uint64) (string, error) {
 	var result string
 	err := c.withRetry(func() error {
@@ -124,17 +442,61 @@ func (c *RpcClient) Code(address common.Address, blockNum uint64) (string, error
 	return result, nil
 }
 
+// clientVersionTimeout bounds the web3_clientVersion call, made before any work starts
+const clientVersionTimeout = 5 * time.Second
+
+// ClientVersion returns the web3_clientVersion of the node. It is only informational, so it is tried once
+// with a short timeout, outside of the retries and the circuit breaker, for a dead endpoint not to hold up the run.
+func (c *RpcClient) ClientVersion() (string, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, clientVersionTimeout)
+	defer cancel()
+
+	var result string
+	if err := c.client.CallContext(ctx, &result, "web3_clientVersion"); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// Endpoint is the host of the endpoint, which unlike the URL is safe to log
+func (c *RpcClient) Endpoint() string {
+	return endpointName(c.url)
+}
+
 func (c *RpcClient) Close() {
 	c.client.Close()
 }
 
-// withRetry executes the given function with exponential backoff and jitter
+// withRetry executes the given function with exponential backoff and jitter. Permanent errors are returned
+// right away, and retryable ones count towards opening the endpoint's circuit breaker, which holds back
+// every call to the endpoint for a cooldown. Every attempt waits for the endpoint's rate and concurrency limits.
 func (c *RpcClient) withRetry(fn func() error, operation string) error {
-	var lastErr error
+	var lastErr *RPCError
 
 	for attempt := 1; attempt <= c.retryConfig.MaxAttempts; attempt++ {
+		if wait := c.breaker.wait(); wait > 0 {
+			c.log.Warn("Circuit breaker open, waiting",
+				"operation", operation,
+				"wait", wait,
+			)
+			if err := c.sleep(wait); err != nil {
+				return err
+			}
+		}
+
+		if err := c.limiter.acquire(c.ctx); err != nil {
+			return fmt.Errorf("context cancelled during retry: %w", err)
+		}
+		c.metrics.add("calls", 1)
+		if attempt > 1 {
+			c.metrics.add("retries", 1)
+		}
+		start := time.Now()
 		err := fn()
+		c.metrics.add("latency_us", time.Since(start).Microseconds())
+		c.limiter.release()
 		if err == nil {
+			c.breaker.success()
 			if attempt > 1 {
 				c.log.Info("RPC call succeeded after retry",
 					"operation", operation,
@@ -144,12 +506,36 @@ func (c *RpcClient) withRetry(fn func() error, operation string) error {
 			return nil
 		}
 
-		lastErr = err
+		lastErr = classifyError(err)
+		c.metrics.add("errors_"+string(lastErr.Class), 1)
+
+		if lastErr.Class == ErrorPermanent {
+			c.log.Error("RPC call failed with a permanent error",
+				"operation", operation,
+				"attempt", attempt,
+				"class", lastErr.Class,
+				"error", err,
+			)
+			return lastErr
+		}
+
+		if c.breaker.failure() {
+			c.metrics.add("circuit_opened", 1)
+			c.log.Warn("Circuit breaker opened",
+				"operation", operation,
+				"cooldown", c.breaker.cooldown,
+			)
+			if c.failFast {
+				c.metrics.add("failures", 1)
+				return fmt.Errorf("RPC call failed after %d attempts: %w: %w", attempt, ErrCircuitOpen, lastErr)
+			}
+		}
 
 		if attempt == c.retryConfig.MaxAttempts {
 			c.log.Error("RPC call failed after all retries",
 				"operation", operation,
 				"attempts", attempt,
+				"class", lastErr.Class,
 				"error", err,
 			)
 			break
@@ -161,20 +547,86 @@ func (c *RpcClient) withRetry(fn func() error, operation string) error {
 			"attempt", attempt,
 			"maxAttempts", c.retryConfig.MaxAttempts,
 			"delay", delay,
+			"class", lastErr.Class,
 			"error", err,
 		)
 
-		select {
-		case <-c.ctx.Done():
-			return fmt.Errorf("context cancelled during retry: %w", c.ctx.Err())
-		case <-time.After(delay):
-			// Continue to next attempt
+		if err := c.sleep(delay); err != nil {
+			return err
 		}
 	}
 
+	c.metrics.add("failures", 1)
 	return fmt.Errorf("RPC call failed after %d attempts: %w", c.retryConfig.MaxAttempts, lastErr)
 }
 
+// sleep waits for the delay, or returns an error once the context is cancelled
+func (c *RpcClient) sleep(delay time.Duration) error {
+	select {
+	case <-c.ctx.Done():
+		return fmt.Errorf("context cancelled during retry: %w", c.ctx.Err())
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// batchCall sends the calls in batches of at most batchSize. A failed batch is retried as a whole, while
+// the calls that failed within a successful batch are retried on their own, with the same backoff.
+func (c *RpcClient) batchCall(elems []rpc.BatchElem, operation string) error {
+	for start := 0; start < len(elems); start += c.batchSize {
+		// The copies share the result pointers, only the errors have to be carried over
+		pending := slices.Clone(elems[start:min(start+c.batchSize, len(elems))])
+
+		for attempt := 1; ; attempt++ {
+			err := c.withRetry(func() error {
+				return c.client.BatchCallContext(c.ctx, pending)
+			}, operation)
+			if err != nil {
+				return err
+			}
+
+			var failed []rpc.BatchElem
+			for _, elem := range pending {
+				if elem.Error == nil {
+					continue
+				}
+				classified := classifyError(elem.Error)
+				c.metrics.add("errors_"+string(classified.Class), 1)
+				if classified.Class == ErrorPermanent {
+					return fmt.Errorf("%s: %w", operation, classified)
+				}
+				failed = append(failed, elem)
+			}
+			if len(failed) == 0 {
+				break
+			}
+			if attempt >= c.retryConfig.MaxAttempts {
+				c.metrics.add("failures", int64(len(failed)))
+				return fmt.Errorf("%s: %d calls failed after %d attempts: %w", operation, len(failed), attempt, classifyError(failed[0].Error))
+			}
+
+			delay := c.calculateDelay(attempt)
+			c.log.Warn("RPC batch calls failed, retrying",
+				"operation", operation,
+				"failed", len(failed),
+				"attempt", attempt,
+				"delay", delay,
+				"class", ErrorRetryable,
+				"error", failed[0].Error,
+			)
+			if err := c.sleep(delay); err != nil {
+				return err
+			}
+
+			for i := range failed {
+				failed[i].Error = nil
+			}
+			pending = failed
+		}
+	}
+	return nil
+}
+
 // calculateDelay calculates the delay for the given attempt with exponential backoff and optional jitter
 func (c *RpcClient) calculateDelay(attempt int) time.Duration {
 	// Exponential backoff: baseDelay * 2^(attempt-1)
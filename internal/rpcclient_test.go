@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// newTestRpcClient returns a client of a JSON-RPC server answering every call, batched or not, with the handler.
+// An *rpcError returned by the handler keeps its code, other errors are reported as generic server errors.
+func newTestRpcClient(t *testing.T, handler func(method string, params []json.RawMessage) (any, error)) *RpcClient {
+	t.Helper()
+
+	type request struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	respond := func(req request) map[string]any {
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		if result, err := handler(req.Method, req.Params); err != nil {
+			code := -32000
+			if coded, ok := err.(*rpcError); ok {
+				code = coded.Code
+			}
+			resp["error"] = map[string]any{"code": code, "message": err.Error()}
+		} else {
+			resp["result"] = result
+		}
+		return resp
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid request: %v", err)
+			return
+		}
+		if bytes.HasPrefix(body, []byte("[")) {
+			var reqs []request
+			json.Unmarshal(body, &reqs)
+			resps := make([]map[string]any, len(reqs))
+			for i, req := range reqs {
+				resps[i] = respond(req)
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+		var req request
+		json.Unmarshal(body, &req)
+		json.NewEncoder(w).Encode(respond(req))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewRpcClient(server.URL, context.Background(), &Config{RetryMaxAttempts: 1, RPCBatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewRpcClient() failed: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestRpcClient_BlockByNumber(t *testing.T) {
+	client := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		if method != "eth_getBlockByNumber" || string(params[0]) != `"0x7"` || string(params[1]) != "true" {
+			t.Errorf("Unexpected call %s%s", method, params)
+		}
+		return map[string]any{"transactions": []map[string]any{
+			{"hash": common.HexToHash("0x01"), "to": "0xaa", "input": "0x", "type": "0x2", "transactionIndex": "0x0"},
+			{"hash": common.HexToHash("0x02"), "to": nil, "input": "0x6000", "type": "0x0", "transactionIndex": "0x1"},
+		}}, nil
+	})
+
+	txs, err := client.BlockByNumber(7)
+	if err != nil {
+		t.Fatalf("BlockByNumber() failed: %v", err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(txs))
+	}
+	if tx := txs[common.HexToHash("0x01")]; tx.To != "0xaa" || tx.Type != 2 || tx.Index != 0 {
+		t.Errorf("Unexpected transaction %+v", tx)
+	}
+	if tx := txs[common.HexToHash("0x02")]; tx.To != "" || tx.Input != "0x6000" || tx.Index != 1 {
+		t.Errorf("Unexpected transaction %+v", tx)
+	}
+}
+
+func TestRpcClient_Codes(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches []int
+		failed  bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params []string        `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			t.Errorf("Expected a batch request: %v", err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, len(reqs))
+
+		resps := make([]map[string]any, len(reqs))
+		for i, req := range reqs {
+			resps[i] = map[string]any{"jsonrpc": "2.0", "id": req.ID}
+			// The code of 0xbb fails once, and is retried on its own
+			if common.HexToAddress(req.Params[0]) == common.HexToAddress("0xbb") && !failed {
+				failed = true
+				resps[i]["error"] = map[string]any{"code": -32000, "message": "try again"}
+				continue
+			}
+			resps[i]["result"] = "0x60" + req.Params[0][len(req.Params[0])-2:]
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	client, err := NewRpcClient(server.URL, context.Background(), &Config{RetryMaxAttempts: 3, RPCBatchSize: 2})
+	if err != nil {
+		t.Fatalf("NewRpcClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	codes, err := client.Codes([]CodeRequest{
+		{Address: common.HexToAddress("0xaa"), BlockNum: 1},
+		{Address: common.HexToAddress("0xbb"), BlockNum: 1},
+		{Address: common.HexToAddress("0xcc"), BlockNum: 1},
+	})
+	if err != nil {
+		t.Fatalf("Codes() failed: %v", err)
+	}
+
+	expected := []string{"0x60aa", "0x60bb", "0x60cc"}
+	for i := range expected {
+		if codes[i] != expected[i] {
+			t.Errorf("code %d: got %s, want %s", i, codes[i], expected[i])
+		}
+	}
+
+	// Two batches of at most 2 calls, the failed call retried in between
+	if len(batches) != 3 || batches[0] != 2 || batches[1] != 1 || batches[2] != 1 {
+		t.Errorf("Unexpected batches %v", batches)
+	}
+}
+
+func TestRpcClient_TraceBlockCodeAccess_Unsupported(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		err      string
+		expected int // Number of calls over the two blocks
+	}{
+		{"tracer rejected once", "ReferenceError: toAddress is not defined", 1},
+		{"block failure asked again", "missing trie node abc", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			client := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+				calls.Add(1)
+				return nil, errors.New(tt.err)
+			})
+			for _, block := range []uint64{1, 2} {
+				var rpcErr rpc.Error
+				if _, err := client.TraceBlockCodeAccess(block); !errors.As(err, &rpcErr) {
+					t.Errorf("Expected an rpc.Error for block %d, got %v", block, err)
+				}
+			}
+			if got := int(calls.Load()); got != tt.expected {
+				t.Errorf("Expected %d calls, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+// A response cut short by the node is retried, rather than failing while the traces are decoded
+func TestRpcClient_StreamTraceBlockByNumber_Truncated(t *testing.T) {
+	response, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": 1, "result": []TransactionTrace{
+		{TxHash: "0x01", Result: InnerResult{Steps: []TraceStep{{PC: 0, Op: "PUSH1", Depth: 1}}}},
+		{TxHash: "0x02", Result: InnerResult{Steps: []TraceStep{{PC: 0, Op: "STOP", Depth: 1}}}},
+	}})
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+		if requests.Add(1) > 1 {
+			w.Write(response)
+			return
+		}
+		// Close the connection halfway through the first response
+		w.Write(response[:len(response)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack() failed: %v", err)
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	client, err := NewRpcClient(server.URL, context.Background(), &Config{RetryMaxAttempts: 2, RPCBatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewRpcClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	stream, err := client.StreamTraceBlockByNumber(7)
+	if err != nil {
+		t.Fatalf("StreamTraceBlockByNumber() failed: %v", err)
+	}
+	spool := stream.(*jsonTraceStream).closer.(*spoolFile).Name()
+	traces, err := ReadAllTraces(stream)
+	if err != nil {
+		t.Fatalf("ReadAllTraces() failed: %v", err)
+	}
+	if len(traces) != 2 || traces[1].TxHash != "0x02" {
+		t.Errorf("Unexpected traces %+v", traces)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests.Load())
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("Expected the spool file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrorClass tells whether a failed RPC call is worth retrying
+type ErrorClass string
+
+const (
+	ErrorRetryable ErrorClass = "retryable" // Transport errors, timeouts, rate limits and unknown server errors
+	ErrorPermanent ErrorClass = "permanent" // The same call fails the same way on the same endpoint
+)
+
+// Typed RPC errors, matched with errors.Is
+var (
+	ErrMethodNotFound = errors.New("method not found")
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrMissingState   = errors.New("missing state")
+	ErrBlockNotFound  = errors.New("block not found")
+	ErrRateLimited    = errors.New("rate limited")
+	ErrCircuitOpen    = errors.New("circuit breaker open")
+)
+
+// RPCError is a classified RPC error. It unwraps to both its kind, if known, and the original error,
+// so that errors.As still finds an rpc.Error.
+type RPCError struct {
+	Class ErrorClass
+	Kind  error // One of the typed errors, nil if unknown
+	Err   error
+}
+
+func (e *RPCError) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("%s: %v", e.Class, e.Err)
+	}
+	return fmt.Sprintf("%s %v: %v", e.Class, e.Kind, e.Err)
+}
+
+func (e *RPCError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Standard JSON-RPC and common node error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeLimitExceeded  = -32005
+)
+
+// classifyError maps an error returned by an RPC call to its class and kind
+func classifyError(err error) *RPCError {
+	var classified *RPCError
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	permanent := func(kind error) *RPCError { return &RPCError{Class: ErrorPermanent, Kind: kind, Err: err} }
+	retryable := func(kind error) *RPCError { return &RPCError{Class: ErrorRetryable, Kind: kind, Err: err} }
+
+	if errors.Is(err, context.Canceled) {
+		return permanent(nil)
+	}
+
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return retryable(ErrRateLimited)
+		case httpErr.StatusCode == http.StatusNotFound || httpErr.StatusCode == http.StatusMethodNotAllowed:
+			return permanent(ErrMethodNotFound)
+		case httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 && httpErr.StatusCode != http.StatusRequestTimeout:
+			return permanent(ErrInvalidRequest)
+		default:
+			return retryable(nil)
+		}
+	}
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.ErrorCode() {
+		case codeMethodNotFound:
+			return permanent(ErrMethodNotFound)
+		case codeParseError, codeInvalidRequest, codeInvalidParams:
+			return permanent(ErrInvalidRequest)
+		case codeLimitExceeded:
+			return retryable(ErrRateLimited)
+		}
+
+		// Most node errors share the generic server error code, only the message tells them apart
+		msg := strings.ToLower(rpcErr.Error())
+		switch {
+		case strings.Contains(msg, "missing trie node"),
+			strings.Contains(msg, "historical state"),
+			strings.Contains(msg, "state is not available"),
+			strings.Contains(msg, "pruned"):
+			return permanent(ErrMissingState)
+		case strings.Contains(msg, "block not found"),
+			strings.Contains(msg, "header not found"),
+			strings.Contains(msg, "invalid block"):
+			return permanent(ErrBlockNotFound)
+		case strings.Contains(msg, "rate limit"), strings.Contains(msg, "too many requests"):
+			return retryable(ErrRateLimited)
+		case strings.Contains(msg, "method not found"), strings.Contains(msg, "does not exist/is not available"):
+			return permanent(ErrMethodNotFound)
+		}
+		return retryable(nil)
+	}
+
+	// The response doesn't match the expected type, which won't change on retry
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return permanent(ErrInvalidRequest)
+	}
+
+	return retryable(nil)
+}
+
+// circuitBreaker stops calls to an endpoint for a cooldown once too many of them failed in a row.
+// After the cooldown a single failure opens it again, until a call succeeds.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int // Consecutive retryable failures
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// wait returns how long calls have to wait for the breaker to close, 0 if it is closed
+func (b *circuitBreaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(time.Until(b.openUntil), 0)
+}
+
+// Open reports whether the breaker currently stops calls
+func (b *circuitBreaker) Open() bool {
+	return b.wait() > 0
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// failure records a failed call, and returns true if it opened the breaker
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	b.failures = b.threshold - 1 // Half open once the cooldown is over
+	return true
+}
+
+// rpcMetrics counts the RPC calls per endpoint, published with expvar under "rpc"
+var rpcMetrics = expvar.NewMap("rpc")
+
+// endpointMetrics are the counters of one endpoint, keyed by its host so that API keys in the URL aren't published
+type endpointMetrics struct {
+	prefix string
+}
+
+func newEndpointMetrics(rawURL string) endpointMetrics {
+	return endpointMetrics{prefix: endpointName(rawURL) + "."}
+}
+
+func (m endpointMetrics) add(counter string, delta int64) {
+	rpcMetrics.Add(m.prefix+counter, delta)
+}
+
+func (m endpointMetrics) get(counter string) int64 {
+	if v, ok := rpcMetrics.Get(m.prefix + counter).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// endpointName is the host of the endpoint URL, or the URL itself if it has none, e.g. an IPC path
+func endpointName(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawURL
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class ErrorClass
+		kind  error
+	}{
+		{name: "method not found", err: &rpcError{Code: -32601, Message: "the method debug_traceBlockByNumber does not exist/is not available"}, class: ErrorPermanent, kind: ErrMethodNotFound},
+		{name: "invalid params", err: &rpcError{Code: -32602, Message: "invalid argument 0"}, class: ErrorPermanent, kind: ErrInvalidRequest},
+		{name: "missing trie node", err: &rpcError{Code: -32000, Message: "missing trie node 1234 (path )"}, class: ErrorPermanent, kind: ErrMissingState},
+		{name: "historical state", err: &rpcError{Code: -32000, Message: "required historical state unavailable (reexec=128)"}, class: ErrorPermanent, kind: ErrMissingState},
+		{name: "block not found", err: &rpcError{Code: -32000, Message: "block #99999999 not found"}, class: ErrorRetryable},
+		{name: "header not found", err: &rpcError{Code: -32000, Message: "header not found"}, class: ErrorPermanent, kind: ErrBlockNotFound},
+		{name: "limit exceeded", err: &rpcError{Code: -32005, Message: "limit exceeded"}, class: ErrorRetryable, kind: ErrRateLimited},
+		{name: "execution timeout", err: &rpcError{Code: -32000, Message: "execution timeout"}, class: ErrorRetryable},
+		{name: "http 429", err: rpc.HTTPError{StatusCode: 429, Status: "429 Too Many Requests"}, class: ErrorRetryable, kind: ErrRateLimited},
+		{name: "http 502", err: rpc.HTTPError{StatusCode: 502, Status: "502 Bad Gateway"}, class: ErrorRetryable},
+		{name: "http 401", err: rpc.HTTPError{StatusCode: 401, Status: "401 Unauthorized"}, class: ErrorPermanent, kind: ErrInvalidRequest},
+		{name: "wrapped", err: fmt.Errorf("call failed: %w", &rpcError{Code: -32601, Message: "method not found"}), class: ErrorPermanent, kind: ErrMethodNotFound},
+		{name: "type mismatch", err: json.Unmarshal([]byte(`"0x1"`), new(int)), class: ErrorPermanent, kind: ErrInvalidRequest},
+		{name: "cancelled", err: context.Canceled, class: ErrorPermanent},
+		{name: "transport", err: io.ErrUnexpectedEOF, class: ErrorRetryable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classified := classifyError(tt.err)
+			if classified.Class != tt.class || classified.Kind != tt.kind {
+				t.Errorf("Expected %s %v, got %s %v", tt.class, tt.kind, classified.Class, classified.Kind)
+			}
+			if classified.Err.Error() != tt.err.Error() {
+				t.Errorf("Expected the classified error to wrap %v, got %v", tt.err, classified.Err)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(3, time.Hour)
+
+	breaker.failure()
+	breaker.failure()
+	breaker.success()
+	breaker.failure()
+	breaker.failure()
+	if breaker.Open() {
+		t.Fatal("Expected the breaker to stay closed, the failures weren't consecutive")
+	}
+
+	if !breaker.failure() || !breaker.Open() {
+		t.Fatal("Expected the third consecutive failure to open the breaker")
+	}
+
+	// Half open once the cooldown is over: a single failure opens it again
+	breaker.openUntil = time.Time{}
+	if !breaker.failure() {
+		t.Error("Expected a failure after the cooldown to open the breaker again")
+	}
+}
+
+func TestRpcClient_PermanentErrorNotRetried(t *testing.T) {
+	calls := 0
+	client := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		calls++
+		return nil, &rpcError{Code: -32601, Message: "the method eth_getCode does not exist/is not available"}
+	})
+	client.retryConfig.MaxAttempts = 5
+
+	_, err := client.BlockByNumber(1)
+	if !errors.Is(err, ErrMethodNotFound) {
+		t.Errorf("Expected ErrMethodNotFound, got %v", err)
+	}
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) || rpcErr.ErrorCode() != -32601 {
+		t.Errorf("Expected the rpc.Error to be kept, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single call, got %d", calls)
+	}
+}
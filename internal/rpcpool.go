@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal/logger"
+	"github.com/weiihann/chunk-analysis/internal/sampler"
+)
+
+// RpcPool routes every call to one of the RPC endpoints, preferring the least busy of those whose circuit
+// breaker is closed, and fails over to the next endpoint when a call fails on one
+type RpcPool struct {
+	clients []*RpcClient
+	next    atomic.Uint64 // Rotates the endpoints that are equally busy
+	log     *slog.Logger
+}
+
+// NewRpcPool dials every endpoint, with the rate and concurrency limits configured for it.
+// Endpoints that fail to dial are left out, it only fails if none is left.
+func NewRpcPool(urls []string, ctx context.Context, config *Config) (*RpcPool, error) {
+	log := logger.GetLogger("rpcpool")
+
+	var clients []*RpcClient
+	for i, url := range urls {
+		client, err := NewRpcClient(url, ctx, config)
+		if err != nil {
+			log.Error("failed to create rpc client", "endpoint", endpointName(url), "error", err)
+			continue
+		}
+		client.limiter = newEndpointLimiter(endpointLimit(config.RPCRateLimit, i), endpointLimit(config.RPCMaxConcurrency, i))
+		clients = append(clients, client)
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("no rpc endpoint available")
+	}
+	return newRpcPool(clients), nil
+}
+
+func newRpcPool(clients []*RpcClient) *RpcPool {
+	for _, client := range clients {
+		// With a single endpoint there is nothing to fail over to, it waits out its breaker instead
+		client.failFast = len(clients) > 1
+	}
+	return &RpcPool{
+		clients: clients,
+		log:     logger.GetLogger("rpcpool"),
+	}
+}
+
+// endpointLimit is the limit of the i-th endpoint: the limits are either given per endpoint, or a single
+// one applies to all of them. 0 means unlimited.
+func endpointLimit(limits []int, i int) int {
+	switch {
+	case len(limits) == 1:
+		return limits[0]
+	case i < len(limits):
+		return limits[i]
+	default:
+		return 0
+	}
+}
+
+// order returns the endpoints a call tries in turn: the healthy ones, least busy first.
+// If every breaker is open, only the endpoint that closes first is tried, once its cooldown is over.
+func (p *RpcPool) order() []*RpcClient {
+	start := int(p.next.Add(1))
+	var healthy []*RpcClient
+	for i := range p.clients {
+		client := p.clients[(start+i)%len(p.clients)]
+		if !client.breaker.Open() {
+			healthy = append(healthy, client)
+		}
+	}
+	if len(healthy) == 0 {
+		return []*RpcClient{slices.MinFunc(p.clients, func(a, b *RpcClient) int {
+			return cmp.Compare(a.breaker.wait(), b.breaker.wait())
+		})}
+	}
+	slices.SortStableFunc(healthy, func(a, b *RpcClient) int {
+		return cmp.Compare(a.limiter.inflight.Load(), b.limiter.inflight.Load())
+	})
+	return healthy
+}
+
+// do runs the call on the endpoints in turn until it succeeds, or fails in a way another endpoint won't fix
+func (p *RpcPool) do(operation string, fn func(client *RpcClient) error) error {
+	return p.doOn(p.order(), operation, fn)
+}
+
+// doOn is the same as do, on the given endpoints
+func (p *RpcPool) doOn(clients []*RpcClient, operation string, fn func(client *RpcClient) error) error {
+	var err error
+	for i, client := range clients {
+		err = fn(client)
+		if err == nil || !canFailover(err) {
+			return err
+		}
+		if i < len(clients)-1 {
+			p.log.Warn("RPC call failed, failing over",
+				"operation", operation,
+				"endpoint", client.Endpoint(),
+				"next", clients[i+1].Endpoint(),
+				"error", err,
+			)
+		}
+	}
+	return err
+}
+
+// canFailover reports whether a call that failed on one endpoint may succeed on another. Endpoints differ
+// in the state, methods and tracers they serve, but an invalid request is invalid everywhere.
+func canFailover(err error) bool {
+	return !errors.Is(err, ErrInvalidRequest) && !errors.Is(err, context.Canceled)
+}
+
+func (p *RpcPool) StreamTraceBlockByNumber(blockNum uint64) (TraceStream, error) {
+	var stream TraceStream
+	err := p.do(fmt.Sprintf("StreamTraceBlockByNumber(%d)", blockNum), func(client *RpcClient) (err error) {
+		stream, err = client.StreamTraceBlockByNumber(blockNum)
+		return err
+	})
+	return stream, err
+}
+
+func (p *RpcPool) TraceBlockCallFrames(blockNum uint64) ([]CallFrameTrace, error) {
+	var frames []CallFrameTrace
+	err := p.do(fmt.Sprintf("TraceBlockCallFrames(%d)", blockNum), func(client *RpcClient) (err error) {
+		frames, err = client.TraceBlockCallFrames(blockNum)
+		return err
+	})
+	return frames, err
+}
+
+// TraceBlockCodeAccess fails over on the errors returned by the node too, as another node may support the
+// tracer. The error of the last endpoint is returned as is, for the caller to fall back to the struct logs.
+// The endpoints known to reject the tracer are left out, unless all of them do.
+func (p *RpcPool) TraceBlockCodeAccess(blockNum uint64) ([]CodeAccessTrace, error) {
+	clients := p.order()
+	supported := slices.DeleteFunc(slices.Clone(clients), func(client *RpcClient) bool {
+		return client.codeAccessErr.Load() != nil
+	})
+	if len(supported) == 0 {
+		return nil, *clients[0].codeAccessErr.Load()
+	}
+
+	var traces []CodeAccessTrace
+	err := p.doOn(supported, fmt.Sprintf("TraceBlockCodeAccess(%d)", blockNum), func(client *RpcClient) (err error) {
+		traces, err = client.TraceBlockCodeAccess(blockNum)
+		return err
+	})
+	return traces, err
+}
+
+func (p *RpcPool) ReplayBlock(blockNum uint64) (*ReplayBlock, error) {
+	var block *ReplayBlock
+	err := p.do(fmt.Sprintf("ReplayBlock(%d)", blockNum), func(client *RpcClient) (err error) {
+		block, err = client.ReplayBlock(blockNum)
+		return err
+	})
+	return block, err
+}
+
+func (p *RpcPool) BlockByNumber(blockNum uint64) (map[common.Hash]BlockTx, error) {
+	var txs map[common.Hash]BlockTx
+	err := p.do(fmt.Sprintf("BlockByNumber(%d)", blockNum), func(client *RpcClient) (err error) {
+		txs, err = client.BlockByNumber(blockNum)
+		return err
+	})
+	return txs, err
+}
+
+func (p *RpcPool) Codes(reqs []CodeRequest) ([]string, error) {
+	var codes []string
+	err := p.do(fmt.Sprintf("Codes(%d)", len(reqs)), func(client *RpcClient) (err error) {
+		codes, err = client.Codes(reqs)
+		return err
+	})
+	return codes, err
+}
+
+func (p *RpcPool) Code(address common.Address, blockNum uint64) (string, error) {
+	var code string
+	err := p.do(fmt.Sprintf("Code(%s, %d)", address.Hex(), blockNum), func(client *RpcClient) (err error) {
+		code, err = client.Code(address, blockNum)
+		return err
+	})
+	return code, err
+}
+
+func (p *RpcPool) BlockStats(blockNum uint64) (sampler.Stats, error) {
+	var stats sampler.Stats
+	err := p.do(fmt.Sprintf("BlockStats(%d)", blockNum), func(client *RpcClient) (err error) {
+		stats, err = client.BlockStats(blockNum)
+		return err
+	})
+	return stats, err
+}
+
+// NodeVersions returns the client version of every endpoint, left empty for those that fail to answer
+func (p *RpcPool) NodeVersions() []NodeVersion {
+	nodes := make([]NodeVersion, len(p.clients))
+	for i, client := range p.clients {
+		nodes[i].Endpoint = client.Endpoint()
+		version, err := client.ClientVersion()
+		if err != nil {
+			p.log.Warn("failed to get client version", "endpoint", client.Endpoint(), "error", err)
+			continue
+		}
+		nodes[i].ClientVersion = version
+	}
+	return nodes
+}
+
+func (p *RpcPool) Close() {
+	for _, client := range p.clients {
+		client.Close()
+	}
+}
+
+// EndpointStats are the counters of an endpoint since the start of the process
+type EndpointStats struct {
+	Endpoint    string
+	Calls       int64 // Attempts, retries included
+	Retries     int64
+	Errors      int64 // Failed attempts
+	Failures    int64 // Calls that failed after all their attempts
+	AvgLatency  time.Duration
+	CircuitOpen bool
+}
+
+// Stats returns the counters of every endpoint of the pool
+func (p *RpcPool) Stats() []EndpointStats {
+	stats := make([]EndpointStats, len(p.clients))
+	for i, client := range p.clients {
+		m := client.metrics
+		stats[i] = EndpointStats{
+			Endpoint:    client.Endpoint(),
+			Calls:       m.get("calls"),
+			Retries:     m.get("retries"),
+			Errors:      m.get("errors_"+string(ErrorRetryable)) + m.get("errors_"+string(ErrorPermanent)),
+			Failures:    m.get("failures"),
+			CircuitOpen: client.breaker.Open(),
+		}
+		if stats[i].Calls > 0 {
+			stats[i].AvgLatency = time.Duration(m.get("latency_us")/stats[i].Calls) * time.Microsecond
+		}
+	}
+	return stats
+}
+
+// LogStats logs the counters of every endpoint of the pool
+func (p *RpcPool) LogStats() {
+	for _, s := range p.Stats() {
+		p.log.Info("endpoint stats",
+			"endpoint", s.Endpoint,
+			"calls", s.Calls,
+			"retries", s.Retries,
+			"errors", s.Errors,
+			"failures", s.Failures,
+			"avg_latency", s.AvgLatency,
+			"circuit_open", s.CircuitOpen,
+		)
+	}
+}
+
+// endpointLimiter caps the requests per second and the concurrent requests of an endpoint, 0 being unlimited.
+// A streamed trace holds its slot until it is fully spooled, as the node keeps tracing the block while it
+// sends it. The pool counts it as in flight too, which steers the other calls to the endpoints not busy
+// with a large trace. A call never waits for a slot while holding one, so a limit of 1 can't deadlock, but
+// it queues every other call to the endpoint behind the download.
+type endpointLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // Between the start of two requests
+	next     time.Time     // Earliest start of the next request
+	slots    chan struct{} // nil if the concurrency is unlimited
+	inflight atomic.Int64
+}
+
+func newEndpointLimiter(rate, concurrency int) *endpointLimiter {
+	l := &endpointLimiter{}
+	if rate > 0 {
+		l.interval = time.Second / time.Duration(rate)
+	}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// reserve books the next request start, and returns how long to wait for it
+func (l *endpointLimiter) reserve() time.Duration {
+	if l.interval == 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	return wait
+}
+
+// acquire waits for the rate limit and a free slot, it must be followed by release
+func (l *endpointLimiter) acquire(ctx context.Context) error {
+	if wait := l.reserve(); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if l.slots != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case l.slots <- struct{}{}:
+		}
+	}
+	l.inflight.Add(1)
+	return nil
+}
+
+func (l *endpointLimiter) release() {
+	l.inflight.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRpcPool_Failover(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		archiveCalls int
+	)
+	full := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		return nil, &rpcError{Code: -32000, Message: "missing trie node 1234 (path )"}
+	})
+	archive := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		archiveCalls++
+		return map[string]any{"gasUsed": "0x10", "transactions": []string{}}, nil
+	})
+	pool := newRpcPool([]*RpcClient{full, archive})
+
+	// Whichever endpoint is tried first, the call ends up on the archive node
+	for range 2 {
+		stats, err := pool.BlockStats(1)
+		if err != nil {
+			t.Fatalf("BlockStats() failed: %v", err)
+		}
+		if stats.GasUsed != 0x10 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	}
+	if archiveCalls != 2 {
+		t.Errorf("Expected 2 calls to the archive node, got %d", archiveCalls)
+	}
+
+	stats := pool.Stats()
+	if len(stats) != 2 || stats[0].Endpoint != full.Endpoint() || stats[0].Errors == 0 || stats[0].Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestRpcPool_InvalidRequestNotFailedOver(t *testing.T) {
+	calls := 0
+	handler := func(method string, params []json.RawMessage) (any, error) {
+		calls++
+		return nil, &rpcError{Code: -32602, Message: "invalid argument 0"}
+	}
+	pool := newRpcPool([]*RpcClient{newTestRpcClient(t, handler), newTestRpcClient(t, handler)})
+
+	if _, err := pool.BlockStats(1); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single call, got %d", calls)
+	}
+}
+
+func TestRpcPool_SkipsOpenEndpoints(t *testing.T) {
+	handler := func(method string, params []json.RawMessage) (any, error) {
+		return map[string]any{"gasUsed": "0x1", "transactions": []string{}}, nil
+	}
+	open, closed := newTestRpcClient(t, handler), newTestRpcClient(t, handler)
+	open.breaker = newCircuitBreaker(1, time.Hour)
+	open.breaker.failure()
+	pool := newRpcPool([]*RpcClient{open, closed})
+
+	for range 4 {
+		if order := pool.order(); len(order) != 1 || order[0] != closed {
+			t.Fatalf("Expected only the closed endpoint, got %v", order)
+		}
+	}
+}
+
+func TestEndpointLimit(t *testing.T) {
+	if limit := endpointLimit(nil, 2); limit != 0 {
+		t.Errorf("Expected no limit, got %d", limit)
+	}
+	if limit := endpointLimit([]int{5}, 2); limit != 5 {
+		t.Errorf("Expected the single limit to apply to every endpoint, got %d", limit)
+	}
+	if limit := endpointLimit([]int{5, 7, 9}, 1); limit != 7 {
+		t.Errorf("Expected the limit of the endpoint, got %d", limit)
+	}
+}
+
+func TestEndpointLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	limiter := newEndpointLimiter(50, 0)
+	start := time.Now()
+	for range 3 {
+		if err := limiter.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		limiter.release()
+	}
+	// The first request starts right away, the next two 20ms apart
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected the requests to be spread over 40ms, took %v", elapsed)
+	}
+
+	limiter = newEndpointLimiter(0, 1)
+	if err := limiter.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the second request to wait for the slot, got %v", err)
+	}
+	limiter.release()
+	if err := limiter.acquire(ctx); err != nil {
+		t.Errorf("Expected the released slot to be free, got %v", err)
+	}
+}
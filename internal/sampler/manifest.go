@@ -0,0 +1,73 @@
+package sampler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFile is the name of the manifest in the result directory
+const ManifestFile = "sample.json"
+
+// Manifest records how a sample was drawn, and the blocks it contains
+type Manifest struct {
+	Strategy   string   `json:"strategy"`
+	StartBlock uint64   `json:"start_block"`
+	EndBlock   uint64   `json:"end_block"`
+	Size       uint64   `json:"size"`
+	Seed       uint64   `json:"seed"`
+	Strata     int      `json:"strata,omitempty"`
+	File       string   `json:"file,omitempty"`
+	Blocks     []uint64 `json:"blocks"`
+}
+
+// NewManifest returns the manifest of the blocks sampled with the given config
+func NewManifest(config Config, blocks []uint64) *Manifest {
+	return &Manifest{
+		Strategy:   config.Strategy,
+		StartBlock: config.StartBlock,
+		EndBlock:   config.EndBlock,
+		Size:       config.Size,
+		Seed:       config.Seed,
+		Strata:     config.Strata,
+		File:       config.File,
+		Blocks:     blocks,
+	}
+}
+
+// ReadManifest reads the manifest from the directory, returning nil if there is none
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sample manifest: %w", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode sample manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// WriteManifest writes the manifest to the directory, replacing any previous one
+func WriteManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sample manifest: %w", err)
+	}
+
+	path := filepath.Join(dir, ManifestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write sample manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace sample manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+// Package sampler picks the blocks a run analyzes.
+//
+// Every strategy is deterministic for a given configuration and seed, and the
+// chosen blocks are recorded in a manifest so a study can be reproduced exactly.
+package sampler
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Sampling strategies
+const (
+	Uniform = "uniform" // Evenly spaced over the range
+	Random  = "random"  // Seeded uniform random draw over the range
+	Gas     = "gas"     // Stratified by gas used
+	TxCount = "txcount" // Stratified by transaction count
+	File    = "file"    // Explicit block list read from a file
+)
+
+// Strategies returns the names of all known strategies
+func Strategies() []string {
+	return []string{Uniform, Random, Gas, TxCount, File}
+}
+
+const (
+	// Stratified strategies rank a random pool of this many candidates per sampled block
+	poolFactor = 4
+	// Default number of concurrent block stats requests when building the pool
+	defaultStatsConcurrency = 16
+)
+
+// Sampler returns the sorted, deduplicated blocks to analyze
+type Sampler interface {
+	Sample() ([]uint64, error)
+}
+
+// Config selects and parameterizes a sampling strategy
+type Config struct {
+	Strategy   string
+	StartBlock uint64
+	EndBlock   uint64
+	Size       uint64
+	Seed       uint64
+	Strata     int    // Number of strata for the stratified strategies
+	File       string // Block list for the file strategy
+
+	// Concurrent block stats requests of the stratified strategies, 0 for the default
+	StatsConcurrency int
+}
+
+// Stats are the per-block metrics the stratified strategies rank blocks by
+type Stats struct {
+	GasUsed uint64
+	TxCount uint64
+}
+
+// StatsSource looks up the stats of a block
+type StatsSource interface {
+	BlockStats(blockNum uint64) (Stats, error)
+}
+
+// New returns the sampler for the configured strategy. The stats source is only used by the stratified strategies.
+func New(config Config, source StatsSource) (Sampler, error) {
+	switch strings.ToLower(config.Strategy) {
+	case Uniform:
+		return uniformSampler{config}, nil
+	case Random:
+		return randomSampler{config}, nil
+	case Gas:
+		return stratifiedSampler{config, source, func(s Stats) uint64 { return s.GasUsed }}, nil
+	case TxCount:
+		return stratifiedSampler{config, source, func(s Stats) uint64 { return s.TxCount }}, nil
+	case File:
+		return fileSampler{config.File}, nil
+	default:
+		return nil, fmt.Errorf("unknown sample strategy %q, must be one of: %s", config.Strategy, strings.Join(Strategies(), ", "))
+	}
+}
+
+// rangeLen returns the number of blocks in the configured range
+func (c Config) rangeLen() uint64 {
+	if c.EndBlock < c.StartBlock {
+		return 0
+	}
+	return c.EndBlock - c.StartBlock + 1 // Wraps to 0 for the full uint64 range, which isn't a real block range
+}
+
+func (c Config) rng() *rand.Rand {
+	return rand.New(rand.NewPCG(c.Seed, c.Seed))
+}
+
+// uniformSampler spreads Size blocks evenly over the range, or takes every block of a range not larger than Size
+type uniformSampler struct {
+	config Config
+}
+
+func (s uniformSampler) Sample() ([]uint64, error) {
+	c := s.config
+	n := c.rangeLen()
+	if n == 0 || c.Size == 0 {
+		return nil, nil
+	}
+	if n <= c.Size {
+		return drawRange(c, c.Size), nil
+	}
+
+	// The i-th block is at i*(end-start)/Size, which are distinct blocks as the range is larger than Size.
+	// The product is 128 bits wide so that it can't overflow, and the quotient fits as i < Size.
+	span := c.EndBlock - c.StartBlock
+	blocks := make([]uint64, c.Size)
+	for i := range c.Size {
+		hi, lo := bits.Mul64(i, span)
+		offset, _ := bits.Div64(hi, lo, c.Size)
+		blocks[i] = c.StartBlock + offset
+	}
+	return blocks, nil
+}
+
+// randomSampler draws Size distinct blocks of the range uniformly at random
+type randomSampler struct {
+	config Config
+}
+
+func (s randomSampler) Sample() ([]uint64, error) {
+	return drawRange(s.config, s.config.Size), nil
+}
+
+// drawRange draws k distinct blocks of the configured range, or all of them if the range isn't larger than k
+func drawRange(c Config, k uint64) []uint64 {
+	n := c.rangeLen()
+	if n <= k {
+		blocks := make([]uint64, n)
+		for i := range blocks {
+			blocks[i] = c.StartBlock + uint64(i)
+		}
+		return blocks
+	}
+
+	// Floyd's algorithm, draws k offsets without materializing the range
+	rng := c.rng()
+	chosen := make(map[uint64]struct{}, k)
+	for j := n - k; j < n; j++ {
+		t := rng.Uint64N(j + 1)
+		if _, ok := chosen[t]; ok {
+			t = j
+		}
+		chosen[t] = struct{}{}
+	}
+
+	blocks := make([]uint64, 0, k)
+	for offset := range chosen {
+		blocks = append(blocks, c.StartBlock+offset)
+	}
+	slices.Sort(blocks)
+	return blocks
+}
+
+// stratifiedSampler ranks a random pool of blocks by a metric, splits it into strata of equal size,
+// and draws the same number of blocks from each, so that quiet and busy blocks are equally represented.
+//
+// The pool is 4 times the sample size, and the stats of every block in it are looked up before any block
+// is analyzed: sampling 100000 blocks costs 400000 calls to the node, StatsConcurrency of them at a time.
+type stratifiedSampler struct {
+	config Config
+	source StatsSource
+	metric func(Stats) uint64
+}
+
+func (s stratifiedSampler) Sample() ([]uint64, error) {
+	c := s.config
+	if s.source == nil {
+		return nil, fmt.Errorf("sample strategy %q needs a block stats source", c.Strategy)
+	}
+	if c.Strata < 1 {
+		return nil, fmt.Errorf("number of strata must be at least 1, got %d", c.Strata)
+	}
+
+	pool := drawRange(c, c.Size*poolFactor)
+	if uint64(len(pool)) <= c.Size {
+		return pool, nil
+	}
+
+	metrics := make([]uint64, len(pool))
+	var g errgroup.Group
+	concurrency := c.StatsConcurrency
+	if concurrency < 1 {
+		concurrency = defaultStatsConcurrency
+	}
+	g.SetLimit(concurrency)
+	for i, block := range pool {
+		g.Go(func() error {
+			stats, err := s.source.BlockStats(block)
+			if err != nil {
+				return fmt.Errorf("failed to get stats of block %d: %w", block, err)
+			}
+			metrics[i] = s.metric(stats)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Rank the pool by metric, breaking ties by block number so the order doesn't depend on the fetch order
+	order := make([]int, len(pool))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		if metrics[a] != metrics[b] {
+			return cmpUint64(metrics[a], metrics[b])
+		}
+		return cmpUint64(pool[a], pool[b])
+	})
+
+	rng := c.rng()
+	strata := uint64(c.Strata)
+	blocks := make([]uint64, 0, c.Size)
+	for i := range strata {
+		lo, hi := uint64(len(order))*i/strata, uint64(len(order))*(i+1)/strata
+		stratum := order[lo:hi]
+
+		// Spread the remainder over the first strata
+		want := c.Size / strata
+		if i < c.Size%strata {
+			want++
+		}
+		want = min(want, uint64(len(stratum)))
+
+		for _, j := range rng.Perm(len(stratum))[:want] {
+			blocks = append(blocks, pool[stratum[j]])
+		}
+	}
+	slices.Sort(blocks)
+	return blocks, nil
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// fileSampler reads one block number per line, in decimal or 0x-prefixed hex.
+// Blank lines and lines starting with # are ignored.
+type fileSampler struct {
+	path string
+}
+
+func (s fileSampler) Sample() ([]uint64, error) {
+	if s.path == "" {
+		return nil, fmt.Errorf("sample strategy %q needs a block list file", File)
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block list: %w", err)
+	}
+	defer file.Close()
+
+	var blocks []uint64
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		block, err := strconv.ParseUint(text, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block number on line %d of %s: %w", line, s.path, err)
+		}
+		blocks = append(blocks, block)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read block list: %w", err)
+	}
+
+	slices.Sort(blocks)
+	return slices.Compact(blocks), nil
+}
@@ -0,0 +1,237 @@
+package sampler
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUniform(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected []uint64
+	}{
+		{
+			name:     "range larger than size",
+			config:   Config{StartBlock: 100, EndBlock: 109, Size: 5},
+			expected: []uint64{100, 101, 103, 105, 107},
+		},
+		{
+			name:     "range not a multiple of size",
+			config:   Config{StartBlock: 100, EndBlock: 109, Size: 3},
+			expected: []uint64{100, 103, 106},
+		},
+		{
+			name:     "size blocks with a stride below 2",
+			config:   Config{StartBlock: 100, EndBlock: 109, Size: 6},
+			expected: []uint64{100, 101, 103, 104, 106, 107},
+		},
+		{
+			name:     "range as large as size",
+			config:   Config{StartBlock: 100, EndBlock: 102, Size: 3},
+			expected: []uint64{100, 101, 102},
+		},
+		{
+			name:     "range too large to multiply",
+			config:   Config{StartBlock: 1, EndBlock: math.MaxUint64 - 1, Size: 2},
+			expected: []uint64{1, math.MaxUint64 / 2},
+		},
+		{
+			name:     "range smaller than size",
+			config:   Config{StartBlock: 100, EndBlock: 102, Size: 10},
+			expected: []uint64{100, 101, 102},
+		},
+		{
+			name:   "empty range",
+			config: Config{StartBlock: 100, EndBlock: 99, Size: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Strategy = Uniform
+			blocks := sample(t, tt.config, nil)
+			if !slices.Equal(blocks, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, blocks)
+			}
+		})
+	}
+}
+
+func TestRandom(t *testing.T) {
+	config := Config{Strategy: Random, StartBlock: 1000, EndBlock: 1999, Size: 50, Seed: 7}
+
+	blocks := sample(t, config, nil)
+	if len(blocks) != 50 {
+		t.Fatalf("Expected 50 blocks, got %d", len(blocks))
+	}
+	if !slices.IsSorted(blocks) || len(slices.Compact(slices.Clone(blocks))) != 50 {
+		t.Errorf("Expected sorted distinct blocks, got %v", blocks)
+	}
+	if blocks[0] < 1000 || blocks[49] > 1999 {
+		t.Errorf("Blocks out of range: %v", blocks)
+	}
+
+	if again := sample(t, config, nil); !slices.Equal(blocks, again) {
+		t.Error("Same seed should give the same sample")
+	}
+
+	config.Seed = 8
+	if other := sample(t, config, nil); slices.Equal(blocks, other) {
+		t.Error("Different seeds should give different samples")
+	}
+
+	config.Size = 5000
+	if all := sample(t, config, nil); len(all) != 1000 {
+		t.Errorf("Expected the whole range, got %d blocks", len(all))
+	}
+}
+
+type fakeStats map[uint64]Stats
+
+func (f fakeStats) BlockStats(blockNum uint64) (Stats, error) {
+	stats, ok := f[blockNum]
+	if !ok {
+		return Stats{}, fmt.Errorf("unknown block %d", blockNum)
+	}
+	return stats, nil
+}
+
+func TestStratified(t *testing.T) {
+	// Gas used grows with the block number, tx count shrinks with it
+	source := fakeStats{}
+	for block := uint64(0); block < 1000; block++ {
+		source[block] = Stats{GasUsed: block, TxCount: 1000 - block}
+	}
+
+	for _, strategy := range []string{Gas, TxCount} {
+		t.Run(strategy, func(t *testing.T) {
+			config := Config{Strategy: strategy, StartBlock: 0, EndBlock: 999, Size: 40, Seed: 1, Strata: 4}
+			blocks := sample(t, config, source)
+			if len(blocks) != 40 {
+				t.Fatalf("Expected 40 blocks, got %d", len(blocks))
+			}
+
+			// The pool is a random draw over the range, so every quarter of the metric's range gets blocks
+			quarters := make([]int, 4)
+			for _, block := range blocks {
+				quarters[block/250]++
+			}
+			for i, n := range quarters {
+				if n == 0 {
+					t.Errorf("Quarter %d of the range has no blocks: %v", i, quarters)
+				}
+			}
+
+			if again := sample(t, config, source); !slices.Equal(blocks, again) {
+				t.Error("Same seed should give the same sample")
+			}
+		})
+	}
+
+	if _, err := mustNew(t, Config{Strategy: Gas, EndBlock: 999, Size: 10, Strata: 2}, nil).Sample(); err == nil {
+		t.Error("Expected an error without a stats source")
+	}
+}
+
+// concurrentStats records the most concurrent BlockStats calls
+type concurrentStats struct {
+	inFlight, max atomic.Int32
+}
+
+func (c *concurrentStats) BlockStats(blockNum uint64) (Stats, error) {
+	n := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		if peak := c.max.Load(); n <= peak || c.max.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return Stats{GasUsed: blockNum}, nil
+}
+
+func TestStratified_StatsConcurrency(t *testing.T) {
+	source := &concurrentStats{}
+	config := Config{Strategy: Gas, StartBlock: 0, EndBlock: 999, Size: 10, Seed: 1, Strata: 2, StatsConcurrency: 2}
+	if blocks := sample(t, config, source); len(blocks) != 10 {
+		t.Fatalf("Expected 10 blocks, got %d", len(blocks))
+	}
+	if peak := source.max.Load(); peak > 2 {
+		t.Errorf("Expected at most 2 concurrent calls, got %d", peak)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.txt")
+	content := "# blocks to study\n22000010\n\n0x14fb180\n22000001\n22000010\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write block list: %v", err)
+	}
+
+	blocks := sample(t, Config{Strategy: File, File: path}, nil)
+	expected := []uint64{22000000, 22000001, 22000010}
+	if !slices.Equal(blocks, expected) {
+		t.Errorf("Expected %v, got %v", expected, blocks)
+	}
+
+	if err := os.WriteFile(path, []byte("22000000\nnope\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write block list: %v", err)
+	}
+	if _, err := mustNew(t, Config{Strategy: File, File: path}, nil).Sample(); err == nil {
+		t.Error("Expected an error for an invalid block number")
+	}
+}
+
+func TestNew_UnknownStrategy(t *testing.T) {
+	if _, err := New(Config{Strategy: "nope"}, nil); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := ReadManifest(dir)
+	if err != nil || m != nil {
+		t.Fatalf("Expected no manifest, got %v, %v", m, err)
+	}
+
+	config := Config{Strategy: Random, StartBlock: 1, EndBlock: 100, Size: 3, Seed: 42}
+	want := NewManifest(config, []uint64{5, 17, 80})
+	if err := WriteManifest(dir, want); err != nil {
+		t.Fatalf("WriteManifest() failed: %v", err)
+	}
+
+	got, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadManifest() failed: %v", err)
+	}
+	if got.Strategy != Random || got.Seed != 42 || !slices.Equal(got.Blocks, want.Blocks) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func mustNew(t *testing.T, config Config, source StatsSource) Sampler {
+	t.Helper()
+	s, err := New(config, source)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	return s
+}
+
+func sample(t *testing.T, config Config, source StatsSource) []uint64 {
+	t.Helper()
+	blocks, err := mustNew(t, config, source).Sample()
+	if err != nil {
+		t.Fatalf("Sample() failed: %v", err)
+	}
+	return blocks
+}
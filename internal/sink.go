@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Output formats of the results
+const (
+	OutputCSV     = "csv"
+	OutputParquet = "parquet"
+	OutputSQLite  = "sqlite"
+)
+
+// OutputFormats returns the supported output formats
+func OutputFormats() []string {
+	return []string{OutputCSV, OutputParquet, OutputSQLite}
+}
+
+// ResultSink is where a worker writes the results of the blocks it analyzed. The results of a block are only
+// guaranteed to be in the output files once flushed, which is when the block gets checkpointed.
+type ResultSink interface {
+	WriteBlock(result BlockResult) error
+	Flush() error
+	Close() error
+	// Files returns the names of the files written, relative to the result directory
+	Files() []string
+}
+
+// NewResultSinks returns the sinks of a worker: the results in the configured format, and the per-transaction
+// rows if enabled
+func NewResultSinks(config *Config, id int) ([]ResultSink, error) {
+	var sinks []ResultSink
+	switch config.OutputFormat {
+	case OutputCSV:
+		sinks = append(sinks, NewResultWriter(config.ResultDir, id, config.ChunkSizes...))
+	case OutputParquet:
+		writer, err := NewParquetWriter(config.ResultDir, id, config.ParquetRowGroupBlocks, config.ChunkSizes...)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, writer)
+	case OutputSQLite:
+		writer, err := NewSQLiteWriter(config.ResultDir, config.ChunkSizes...)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, writer)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", config.OutputFormat)
+	}
+
+	if config.PerTxOutput {
+		sinks = append(sinks, NewTxResultWriter(config.ResultDir, id))
+	}
+	return sinks, nil
+}
+
+// blockSummary sums the per-contract results of a block
+type blockSummary struct {
+	chunksCount      int
+	stemsCount       int
+	headerStemsCount int
+	witnessGas       uint64
+}
+
+func summarizeBlock(results map[common.Address]*MergedTraceResult) blockSummary {
+	var s blockSummary
+	for _, result := range results {
+		stems := result.Stems()
+		s.chunksCount += len(result.AccessedChunks())
+		s.stemsCount += stems.Count
+		if stems.HeaderHit {
+			s.headerStemsCount++
+		}
+		s.witnessGas += result.WitnessGas
+	}
+	return s
+}
+
+// txSummary sums the per-contract results of a transaction. Initcode isn't part of the state tree, only its
+// chunks are counted.
+type txSummary struct {
+	contractsCount int
+	chunksCount    int
+	stemsCount     int
+}
+
+func summarizeTx(tx TxResult) txSummary {
+	s := txSummary{contractsCount: len(tx.Results) + len(tx.InitCodes)}
+	for _, result := range tx.Results {
+		s.chunksCount += len(result.AccessedChunks())
+		s.stemsCount += result.Stems().Count
+	}
+	for _, result := range tx.InitCodes {
+		s.chunksCount += len(result.AccessedChunks())
+	}
+	return s
+}
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/weiihann/chunk-analysis/internal/treekey"
+)
+
+// SQLiteFile is the name of the database shared by the workers, in the result directory
+const SQLiteFile = "results.db"
+
+// sqliteSchema has the same columns as the CSV files, with the chunks stored as blobs of the number of bytes
+// accessed in each chunk. Every row but the contracts is keyed by block, so writing a block again replaces its rows.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	block_number       INTEGER PRIMARY KEY,
+	contracts_count    INTEGER NOT NULL,
+	chunks_count       INTEGER NOT NULL,
+	stems_count        INTEGER NOT NULL,
+	header_stems_count INTEGER NOT NULL,
+	witness_gas        INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS contracts (
+	address       TEXT NOT NULL,
+	code_hash     TEXT NOT NULL,
+	bytecode_size INTEGER NOT NULL,
+	PRIMARY KEY (address, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS accesses (
+	block_number     INTEGER NOT NULL,
+	address          TEXT NOT NULL,
+	code_hash        TEXT NOT NULL,
+	chunks           BLOB NOT NULL,
+	chunks_count     INTEGER NOT NULL,
+	code_size_count  INTEGER NOT NULL,
+	code_copy_count  INTEGER NOT NULL,
+	code_copy_chunks BLOB,
+	stems_count      INTEGER NOT NULL,
+	header_stem      INTEGER NOT NULL,
+	witness_gas      INTEGER NOT NULL,
+	PRIMARY KEY (block_number, address)
+);
+
+CREATE TABLE IF NOT EXISTS access_chunk_sizes (
+	block_number INTEGER NOT NULL,
+	address      TEXT NOT NULL,
+	chunk_size   INTEGER NOT NULL,
+	chunks       BLOB NOT NULL,
+	stems_count  INTEGER NOT NULL,
+	PRIMARY KEY (block_number, address, chunk_size)
+);
+
+CREATE TABLE IF NOT EXISTS initcode_accesses (
+	block_number     INTEGER NOT NULL,
+	initcode_hash    TEXT NOT NULL,
+	bytecode_size    INTEGER NOT NULL,
+	chunks           BLOB NOT NULL,
+	chunks_count     INTEGER NOT NULL,
+	code_size_count  INTEGER NOT NULL,
+	code_copy_count  INTEGER NOT NULL,
+	code_copy_chunks BLOB,
+	PRIMARY KEY (block_number, initcode_hash)
+);
+
+CREATE TABLE IF NOT EXISTS txs (
+	block_number    INTEGER NOT NULL,
+	tx_index        INTEGER NOT NULL,
+	tx_hash         TEXT NOT NULL,
+	tx_type         INTEGER NOT NULL,
+	contracts_count INTEGER NOT NULL,
+	chunks_count    INTEGER NOT NULL,
+	stems_count     INTEGER NOT NULL,
+	witness_gas     INTEGER NOT NULL,
+	PRIMARY KEY (block_number, tx_index)
+);
+`
+
+const (
+	upsertBlock = `INSERT INTO blocks (block_number, contracts_count, chunks_count, stems_count, header_stems_count, witness_gas)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (block_number) DO UPDATE SET
+	contracts_count = excluded.contracts_count,
+	chunks_count = excluded.chunks_count,
+	stems_count = excluded.stems_count,
+	header_stems_count = excluded.header_stems_count,
+	witness_gas = excluded.witness_gas`
+
+	upsertContract = `INSERT INTO contracts (address, code_hash, bytecode_size)
+VALUES (?, ?, ?)
+ON CONFLICT (address, code_hash) DO NOTHING`
+
+	insertAccess = `INSERT INTO accesses (block_number, address, code_hash, chunks, chunks_count, code_size_count, code_copy_count, code_copy_chunks, stems_count, header_stem, witness_gas)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	insertAccessChunkSize = `INSERT INTO access_chunk_sizes (block_number, address, chunk_size, chunks, stems_count)
+VALUES (?, ?, ?, ?, ?)`
+
+	insertInitCodeAccess = `INSERT INTO initcode_accesses (block_number, initcode_hash, bytecode_size, chunks, chunks_count, code_size_count, code_copy_count, code_copy_chunks)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	insertTx = `INSERT INTO txs (block_number, tx_index, tx_hash, tx_type, contracts_count, chunks_count, stems_count, witness_gas)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+)
+
+// sqliteBlockTables have several rows per block, which are all deleted before the block is written again
+var sqliteBlockTables = []string{"accesses", "access_chunk_sizes", "initcode_accesses", "txs"}
+
+// SQLiteWriter writes the results into a database shared by every worker. The database is in WAL mode, so
+// the workers write to it concurrently, each with its own connection. The blocks written since the last flush
+// are committed together by the flush.
+//
+// Writing a block deletes the rows it had first, so the blocks re-analyzed after a resume replace their rows
+// instead of adding duplicates or leaving stale ones, and the database doesn't need to be rolled back to the
+// checkpoint.
+type SQLiteWriter struct {
+	db         *sql.DB
+	tx         *sql.Tx // Transaction of the blocks written since the last flush, nil if none
+	chunkSizes []uint32
+}
+
+func NewSQLiteWriter(dir string, chunkSizes ...uint32) (*SQLiteWriter, error) {
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Take the write lock when the transaction begins rather than on its first write, so that concurrent
+	// writers wait on the busy timeout instead of failing to upgrade their lock
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=30000&_txlock=immediate",
+		filepath.Join(dir, SQLiteFile))
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", SQLiteFile, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the tables of %s: %w", SQLiteFile, err)
+	}
+	return &SQLiteWriter{
+		db:         db,
+		chunkSizes: chunkSizes,
+	}, nil
+}
+
+// WriteBlock replaces the rows of the block, they are committed by the next flush
+func (w *SQLiteWriter) WriteBlock(result BlockResult) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		w.tx = tx
+	}
+
+	if err := w.writeBlock(result); err != nil {
+		w.tx.Rollback()
+		w.tx = nil
+		return err
+	}
+	return nil
+}
+
+func (w *SQLiteWriter) writeBlock(result BlockResult) error {
+	blockNum := result.BlockNum
+	for _, table := range sqliteBlockTables {
+		if _, err := w.tx.Exec("DELETE FROM "+table+" WHERE block_number = ?", blockNum); err != nil {
+			return fmt.Errorf("failed to delete the %s of block %d: %w", table, blockNum, err)
+		}
+	}
+
+	for address, res := range result.Results {
+		hex := address.Hex()
+		codeHash := res.CodeHash.Hex()
+		stems := res.Stems()
+		if _, err := w.tx.Exec(upsertContract, hex, codeHash, res.Bits.Size()); err != nil {
+			return fmt.Errorf("failed to write contract: %w", err)
+		}
+		if _, err := w.tx.Exec(insertAccess,
+			blockNum,
+			hex,
+			codeHash,
+			res.Bits.Chunks(),
+			len(res.AccessedChunks()),
+			res.CodeSizeCount,
+			res.CodeCopyCount,
+			sqliteCopyChunks(res.CopyBits),
+			stems.Count,
+			stems.HeaderHit,
+			res.WitnessGas,
+		); err != nil {
+			return fmt.Errorf("failed to write access: %w", err)
+		}
+		for _, size := range w.chunkSizes {
+			if _, err := w.tx.Exec(insertAccessChunkSize,
+				blockNum,
+				hex,
+				size,
+				res.Bits.ChunksFor(size),
+				treekey.CountStems(res.AccessedChunksFor(size)).Count,
+			); err != nil {
+				return fmt.Errorf("failed to write access: %w", err)
+			}
+		}
+	}
+
+	// Initcode isn't part of the state tree, so it has no stems and no witness gas
+	for hash, res := range result.InitCodes {
+		if _, err := w.tx.Exec(insertInitCodeAccess,
+			blockNum,
+			hash.Hex(),
+			res.Bits.Size(),
+			res.Bits.Chunks(),
+			len(res.AccessedChunks()),
+			res.CodeSizeCount,
+			res.CodeCopyCount,
+			sqliteCopyChunks(res.CopyBits),
+		); err != nil {
+			return fmt.Errorf("failed to write initcode access: %w", err)
+		}
+	}
+
+	summary := summarizeBlock(result.Results)
+	if _, err := w.tx.Exec(upsertBlock,
+		blockNum,
+		len(result.Results),
+		summary.chunksCount,
+		summary.stemsCount,
+		summary.headerStemsCount,
+		summary.witnessGas,
+	); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+
+	for _, tx := range result.Txs {
+		summary := summarizeTx(tx)
+		if _, err := w.tx.Exec(insertTx,
+			blockNum,
+			tx.TxIndex,
+			tx.TxHash,
+			tx.TxType,
+			summary.contractsCount,
+			summary.chunksCount,
+			summary.stemsCount,
+			tx.WitnessGas,
+		); err != nil {
+			return fmt.Errorf("failed to write tx: %w", err)
+		}
+	}
+	return nil
+}
+
+// Flush commits the blocks written since the last flush, if any
+func (w *SQLiteWriter) Flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// Close commits the blocks that weren't flushed yet, and closes the connection
+func (w *SQLiteWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		w.db.Close()
+		return err
+	}
+	return w.db.Close()
+}
+
+// Files returns no file: replacing the rows of the blocks written again makes the database consistent with
+// the checkpoint, without truncating it
+func (w *SQLiteWriter) Files() []string {
+	return nil
+}
+
+// sqliteCopyChunks returns the per-chunk byte counts copied by CODECOPY/EXTCODECOPY, nil if none were recorded
+func sqliteCopyChunks(bits *BitSet) []byte {
+	if bits == nil {
+		return nil
+	}
+	return bits.Chunks()
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSQLiteWriter(t *testing.T) {
+	tempDir := t.TempDir()
+
+	addr := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	codeHash := common.HexToHash("0xc0de")
+	block := func(blockNum uint64) BlockResult {
+		bitSet := NewBitSet(100, 32)
+		bitSet.Set(10).Set(20).Set(40)
+		initCode := NewBitSet(40, 32)
+		initCode.SetRange(0, 5)
+		return BlockResult{
+			BlockNum:  blockNum,
+			Results:   map[common.Address]*MergedTraceResult{addr: {CodeHash: codeHash, Bits: bitSet, CodeSizeCount: 2}},
+			InitCodes: map[common.Hash]*MergedTraceResult{common.HexToHash("0xaa"): {Bits: initCode}},
+			Txs:       []TxResult{{TxHash: "0x01", TxIndex: 0, TxType: 2}},
+		}
+	}
+
+	// Two workers writing at once, the second one writing again the blocks of the first, as after a resume
+	first, err := NewSQLiteWriter(tempDir, 64)
+	if err != nil {
+		t.Fatalf("NewSQLiteWriter() failed: %v", err)
+	}
+	second, err := NewSQLiteWriter(tempDir, 64)
+	if err != nil {
+		t.Fatalf("NewSQLiteWriter() failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, writer := range []*SQLiteWriter{first, second} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, blockNum := range []uint64{1, 2} {
+				if err := writer.WriteBlock(block(blockNum)); err != nil {
+					t.Errorf("WriteBlock() failed: %v", err)
+					return
+				}
+				if err := writer.Flush(); err != nil {
+					t.Errorf("Flush() failed: %v", err)
+					return
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Errorf("Close() failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if files := first.Files(); len(files) != 0 {
+		t.Errorf("Expected no checkpointed file, got %v", files)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(tempDir, SQLiteFile))
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil || journalMode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %q (%v)", journalMode, err)
+	}
+
+	for table, expected := range map[string]int{
+		"blocks":             2,
+		"contracts":          1,
+		"accesses":           2,
+		"access_chunk_sizes": 2,
+		"initcode_accesses":  2,
+		"txs":                2,
+	} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("Failed to count %s: %v", table, err)
+		}
+		if count != expected {
+			t.Errorf("Expected %d rows in %s, got %d", expected, table, count)
+		}
+	}
+
+	var (
+		hash          string
+		chunks        []byte
+		chunksCount   int
+		codeSizeCount int
+		bytecodeSize  int
+	)
+	err = db.QueryRow(`SELECT a.code_hash, a.chunks, a.chunks_count, a.code_size_count, c.bytecode_size
+		FROM accesses a JOIN contracts c USING (address, code_hash)
+		WHERE a.block_number = 2 AND a.address = ?`, addr.Hex()).Scan(&hash, &chunks, &chunksCount, &codeSizeCount, &bytecodeSize)
+	if err != nil {
+		t.Fatalf("Failed to query the access: %v", err)
+	}
+	if hash != codeHash.Hex() || !bytes.Equal(chunks, []byte{2, 1, 0, 0}) || chunksCount != 2 || codeSizeCount != 2 || bytecodeSize != 100 {
+		t.Errorf("Unexpected access %s %v %d %d %d", hash, chunks, chunksCount, codeSizeCount, bytecodeSize)
+	}
+
+	var extraChunks []byte
+	if err := db.QueryRow("SELECT chunks FROM access_chunk_sizes WHERE block_number = 1 AND chunk_size = 64").Scan(&extraChunks); err != nil {
+		t.Fatalf("Failed to query the extra chunk size: %v", err)
+	}
+	if !bytes.Equal(extraChunks, []byte{3, 0}) {
+		t.Errorf("Unexpected extra chunk size chunks %v", extraChunks)
+	}
+}
+
+// Writing a block again with fewer rows leaves none of the earlier ones behind
+func TestSQLiteWriter_RewriteBlock(t *testing.T) {
+	tempDir := t.TempDir()
+	writer, err := NewSQLiteWriter(tempDir, 64)
+	if err != nil {
+		t.Fatalf("NewSQLiteWriter() failed: %v", err)
+	}
+
+	result := BlockResult{BlockNum: 1, Results: map[common.Address]*MergedTraceResult{}, InitCodes: map[common.Hash]*MergedTraceResult{}}
+	for i := range 3 {
+		result.Results[common.BigToAddress(big.NewInt(int64(i+1)))] = &MergedTraceResult{Bits: NewBitSet(10, 32)}
+		result.InitCodes[common.BigToHash(big.NewInt(int64(i+1)))] = &MergedTraceResult{Bits: NewInitCodeBitSet(10, 32)}
+		result.Txs = append(result.Txs, TxResult{TxHash: "0x01", TxIndex: i})
+	}
+	if err := writer.WriteBlock(result); err != nil {
+		t.Fatalf("WriteBlock() failed: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	rewritten := BlockResult{
+		BlockNum:  1,
+		Results:   map[common.Address]*MergedTraceResult{common.BigToAddress(big.NewInt(3)): {Bits: NewBitSet(10, 32)}},
+		InitCodes: map[common.Hash]*MergedTraceResult{},
+		Txs:       []TxResult{{TxHash: "0x02", TxIndex: 0}},
+	}
+	if err := writer.WriteBlock(rewritten); err != nil {
+		t.Fatalf("WriteBlock() failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(tempDir, SQLiteFile))
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	defer db.Close()
+	for table, expected := range map[string]int{
+		"blocks":             1,
+		"contracts":          3, // Contracts aren't per block
+		"accesses":           1,
+		"access_chunk_sizes": 1,
+		"initcode_accesses":  0,
+		"txs":                1,
+	} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("Failed to count %s: %v", table, err)
+		}
+		if count != expected {
+			t.Errorf("Expected %d rows in %s, got %d", expected, table, count)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceCacheExt = ".json.gz"
+
+// TraceCache persists traces fetched over RPC as gzipped JSON files in a directory, shared by all retrievers.
+// When the files grow past the size cap, the least recently used blocks are evicted, with all their files: a
+// block is only analyzed offline if its trace, transactions and codes are all cached. A hit refreshes the
+// modification time of the file, which is what recency is tracked by, so it survives restarts.
+type TraceCache struct {
+	dir      string
+	maxBytes int64 // 0 means unlimited
+
+	mu      sync.Mutex
+	size    int64 // Total size of the cached files, only known once the directory was scanned
+	scanned bool
+}
+
+func NewTraceCache(dir string, maxBytes int64) *TraceCache {
+	return &TraceCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+}
+
+func (c *TraceCache) path(name string) string {
+	return filepath.Join(c.dir, name+traceCacheExt)
+}
+
+// Get decodes the cached entry into v, returning false if there is none
+func (c *TraceCache) Get(name string, v any) (bool, error) {
+	reader, ok, err := c.Open(name)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode cached trace %s: %w", c.path(name), err)
+	}
+	return true, nil
+}
+
+// Put atomically writes the entry, then evicts the least recently used entries if the cache is over its cap
+func (c *TraceCache) Put(name string, v any) error {
+	entry, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(entry).Encode(v); err != nil {
+		entry.Abort()
+		return fmt.Errorf("failed to encode cached trace: %w", err)
+	}
+	return entry.Commit()
+}
+
+// Open returns a reader of the decompressed entry, returning false if there is none
+func (c *TraceCache) Open(name string) (io.ReadCloser, bool, error) {
+	path := c.path(name)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open cached trace: %w", err)
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, false, fmt.Errorf("failed to decompress cached trace %s: %w", path, err)
+	}
+
+	// Mark as recently used
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return &cacheReader{Reader: reader, file: file}, true, nil
+}
+
+type cacheReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *cacheReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// Create starts writing an entry. The entry only becomes visible once committed.
+func (c *TraceCache) Create(name string) (*CacheEntry, error) {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create trace directory: %w", err)
+	}
+
+	path := c.path(name)
+	tmp, err := os.CreateTemp(c.dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cached trace: %w", err)
+	}
+
+	return &CacheEntry{
+		Writer: gzip.NewWriter(tmp),
+		cache:  c,
+		path:   path,
+		tmp:    tmp,
+	}, nil
+}
+
+// CacheEntry is a cache entry being written, compressed on the fly
+type CacheEntry struct {
+	*gzip.Writer
+	cache *TraceCache
+	path  string
+	tmp   *os.File
+}
+
+// Abort discards the entry
+func (e *CacheEntry) Abort() {
+	e.Writer.Close()
+	e.tmp.Close()
+	os.Remove(e.tmp.Name())
+}
+
+// Commit atomically moves the entry into the cache, then evicts the least recently used entries
+// if the cache is over its cap
+func (e *CacheEntry) Commit() error {
+	defer os.Remove(e.tmp.Name()) // No-op once renamed
+
+	if err := e.Writer.Close(); err != nil {
+		e.tmp.Close()
+		return fmt.Errorf("failed to compress cached trace: %w", err)
+	}
+	if err := e.tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close cached trace: %w", err)
+	}
+
+	stat, err := os.Stat(e.tmp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to stat cached trace: %w", err)
+	}
+
+	c := e.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The entry may replace one of the same name, whose size no longer counts
+	var replaced int64
+	if old, err := os.Stat(e.path); err == nil {
+		replaced = old.Size()
+	}
+	if err := os.Rename(e.tmp.Name(), e.path); err != nil {
+		return fmt.Errorf("failed to save cached trace: %w", err)
+	}
+
+	if c.maxBytes == 0 {
+		return nil
+	}
+	if !c.scanned {
+		// The scan already sees the new file
+		return c.evict(e.path)
+	}
+	c.size += stat.Size() - replaced
+	if c.size > c.maxBytes {
+		return c.evict(e.path)
+	}
+	return nil
+}
+
+// cachedBlock is the files of a block in the cache
+type cachedBlock struct {
+	paths   []string
+	size    int64
+	lastUse time.Time // Most recent modification time of its files
+}
+
+// cacheBlockKey returns the block an entry belongs to, e.g. block_5 for block_5_trace.json.gz.
+// Entries not named after a block are on their own.
+func cacheBlockKey(name string) string {
+	rest, ok := strings.CutPrefix(name, "block_")
+	if !ok {
+		return name
+	}
+	num, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return name
+	}
+	return "block_" + num
+}
+
+// evict rescans the directory and removes the least recently used blocks until the cache fits its cap.
+// The block of the entry just written is kept. Must be called with the lock held.
+func (c *TraceCache) evict(keep string) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read trace directory: %w", err)
+	}
+
+	blocks := make(map[string]*cachedBlock)
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), traceCacheExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stat cached trace: %w", err)
+		}
+
+		key := cacheBlockKey(entry.Name())
+		block, ok := blocks[key]
+		if !ok {
+			block = &cachedBlock{}
+			blocks[key] = block
+		}
+		block.paths = append(block.paths, filepath.Join(c.dir, entry.Name()))
+		block.size += info.Size()
+		if info.ModTime().After(block.lastUse) {
+			block.lastUse = info.ModTime()
+		}
+		size += info.Size()
+	}
+
+	keepKey := cacheBlockKey(filepath.Base(keep))
+	keys := slices.Collect(maps.Keys(blocks))
+	slices.SortFunc(keys, func(a, b string) int { return blocks[a].lastUse.Compare(blocks[b].lastUse) })
+
+	for _, key := range keys {
+		if size <= c.maxBytes {
+			break
+		}
+		if key == keepKey {
+			continue
+		}
+		block := blocks[key]
+		for _, path := range block.paths {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to evict cached trace: %w", err)
+			}
+		}
+		size -= block.size
+	}
+
+	c.size = size
+	c.scanned = true
+	return nil
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestTraceCache_PutGet(t *testing.T) {
+	tempDir := t.TempDir()
+	cache := NewTraceCache(tempDir, 0)
+
+	var missing JSONTrace
+	ok, err := cache.Get("block_1_trace", &missing)
+	if err != nil || ok {
+		t.Fatalf("Expected a miss, got %t, %v", ok, err)
+	}
+
+	want := JSONTrace{Result: []TransactionTrace{
+		{TxHash: "0xaa", Result: InnerResult{Steps: []TraceStep{{PC: 1, Op: "PUSH1", Depth: 1, Stack: []string{"0x1"}}}}},
+	}}
+	if err := cache.Put("block_1_trace", want); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	var got JSONTrace
+	ok, err = cache.Get("block_1_trace", &got)
+	if err != nil || !ok {
+		t.Fatalf("Expected a hit, got %t, %v", ok, err)
+	}
+	if len(got.Result) != 1 || got.Result[0].TxHash != "0xaa" || got.Result[0].Result.Steps[0].Stack[0] != "0x1" {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	// Only the compressed entry is left behind
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "block_1_trace"+traceCacheExt {
+		t.Errorf("Expected a single cache file, got %v", entries)
+	}
+}
+
+func TestTraceCache_Evict(t *testing.T) {
+	tempDir := t.TempDir()
+	cache := NewTraceCache(tempDir, 0)
+
+	// Fill the cache without a cap, then age the entries so that block 2 is the least recently used
+	for _, name := range []string{"block_1_trace", "block_2_trace", "block_3_trace"} {
+		if err := cache.Put(name, JSONTrace{Result: []TransactionTrace{{TxHash: name}}}); err != nil {
+			t.Fatalf("Put() failed: %v", err)
+		}
+	}
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"block_1_trace": 2 * time.Hour, "block_2_trace": 3 * time.Hour, "block_3_trace": time.Hour} {
+		if err := os.Chtimes(cache.path(name), now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatalf("Failed to age %s: %v", name, err)
+		}
+	}
+
+	// A hit makes block 1 the most recently used
+	var trace JSONTrace
+	if ok, err := cache.Get("block_1_trace", &trace); err != nil || !ok {
+		t.Fatalf("Expected a hit, got %t, %v", ok, err)
+	}
+
+	stat, err := os.Stat(cache.path("block_1_trace"))
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+
+	// Room for three entries, so adding a fourth evicts exactly one
+	cache.maxBytes = 3*stat.Size() + stat.Size()/2
+	if err := cache.Put("block_4_trace", JSONTrace{Result: []TransactionTrace{{TxHash: "block_4_trace"}}}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	for name, kept := range map[string]bool{"block_1_trace": true, "block_2_trace": false, "block_3_trace": true, "block_4_trace": true} {
+		_, err := os.Stat(cache.path(name))
+		if kept && err != nil {
+			t.Errorf("Expected %s to be kept, got %v", name, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be evicted, got %v", name, err)
+		}
+	}
+}
+
+func TestTraceCache_EvictBlock(t *testing.T) {
+	tempDir := t.TempDir()
+	cache := NewTraceCache(tempDir, 0)
+
+	names := []string{"block_1_trace", "block_1_txs", "block_2_trace", "block_2_txs"}
+	for _, name := range names {
+		if err := cache.Put(name, JSONTrace{Result: []TransactionTrace{{TxHash: "0xaa"}}}); err != nil {
+			t.Fatalf("Put() failed: %v", err)
+		}
+	}
+	// Block 1 has the oldest file, but was used more recently than block 2 through its other file
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"block_1_trace": 4 * time.Hour, "block_1_txs": time.Hour, "block_2_trace": 3 * time.Hour, "block_2_txs": 2 * time.Hour} {
+		if err := os.Chtimes(cache.path(name), now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatalf("Failed to age %s: %v", name, err)
+		}
+	}
+
+	stat, err := os.Stat(cache.path("block_1_trace"))
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+
+	// Room for four entries, so adding a fifth evicts a whole block
+	cache.maxBytes = 4*stat.Size() + stat.Size()/2
+	if err := cache.Put("block_3_trace", JSONTrace{Result: []TransactionTrace{{TxHash: "0xaa"}}}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	for name, kept := range map[string]bool{"block_1_trace": true, "block_1_txs": true, "block_2_trace": false, "block_2_txs": false, "block_3_trace": true} {
+		_, err := os.Stat(cache.path(name))
+		if kept && err != nil {
+			t.Errorf("Expected %s to be kept, got %v", name, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be evicted, got %v", name, err)
+		}
+	}
+}
+
+func TestTraceCache_Overwrite(t *testing.T) {
+	tempDir := t.TempDir()
+	cache := NewTraceCache(tempDir, 1<<20)
+
+	// Writing the same entry again replaces its size instead of adding to it
+	for range 3 {
+		if err := cache.Put("block_1_trace", JSONTrace{Result: []TransactionTrace{{TxHash: "0xaa"}}}); err != nil {
+			t.Fatalf("Put() failed: %v", err)
+		}
+	}
+
+	stat, err := os.Stat(cache.path("block_1_trace"))
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if cache.size != stat.Size() {
+		t.Errorf("Expected a cache size of %d, got %d", stat.Size(), cache.size)
+	}
+}
+
+func TestTraceRetriever_Cached(t *testing.T) {
+	tempDir := t.TempDir()
+	cache := NewTraceCache(tempDir, 0)
+	if err := cache.Put("block_7_trace", JSONTrace{Result: []TransactionTrace{{TxHash: "0xaa"}}}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if err := cache.Put("block_7_calls", JSONCallFrames{Result: []CallFrameTrace{{TxHash: "0xaa"}}}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	// Without an RPC client, any miss would panic
+	retriever := NewTraceRetriever(nil, tempDir, cache)
+
+	trace, err := retriever.GetTrace(7)
+	if err != nil {
+		t.Fatalf("GetTrace() failed: %v", err)
+	}
+	if len(trace) != 1 || trace[0].TxHash != "0xaa" {
+		t.Errorf("Unexpected trace %+v", trace)
+	}
+
+	frames, err := retriever.GetCallFrames(7)
+	if err != nil {
+		t.Fatalf("GetCallFrames() failed: %v", err)
+	}
+	if len(frames) != 1 || frames[0].TxHash != "0xaa" {
+		t.Errorf("Unexpected call frames %+v", frames)
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "block_7_trace.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected no plain trace file, got %v", err)
+	}
+}
+
+// A block analyzed once is analyzed again from the cache only, with either tracer
+func TestTraceRetriever_OfflineRerun(t *testing.T) {
+	sender := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	deployed := crypto.CreateAddress(sender, 0)
+	node := deployAndCallHandler(sender, deployed)
+
+	var offline atomic.Bool
+	client := newTestRpcClient(t, func(method string, params []json.RawMessage) (any, error) {
+		if offline.Load() {
+			return nil, fmt.Errorf("node offline, %s called", method)
+		}
+		if method != "debug_traceBlockByNumber" {
+			return node(method, params)
+		}
+		if strings.Contains(string(params[1]), "tracer") {
+			return []CodeAccessTrace{
+				{TxHash: "0x01", Result: CodeAccessResult{Codes: []CodeAccess{{InitCode: "0x600a600c600039600a6000f3", Ranges: [][2]uint64{{0, 13}}}}}},
+				{TxHash: "0x02", Result: CodeAccessResult{Codes: []CodeAccess{{Address: deployed.Hex(), Ranges: [][2]uint64{{0, 5}}}}}},
+			}, nil
+		}
+		return []TransactionTrace{
+			{TxHash: "0x01", Result: InnerResult{Steps: []TraceStep{{PC: 0, Op: "PUSH1", Depth: 1}, {PC: 2, Op: "RETURN", Depth: 1, Stack: []string{"0x0", "0xa"}}}}},
+			{TxHash: "0x02", Result: InnerResult{Steps: []TraceStep{{PC: 0, Op: "PUSH1", Depth: 1}, {PC: 2, Op: "PUSH1", Depth: 1}, {PC: 4, Op: "ADD", Depth: 1}}}},
+		}, nil
+	})
+	cache := NewTraceCache(t.TempDir(), 0)
+
+	analyze := func(tracer string) BlockResult {
+		t.Helper()
+		// A new analyzer, whose code cache is empty
+		analyzer := newTestAnalyzer(t, client, cache)
+		var (
+			result BlockResult
+			err    error
+		)
+		if tracer == TracerCodeAccess {
+			var traces []CodeAccessTrace
+			if traces, err = analyzer.retriever.GetCodeAccess(100); err == nil {
+				result, err = analyzer.AnalyzeCodeAccess(100, traces)
+			}
+		} else {
+			var stream TraceStream
+			if stream, err = analyzer.retriever.StreamTrace(100); err == nil {
+				result, err = analyzer.AnalyzeStream(100, stream)
+				stream.Close()
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s analysis failed: %v", tracer, err)
+		}
+		if res := result.Results[deployed]; res == nil || res.Bits.Count() != 5 {
+			t.Fatalf("Unexpected %s result %v", tracer, result.Results)
+		}
+		return result
+	}
+
+	for _, tracer := range []string{TracerCodeAccess, TracerStructLog} {
+		analyze(tracer)
+	}
+	offline.Store(true)
+	for _, tracer := range []string{TracerCodeAccess, TracerStructLog} {
+		analyze(tracer)
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TraceStream yields the transaction traces of a block one at a time, in transaction order,
+// so that only the transactions being analyzed have to be held in memory.
+type TraceStream interface {
+	// Next returns the next transaction trace, or io.EOF once all of them were read
+	Next() (*TransactionTrace, error)
+	Close() error
+}
+
+// ReadAllTraces drains the stream into a slice and closes it
+func ReadAllTraces(stream TraceStream) ([]TransactionTrace, error) {
+	defer stream.Close()
+
+	var traces []TransactionTrace
+	for {
+		tx, err := stream.Next()
+		if errors.Is(err, io.EOF) {
+			return traces, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, *tx)
+	}
+}
+
+// sliceTraceStream streams traces that are already in memory
+type sliceTraceStream struct {
+	traces []TransactionTrace
+	next   int
+}
+
+func NewSliceTraceStream(traces []TransactionTrace) TraceStream {
+	return &sliceTraceStream{traces: traces}
+}
+
+func (s *sliceTraceStream) Next() (*TransactionTrace, error) {
+	if s.next >= len(s.traces) {
+		return nil, io.EOF
+	}
+	s.next++
+	return &s.traces[s.next-1], nil
+}
+
+func (s *sliceTraceStream) Close() error {
+	return nil
+}
+
+// jsonTraceStream decodes the "result" array of a debug_traceBlockByNumber response, or of a trace file
+// with the same shape, one transaction at a time
+type jsonTraceStream struct {
+	dec    *json.Decoder
+	closer io.Closer
+	inside bool // Positioned inside the result array
+	done   bool
+}
+
+func newJSONTraceStream(r io.ReadCloser) *jsonTraceStream {
+	return &jsonTraceStream{
+		dec:    json.NewDecoder(r),
+		closer: r,
+	}
+}
+
+// rpcError is the error member of a JSON-RPC response
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// ErrorCode implements rpc.Error
+func (e *rpcError) ErrorCode() int {
+	return e.Code
+}
+
+func (s *jsonTraceStream) Next() (*TransactionTrace, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	if !s.inside {
+		if err := s.seekResult(); err != nil {
+			return nil, err
+		}
+		s.inside = true
+	}
+
+	if !s.dec.More() {
+		// Consume the closing bracket, the rest of the envelope is of no interest
+		if _, err := s.dec.Token(); err != nil {
+			return nil, fmt.Errorf("failed to decode trace: %w", unexpectedEOF(err))
+		}
+		s.done = true
+		return nil, io.EOF
+	}
+
+	var tx TransactionTrace
+	if err := s.dec.Decode(&tx); err != nil {
+		return nil, fmt.Errorf("failed to decode trace: %w", unexpectedEOF(err))
+	}
+	return &tx, nil
+}
+
+// seekResult moves the decoder to the start of the result array, skipping the other members of the object
+func (s *jsonTraceStream) seekResult() error {
+	if err := s.expectDelim('{'); err != nil {
+		return err
+	}
+	for s.dec.More() {
+		token, err := s.dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to decode trace: %w", unexpectedEOF(err))
+		}
+
+		switch token {
+		case "result":
+			return s.expectDelim('[')
+		case "error":
+			var rpcErr rpcError
+			if err := s.dec.Decode(&rpcErr); err != nil {
+				return fmt.Errorf("failed to decode rpc error: %w", unexpectedEOF(err))
+			}
+			return &rpcErr
+		default:
+			var skipped json.RawMessage
+			if err := s.dec.Decode(&skipped); err != nil {
+				return fmt.Errorf("failed to decode trace: %w", unexpectedEOF(err))
+			}
+		}
+	}
+	return errors.New("trace has no result")
+}
+
+func (s *jsonTraceStream) expectDelim(delim json.Delim) error {
+	token, err := s.dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to decode trace: %w", unexpectedEOF(err))
+	}
+	if token != delim {
+		return fmt.Errorf("failed to decode trace: expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+func (s *jsonTraceStream) Close() error {
+	return s.closer.Close()
+}
+
+// cachingTraceStream writes the traces it yields through to a cache entry, committed once the stream was fully read
+type cachingTraceStream struct {
+	TraceStream
+	entry *CacheEntry
+	count int
+	err   error // First error writing the entry, which is then aborted
+}
+
+func newCachingTraceStream(stream TraceStream, entry *CacheEntry) *cachingTraceStream {
+	s := &cachingTraceStream{TraceStream: stream, entry: entry}
+	_, s.err = io.WriteString(entry, `{"result":[`)
+	return s
+}
+
+func (s *cachingTraceStream) Next() (*TransactionTrace, error) {
+	tx, err := s.TraceStream.Next()
+	if s.entry == nil {
+		return tx, err
+	}
+
+	switch {
+	case errors.Is(err, io.EOF):
+		if s.err == nil {
+			_, s.err = io.WriteString(s.entry, "]}")
+		}
+		if s.err == nil {
+			s.err = s.entry.Commit()
+		} else {
+			s.entry.Abort()
+		}
+		s.entry = nil
+		if s.err != nil {
+			return nil, s.err
+		}
+	case err != nil:
+		s.entry.Abort()
+		s.entry = nil
+	case s.err == nil:
+		if s.count > 0 {
+			_, s.err = io.WriteString(s.entry, ",")
+		}
+		if s.err == nil {
+			s.err = json.NewEncoder(s.entry).Encode(tx)
+		}
+		s.count++
+	}
+	return tx, err
+}
+
+func (s *cachingTraceStream) Close() error {
+	// Not fully read, the entry would be incomplete
+	if s.entry != nil {
+		s.entry.Abort()
+		s.entry = nil
+	}
+	return s.TraceStream.Close()
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testTraceResponse = `{"jsonrpc":"2.0","id":1,"result":[
+	{"txHash":"0xaa","result":{"failed":false,"structLogs":[{"pc":0,"op":"PUSH1","depth":1,"stack":[]}]}},
+	{"txHash":"0xbb","result":{"failed":true,"structLogs":[{"pc":0,"op":"STOP","depth":1,"stack":["0x1"]}]}}
+]}`
+
+func TestJSONTraceStream(t *testing.T) {
+	stream := newJSONTraceStream(io.NopCloser(strings.NewReader(testTraceResponse)))
+
+	first, err := stream.Next()
+	if err != nil {
+		t.Fatalf("Next() failed: %v", err)
+	}
+	if first.TxHash != "0xaa" || len(first.Result.Steps) != 1 || first.Result.Steps[0].Op != "PUSH1" {
+		t.Errorf("Unexpected first trace %+v", first)
+	}
+
+	second, err := stream.Next()
+	if err != nil {
+		t.Fatalf("Next() failed: %v", err)
+	}
+	if second.TxHash != "0xbb" || !second.Result.Failed {
+		t.Errorf("Unexpected second trace %+v", second)
+	}
+
+	for range 2 {
+		if _, err := stream.Next(); !errors.Is(err, io.EOF) {
+			t.Errorf("Expected io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestJSONTraceStream_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "rpc error", body: `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"block not found"}}`},
+		{name: "truncated", body: testTraceResponse[:len(testTraceResponse)/2]},
+		{name: "truncated after a transaction", body: testTraceResponse[:strings.Index(testTraceResponse, "},\n")+1]},
+		{name: "no result", body: `{"jsonrpc":"2.0","id":1}`},
+		{name: "null result", body: `{"jsonrpc":"2.0","id":1,"result":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadAllTraces(newJSONTraceStream(io.NopCloser(strings.NewReader(tt.body))))
+			if err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestCachingTraceStream(t *testing.T) {
+	tempDir := t.TempDir()
+	cache := NewTraceCache(tempDir, 0)
+
+	// A stream that isn't fully read leaves no entry behind
+	entry, err := cache.Create("block_1_trace")
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	stream := newCachingTraceStream(newJSONTraceStream(io.NopCloser(strings.NewReader(testTraceResponse))), entry)
+	if _, err := stream.Next(); err != nil {
+		t.Fatalf("Next() failed: %v", err)
+	}
+	stream.Close()
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no cache file, got %v", entries)
+	}
+
+	// A fully read stream is committed, and reads back the same
+	entry, err = cache.Create("block_1_trace")
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	stream = newCachingTraceStream(newJSONTraceStream(io.NopCloser(strings.NewReader(testTraceResponse))), entry)
+	traces, err := ReadAllTraces(stream)
+	if err != nil {
+		t.Fatalf("ReadAllTraces() failed: %v", err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("Expected 2 traces, got %d", len(traces))
+	}
+
+	cached, err := NewTraceRetriever(nil, tempDir, cache).GetTrace(1)
+	if err != nil {
+		t.Fatalf("GetTrace() failed: %v", err)
+	}
+	if len(cached) != 2 || cached[0].TxHash != "0xaa" || cached[1].TxHash != "0xbb" || !cached[1].Result.Failed {
+		t.Errorf("Unexpected cached traces %+v", cached)
+	}
+}
@@ -0,0 +1,106 @@
+// Package treekey maps accessed code chunks onto the stateless tree layouts of
+// EIP-6800 (verkle) and EIP-7864 (binary trie).
+//
+// Both layouts place the first 128 code chunks in the account header stem,
+// next to the basic data and code hash leaves. Every following group of 256
+// chunks lives in its own stem, so the number of stems touched is what drives
+// the proof size and the witness gas, rather than the raw chunk count.
+package treekey
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie/utils"
+	"github.com/holiman/uint256"
+)
+
+const (
+	// CodeOffset is the sub index of the first code chunk in the header stem.
+	CodeOffset = 128
+	// StemWidth is the number of leaves under a single stem.
+	StemWidth = 256
+	// HeaderCodeChunks is the number of code chunks stored in the header stem.
+	HeaderCodeChunks = StemWidth - CodeOffset
+	// StemSize is the length of a stem in bytes, the tree key without its sub index.
+	StemSize = 31
+)
+
+type Scheme string
+
+const (
+	Verkle Scheme = "verkle" // EIP-6800
+	Binary Scheme = "binary" // EIP-7864
+)
+
+// ChunkIndex returns the tree index and sub index of the given code chunk.
+// Tree index 0 is the account header stem.
+func ChunkIndex(chunk uint64) (treeIndex uint64, subIndex byte) {
+	pos := CodeOffset + chunk
+	return pos / StemWidth, byte(pos % StemWidth)
+}
+
+// CodeChunkKey returns the tree key of the given code chunk of an account.
+func CodeChunkKey(scheme Scheme, addr common.Address, chunk uint64) ([]byte, error) {
+	switch scheme {
+	case Verkle:
+		return utils.CodeChunkKey(addr.Bytes(), uint256.NewInt(chunk)), nil
+	case Binary:
+		treeIndex, subIndex := ChunkIndex(chunk)
+		return binaryTreeKey(addr, treeIndex, subIndex), nil
+	default:
+		return nil, fmt.Errorf("unknown tree scheme %q", scheme)
+	}
+}
+
+// CodeChunkKeys returns the tree keys of all the given code chunks of an account.
+func CodeChunkKeys(scheme Scheme, addr common.Address, chunks []uint32) ([][]byte, error) {
+	keys := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		key, err := CodeChunkKey(scheme, addr, uint64(chunk))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// binaryTreeKey computes the EIP-7864 key: hash(zero12 || address || treeIndex LE)[:31] || subIndex.
+func binaryTreeKey(addr common.Address, treeIndex uint64, subIndex byte) []byte {
+	var input [64]byte
+	copy(input[12:32], addr.Bytes())
+	binary.LittleEndian.PutUint64(input[32:40], treeIndex)
+
+	hash := sha256.Sum256(input[:])
+	key := make([]byte, StemSize+1)
+	copy(key, hash[:StemSize])
+	key[StemSize] = subIndex
+	return key
+}
+
+// Stems summarises the stems touched by the accessed code chunks of a single account.
+type Stems struct {
+	Count     int  // Number of distinct stems
+	HeaderHit bool // Whether any chunk lives in the account header stem
+}
+
+// CountStems counts the distinct stems touched by the given accessed chunks.
+// The stem of a chunk only depends on its tree index, so no hashing is needed.
+func CountStems(chunks []uint32) Stems {
+	var stems Stems
+	seen := make(map[uint64]struct{})
+	for _, chunk := range chunks {
+		treeIndex, _ := ChunkIndex(uint64(chunk))
+		if treeIndex == 0 {
+			stems.HeaderHit = true
+		}
+		if _, ok := seen[treeIndex]; !ok {
+			seen[treeIndex] = struct{}{}
+			stems.Count++
+		}
+	}
+	return stems
+}
@@ -0,0 +1,93 @@
+package treekey
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestChunkIndex(t *testing.T) {
+	tests := []struct {
+		chunk             uint64
+		expectedTreeIndex uint64
+		expectedSubIndex  byte
+	}{
+		{chunk: 0, expectedTreeIndex: 0, expectedSubIndex: 128},
+		{chunk: 127, expectedTreeIndex: 0, expectedSubIndex: 255},
+		{chunk: 128, expectedTreeIndex: 1, expectedSubIndex: 0},
+		{chunk: 383, expectedTreeIndex: 1, expectedSubIndex: 255},
+		{chunk: 384, expectedTreeIndex: 2, expectedSubIndex: 0},
+	}
+
+	for _, tt := range tests {
+		treeIndex, subIndex := ChunkIndex(tt.chunk)
+		if treeIndex != tt.expectedTreeIndex || subIndex != tt.expectedSubIndex {
+			t.Errorf("ChunkIndex(%d) = (%d, %d), expected (%d, %d)",
+				tt.chunk, treeIndex, subIndex, tt.expectedTreeIndex, tt.expectedSubIndex)
+		}
+	}
+}
+
+func TestCountStems(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []uint32
+		expected Stems
+	}{
+		{
+			name:     "no chunks",
+			chunks:   nil,
+			expected: Stems{},
+		},
+		{
+			name:     "header stem only",
+			chunks:   []uint32{0, 1, 127},
+			expected: Stems{Count: 1, HeaderHit: true},
+		},
+		{
+			name:     "header and first code stem",
+			chunks:   []uint32{5, 128},
+			expected: Stems{Count: 2, HeaderHit: true},
+		},
+		{
+			name:     "code stems without header",
+			chunks:   []uint32{128, 383, 384, 700},
+			expected: Stems{Count: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CountStems(tt.chunks); got != tt.expected {
+				t.Errorf("CountStems() = %+v, expected %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCodeChunkKey_SharedStem(t *testing.T) {
+	addr := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	for _, scheme := range []Scheme{Verkle, Binary} {
+		t.Run(string(scheme), func(t *testing.T) {
+			keys, err := CodeChunkKeys(scheme, addr, []uint32{0, 127, 128})
+			if err != nil {
+				t.Fatalf("CodeChunkKeys() failed: %v", err)
+			}
+			if !bytes.Equal(keys[0][:StemSize], keys[1][:StemSize]) {
+				t.Error("chunks 0 and 127 should share the header stem")
+			}
+			if bytes.Equal(keys[1][:StemSize], keys[2][:StemSize]) {
+				t.Error("chunk 128 should not live in the header stem")
+			}
+			if keys[0][StemSize] != CodeOffset || keys[2][StemSize] != 0 {
+				t.Errorf("unexpected sub indices %d, %d", keys[0][StemSize], keys[2][StemSize])
+			}
+		})
+	}
+
+	if _, err := CodeChunkKey("unknown", addr, 0); err == nil {
+		t.Error("expected error for unknown scheme")
+	}
+}
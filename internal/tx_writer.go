@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var txResultHeader = []string{"block_number", "tx_hash", "tx_index", "tx_type", "address", "bytecode_size", "chunks_data", "code_size_count", "code_copy_count", "code_copy_data", "stems_count", "header_stem", "witness_gas", "code_type", "initcode_hash"}
+
+// TxResultWriter writes one row per (transaction, contract) with the contract's own bitmap and counters,
+// before any merging into the block view.
+type TxResultWriter struct {
+	file     *os.File
+	writer   *csv.Writer
+	filePath string
+}
+
+func NewTxResultWriter(dir string, id int) *TxResultWriter {
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		panic(fmt.Errorf("failed to create directory: %w", err))
+	}
+	return &TxResultWriter{
+		filePath: filepath.Join(dir, fmt.Sprintf("tx-analysis-%d.csv", id)),
+	}
+}
+
+func (w *TxResultWriter) Write(blockNum uint64, txs []TxResult) error {
+	if w.file == nil {
+		file, writer, err := openCSV(w.filePath, txResultHeader)
+		if err != nil {
+			return fmt.Errorf("failed to initialize file: %w", err)
+		}
+		w.file, w.writer = file, writer
+	}
+
+	for _, tx := range txs {
+		for address, result := range tx.Results {
+			stems := result.Stems()
+			record := []string{
+				strconv.FormatUint(blockNum, 10), // block number
+				tx.TxHash,                        // tx hash
+				strconv.Itoa(tx.TxIndex),         // tx index
+				strconv.Itoa(int(tx.TxType)),     // tx type
+				address.Hex(),                    // address
+				strconv.FormatUint(uint64(result.Bits.Size()), 10), // bytecode size
+				result.Bits.EncodeChunks(),                         // encoded chunks data
+				strconv.Itoa(result.CodeSizeCount),                 // code size count
+				strconv.Itoa(result.CodeCopyCount),                 // code copy count
+				encodeCopyChunks(result.CopyBits),                  // encoded code copy data
+				strconv.Itoa(stems.Count),                          // stems count
+				strconv.FormatBool(stems.HeaderHit),                // header stem accessed
+				strconv.FormatUint(result.WitnessGas, 10),          // simulated witness gas
+				codeTypeRuntime,                                    // code type
+				"",                                                 // initcode hash
+			}
+
+			if err := w.writer.Write(record); err != nil {
+				return fmt.Errorf("failed to write CSV record: %w", err)
+			}
+		}
+
+		for hash, result := range tx.InitCodes {
+			record := []string{
+				strconv.FormatUint(blockNum, 10), // block number
+				tx.TxHash,                        // tx hash
+				strconv.Itoa(tx.TxIndex),         // tx index
+				strconv.Itoa(int(tx.TxType)),     // tx type
+				"",                               // address
+				strconv.FormatUint(uint64(result.Bits.Size()), 10), // initcode size
+				result.Bits.EncodeChunks(),                         // encoded chunks data
+				strconv.Itoa(result.CodeSizeCount),                 // code size count
+				strconv.Itoa(result.CodeCopyCount),                 // code copy count
+				encodeCopyChunks(result.CopyBits),                  // encoded code copy data
+				"0",                                                // stems count
+				strconv.FormatBool(false),                          // header stem accessed
+				"0",                                                // simulated witness gas
+				codeTypeInitCode,                                   // code type
+				hash.Hex(),                                         // initcode hash
+			}
+
+			if err := w.writer.Write(record); err != nil {
+				return fmt.Errorf("failed to write CSV record: %w", err)
+			}
+		}
+	}
+
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		return fmt.Errorf("failed to flush CSV writer: %w", err)
+	}
+
+	return nil
+}
+
+// WriteBlock writes the rows of every transaction of the block, flushed as they are written
+func (w *TxResultWriter) WriteBlock(result BlockResult) error {
+	return w.Write(result.BlockNum, result.Txs)
+}
+
+// Flush syncs the CSV file to disk, for the rows written so far to survive a crash of the machine
+func (w *TxResultWriter) Flush() error {
+	return syncCSV(w.file, w.writer)
+}
+
+// Files returns the names of the files written, relative to the result directory
+func (w *TxResultWriter) Files() []string {
+	return []string{filepath.Base(w.filePath)}
+}
+
+// Close closes the CSV file and writer safely
+func (w *TxResultWriter) Close() error {
+	if err := closeCSV(w.file, w.writer); err != nil {
+		return err
+	}
+	w.file = nil
+	w.writer = nil
+	return nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTxResultWriter_Write(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewTxResultWriter(tempDir, 0)
+	defer writer.Close()
+
+	addr := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bits1 := NewBitSet(100, 32)
+	bits1.Set(0)
+	bits2 := NewBitSet(100, 32)
+	bits2.Set(1).Set(2)
+
+	txs := []TxResult{
+		{
+			TxHash:  "0xaa",
+			TxIndex: 0,
+			Results: map[common.Address]*TraceResult{
+				addr: {Addr: addr, Bits: bits1, CodeSizeCount: 1, WitnessGas: 200},
+			},
+		},
+		{
+			TxHash:  "0xbb",
+			TxIndex: 1,
+			TxType:  2,
+			Results: map[common.Address]*TraceResult{
+				addr: {Addr: addr, Bits: bits2, CodeCopyCount: 2, WitnessGas: 200},
+			},
+		},
+	}
+
+	if err := writer.Write(5, txs); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(tempDir, "tx-analysis-0.csv"))
+	if err != nil {
+		t.Fatalf("Failed to open CSV file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 rows (header + 2 data), got %d", len(records))
+	}
+
+	if !equalSlices(records[0], txResultHeader) {
+		t.Errorf("Header mismatch. Expected %v, got %v", txResultHeader, records[0])
+	}
+
+	expected := [][]string{
+		{"5", "0xaa", "0", "0", addr.Hex(), "100", bits1.EncodeChunks(), "1", "0", "", "1", "true", "200", "runtime", ""},
+		{"5", "0xbb", "1", "2", addr.Hex(), "100", bits2.EncodeChunks(), "0", "2", "", "1", "true", "200", "runtime", ""},
+	}
+	for i, expectedData := range expected {
+		if !equalSlices(records[i+1], expectedData) {
+			t.Errorf("Data row %d mismatch. Expected %v, got %v", i, expectedData, records[i+1])
+		}
+	}
+}
+
+func TestMergeTxResults(t *testing.T) {
+	addr := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bits1 := NewBitSet(100, 32)
+	bits1.Set(0)
+	bits2 := NewBitSet(100, 32)
+	bits2.Set(50)
+
+	txs := []TxResult{
+		{Results: map[common.Address]*TraceResult{addr: {Addr: addr, Bits: bits1, CodeSizeCount: 1, WitnessGas: 200}}},
+		{Results: map[common.Address]*TraceResult{addr: {Addr: addr, Bits: bits2, CodeCopyCount: 1, WitnessGas: 200}}},
+	}
+
+	merged, _ := MergeTxResults(txs)
+	res, ok := merged[addr]
+	if !ok {
+		t.Fatal("merged result missing address")
+	}
+	if res.Bits.Count() != 2 || res.CodeSizeCount != 1 || res.CodeCopyCount != 1 || res.WitnessGas != 400 {
+		t.Errorf("unexpected merged result: count=%d codeSize=%d codeCopy=%d gas=%d",
+			res.Bits.Count(), res.CodeSizeCount, res.CodeCopyCount, res.WitnessGas)
+	}
+
+	// The per-transaction bitmaps must not be modified by the merge
+	if bits1.Count() != 1 || bits2.Count() != 1 {
+		t.Error("MergeTxResults modified the per-transaction bitmaps")
+	}
+}
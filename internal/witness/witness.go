@@ -0,0 +1,114 @@
+// Package witness simulates the EIP-4762 gas charged for code access in a
+// stateless Ethereum.
+//
+// Access events are tracked per transaction: the first access to a stem in a
+// transaction pays the branch cost, the first access to a leaf pays the chunk
+// cost, and later accesses within the same transaction are warm and free.
+package witness
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/weiihann/chunk-analysis/internal/treekey"
+)
+
+// Schedule is a set of witness gas parameters
+type Schedule struct {
+	Name       string `json:"name"`
+	BranchCost uint64 `json:"branch_cost"` // Charged for the first access to a stem
+	ChunkCost  uint64 `json:"chunk_cost"`  // Charged for the first access to a code chunk leaf
+}
+
+// ScheduleSet holds parameter tables, keyed by lowercase name
+type ScheduleSet map[string]Schedule
+
+// Schedules holds the built-in parameter tables. Other proposals are compared by loading them from a file.
+var Schedules = ScheduleSet{
+	"eip4762": {
+		Name:       "eip4762",
+		BranchCost: 1900, // WITNESS_BRANCH_COST
+		ChunkCost:  200,  // WITNESS_CHUNK_COST
+	},
+}
+
+// DefaultSchedule is the schedule used when none is configured
+const DefaultSchedule = "eip4762"
+
+// LookupSchedule returns the built-in schedule with the given name
+func LookupSchedule(name string) (Schedule, error) {
+	return Schedules.Lookup(name)
+}
+
+// ScheduleNames returns the sorted names of all built-in schedules
+func ScheduleNames() []string {
+	return Schedules.Names()
+}
+
+// Lookup returns the schedule with the given name
+func (s ScheduleSet) Lookup(name string) (Schedule, error) {
+	schedule, ok := s[strings.ToLower(name)]
+	if !ok {
+		return Schedule{}, fmt.Errorf("unknown gas schedule %q, must be one of: %s", name, strings.Join(s.Names(), ", "))
+	}
+	return schedule, nil
+}
+
+// Names returns the sorted names of the schedules
+func (s ScheduleSet) Names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ReadSchedules returns the built-in schedules along with those of the JSON file at path, a list of objects
+// with a name, branch_cost and chunk_cost. The built-in schedules can't be redefined. An empty path only
+// returns the built-in ones.
+func ReadSchedules(path string) (ScheduleSet, error) {
+	schedules := maps.Clone(Schedules)
+	if path == "" {
+		return schedules, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gas schedules: %w", err)
+	}
+	var loaded []Schedule
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to decode gas schedules %s: %w", path, err)
+	}
+
+	for _, schedule := range loaded {
+		key := strings.ToLower(schedule.Name)
+		if key == "" {
+			return nil, fmt.Errorf("gas schedule without a name in %s", path)
+		}
+		if _, ok := schedules[key]; ok {
+			return nil, fmt.Errorf("gas schedule %q of %s is already defined", schedule.Name, path)
+		}
+		schedules[key] = schedule
+	}
+	return schedules, nil
+}
+
+// CodeAccessGas returns the gas charged for accessing the given code chunks of a single
+// contract within a transaction, assuming all of them start cold.
+//
+// The header stem is not charged a branch cost: calling the contract already touches its
+// basic data leaf, so the header branch is warm by the time any code is read.
+func (s Schedule) CodeAccessGas(chunks []uint32) uint64 {
+	stems := treekey.CountStems(chunks)
+	branches := stems.Count
+	if stems.HeaderHit {
+		branches--
+	}
+	return uint64(branches)*s.BranchCost + uint64(len(chunks))*s.ChunkCost
+}
@@ -0,0 +1,99 @@
+package witness
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCodeAccessGas(t *testing.T) {
+	schedule := Schedules[DefaultSchedule]
+
+	tests := []struct {
+		name     string
+		chunks   []uint32
+		expected uint64
+	}{
+		{
+			name:     "no chunks",
+			chunks:   nil,
+			expected: 0,
+		},
+		{
+			name:     "header stem chunks only",
+			chunks:   []uint32{0, 1, 2},
+			expected: 3 * 200,
+		},
+		{
+			name:     "header and one code stem",
+			chunks:   []uint32{0, 128, 129},
+			expected: 1900 + 3*200,
+		},
+		{
+			name:     "two code stems",
+			chunks:   []uint32{200, 400},
+			expected: 2*1900 + 2*200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := schedule.CodeAccessGas(tt.chunks); got != tt.expected {
+				t.Errorf("CodeAccessGas() = %d, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLookupSchedule(t *testing.T) {
+	if _, err := LookupSchedule("EIP4762"); err != nil {
+		t.Errorf("LookupSchedule() failed: %v", err)
+	}
+	if _, err := LookupSchedule("unknown"); err == nil {
+		t.Error("expected error for unknown schedule")
+	}
+}
+
+func TestReadSchedules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "schedules.json")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write schedules: %v", err)
+		}
+		return path
+	}
+
+	schedules, err := ReadSchedules("")
+	if err != nil || len(schedules) != len(Schedules) {
+		t.Fatalf("Expected the built-in schedules, got %v (%v)", schedules, err)
+	}
+
+	schedules, err = ReadSchedules(write(`[{"name": "Cheap-Chunks", "branch_cost": 1900, "chunk_cost": 100}]`))
+	if err != nil {
+		t.Fatalf("ReadSchedules() failed: %v", err)
+	}
+	schedule, err := schedules.Lookup("cheap-chunks")
+	if err != nil || schedule.BranchCost != 1900 || schedule.ChunkCost != 100 {
+		t.Errorf("Unexpected schedule %+v (%v)", schedule, err)
+	}
+	if _, err := schedules.Lookup(DefaultSchedule); err != nil {
+		t.Errorf("Expected the default schedule to still be there, got %v", err)
+	}
+	if _, err := LookupSchedule("cheap-chunks"); err == nil {
+		t.Error("Expected the built-in schedules to be left as is")
+	}
+
+	for _, content := range []string{
+		`[{"name": "EIP4762", "branch_cost": 1, "chunk_cost": 1}]`,
+		`[{"branch_cost": 1, "chunk_cost": 1}]`,
+		`{"name": "eip4762"}`,
+	} {
+		if _, err := ReadSchedules(write(content)); err == nil {
+			t.Errorf("Expected ReadSchedules() to reject %s", content)
+		}
+	}
+	if _, err := ReadSchedules(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected ReadSchedules() to fail on a missing file")
+	}
+}
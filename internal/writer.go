@@ -3,39 +3,68 @@ package internal
 import (
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/weiihann/chunk-analysis/internal/treekey"
+)
+
+var (
+	resultHeader = []string{"block_number", "address", "bytecode_size", "chunks_data", "code_size_count", "code_copy_count", "code_copy_data", "stems_count", "header_stem", "witness_gas", "code_type", "initcode_hash"}
+	blockHeader  = []string{"block_number", "contracts_count", "chunks_count", "stems_count", "header_stems_count", "witness_gas"}
+	txHeader     = []string{"block_number", "tx_hash", "tx_index", "tx_type", "contracts_count", "chunks_count", "stems_count", "witness_gas"}
+)
+
+const (
+	codeTypeRuntime  = "runtime"
+	codeTypeInitCode = "initcode"
 )
 
 type ResultWriter struct {
-	file     *os.File
-	writer   *csv.Writer
-	filePath string
+	file       *os.File
+	writer     *csv.Writer
+	filePath   string
+	chunkSizes []uint32 // Extra chunk sizes to emit columns for, on top of the configured one
+
+	// Per-block summary, written next to the per-contract rows
+	blockFile     *os.File
+	blockWriter   *csv.Writer
+	blockFilePath string
+
+	// Per-transaction breakdown
+	txFile     *os.File
+	txWriter   *csv.Writer
+	txFilePath string
 }
 
-func NewResultWriter(dir string, id int) *ResultWriter {
+func NewResultWriter(dir string, id int, chunkSizes ...uint32) *ResultWriter {
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		panic(fmt.Errorf("failed to create directory: %w", err))
 	}
 	return &ResultWriter{
-		filePath: filepath.Join(dir, fmt.Sprintf("analysis-%d.csv", id)),
+		filePath:      filepath.Join(dir, fmt.Sprintf("analysis-%d.csv", id)),
+		blockFilePath: filepath.Join(dir, fmt.Sprintf("blocks-%d.csv", id)),
+		txFilePath:    filepath.Join(dir, fmt.Sprintf("txs-%d.csv", id)),
+		chunkSizes:    chunkSizes,
 	}
 }
 
 func (w *ResultWriter) Write(blockNum uint64, results map[common.Address]*MergedTraceResult) error {
-	// Initialize the file and CSV writer if not already done
+	// Initialize the files and CSV writers if not already done
 	if w.file == nil {
-		if err := w.initializeFile(); err != nil {
+		if err := w.initializeFiles(); err != nil {
 			return fmt.Errorf("failed to initialize file: %w", err)
 		}
 	}
 
 	// Write each address result to the CSV
 	for address, result := range results {
+		stems := result.Stems()
 		record := []string{
 			strconv.FormatUint(blockNum, 10),                   // block number
 			address.Hex(),                                      // address
@@ -43,6 +72,18 @@ func (w *ResultWriter) Write(blockNum uint64, results map[common.Address]*Merged
 			result.Bits.EncodeChunks(),                         // encoded chunks data
 			strconv.Itoa(result.CodeSizeCount),                 // code size count
 			strconv.Itoa(result.CodeCopyCount),                 // code copy count
+			encodeCopyChunks(result.CopyBits),                  // encoded code copy data
+			strconv.Itoa(stems.Count),                          // stems count
+			strconv.FormatBool(stems.HeaderHit),                // header stem accessed
+			strconv.FormatUint(result.WitnessGas, 10),          // simulated witness gas
+			codeTypeRuntime,                                    // code type
+			"",                                                 // initcode hash
+		}
+		for _, size := range w.chunkSizes {
+			record = append(record,
+				result.Bits.EncodeChunksFor(size),                                      // encoded chunks data
+				strconv.Itoa(treekey.CountStems(result.AccessedChunksFor(size)).Count), // stems count
+			)
 		}
 
 		if err := w.writer.Write(record); err != nil {
@@ -50,87 +91,312 @@ func (w *ResultWriter) Write(blockNum uint64, results map[common.Address]*Merged
 		}
 	}
 
-	// Flush the writer to ensure data is written to disk
+	summary := summarizeBlock(results)
+	blockRecord := []string{
+		strconv.FormatUint(blockNum, 10),           // block number
+		strconv.Itoa(len(results)),                 // contracts count
+		strconv.Itoa(summary.chunksCount),          // chunks count
+		strconv.Itoa(summary.stemsCount),           // stems count
+		strconv.Itoa(summary.headerStemsCount),     // header stems count
+		strconv.FormatUint(summary.witnessGas, 10), // simulated witness gas
+	}
+	if err := w.blockWriter.Write(blockRecord); err != nil {
+		return fmt.Errorf("failed to write block CSV record: %w", err)
+	}
+
+	// Flush the writers to ensure data is written to disk
 	w.writer.Flush()
 	if err := w.writer.Error(); err != nil {
 		return fmt.Errorf("failed to flush CSV writer: %w", err)
 	}
+	w.blockWriter.Flush()
+	if err := w.blockWriter.Error(); err != nil {
+		return fmt.Errorf("failed to flush block CSV writer: %w", err)
+	}
 
 	return nil
 }
 
-func (w *ResultWriter) initializeFile() error {
+// WriteInitCodes writes the initcode executed in a block, flagged as initcode and identified by its hash.
+// Initcode isn't part of the state tree, so it has no stems and no witness gas.
+func (w *ResultWriter) WriteInitCodes(blockNum uint64, initCodes map[common.Hash]*MergedTraceResult) error {
+	if w.file == nil {
+		if err := w.initializeFiles(); err != nil {
+			return fmt.Errorf("failed to initialize file: %w", err)
+		}
+	}
+
+	for hash, result := range initCodes {
+		record := []string{
+			strconv.FormatUint(blockNum, 10), // block number
+			"",                               // address
+			strconv.FormatUint(uint64(result.Bits.Size()), 10), // initcode size
+			result.Bits.EncodeChunks(),                         // encoded chunks data
+			strconv.Itoa(result.CodeSizeCount),                 // code size count
+			strconv.Itoa(result.CodeCopyCount),                 // code copy count
+			encodeCopyChunks(result.CopyBits),                  // encoded code copy data
+			"0",                                                // stems count
+			strconv.FormatBool(false),                          // header stem accessed
+			"0",                                                // simulated witness gas
+			codeTypeInitCode,                                   // code type
+			hash.Hex(),                                         // initcode hash
+		}
+		for _, size := range w.chunkSizes {
+			record = append(record,
+				result.Bits.EncodeChunksFor(size), // encoded chunks data
+				"0",                               // stems count
+			)
+		}
+
+		if err := w.writer.Write(record); err != nil {
+			return fmt.Errorf("failed to write CSV record: %w", err)
+		}
+	}
+
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		return fmt.Errorf("failed to flush CSV writer: %w", err)
+	}
+
+	return nil
+}
+
+// WriteTxs writes the per-transaction breakdown of a block
+func (w *ResultWriter) WriteTxs(blockNum uint64, txs []TxResult) error {
+	if w.file == nil {
+		if err := w.initializeFiles(); err != nil {
+			return fmt.Errorf("failed to initialize file: %w", err)
+		}
+	}
+
+	for _, tx := range txs {
+		summary := summarizeTx(tx)
+		record := []string{
+			strconv.FormatUint(blockNum, 10),      // block number
+			tx.TxHash,                             // tx hash
+			strconv.Itoa(tx.TxIndex),              // tx index
+			strconv.Itoa(int(tx.TxType)),          // tx type
+			strconv.Itoa(summary.contractsCount),  // contracts count
+			strconv.Itoa(summary.chunksCount),     // chunks count
+			strconv.Itoa(summary.stemsCount),      // stems count
+			strconv.FormatUint(tx.WitnessGas, 10), // simulated witness gas
+		}
+
+		if err := w.txWriter.Write(record); err != nil {
+			return fmt.Errorf("failed to write tx CSV record: %w", err)
+		}
+	}
+
+	w.txWriter.Flush()
+	if err := w.txWriter.Error(); err != nil {
+		return fmt.Errorf("failed to flush tx CSV writer: %w", err)
+	}
+
+	return nil
+}
+
+// WriteBlock writes the contract, initcode, block and transaction rows of a block.
+// The rows are flushed as they are written.
+func (w *ResultWriter) WriteBlock(result BlockResult) error {
+	if err := w.Write(result.BlockNum, result.Results); err != nil {
+		return err
+	}
+	if err := w.WriteInitCodes(result.BlockNum, result.InitCodes); err != nil {
+		return err
+	}
+	return w.WriteTxs(result.BlockNum, result.Txs)
+}
+
+// Flush syncs the CSV files to disk. The rows are handed to the OS as they are written, but only survive
+// a crash of the machine once synced, and the checkpoint taken after the flush must not cover lost rows.
+func (w *ResultWriter) Flush() error {
+	if err := syncCSV(w.file, w.writer); err != nil {
+		return err
+	}
+	if err := syncCSV(w.blockFile, w.blockWriter); err != nil {
+		return err
+	}
+	return syncCSV(w.txFile, w.txWriter)
+}
+
+// initializeFiles opens the three CSV files, or none of them if any fails to open
+func (w *ResultWriter) initializeFiles() error {
+	file, writer, err := openCSV(w.filePath, ResultColumns(w.chunkSizes...))
+	if err != nil {
+		return err
+	}
+
+	blockFile, blockWriter, err := openCSV(w.blockFilePath, blockHeader)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	txFile, txWriter, err := openCSV(w.txFilePath, txHeader)
+	if err != nil {
+		file.Close()
+		blockFile.Close()
+		return err
+	}
+
+	w.file, w.writer = file, writer
+	w.blockFile, w.blockWriter = blockFile, blockWriter
+	w.txFile, w.txWriter = txFile, txWriter
+	return nil
+}
+
+// Files returns the names of the files written, relative to the result directory
+func (w *ResultWriter) Files() []string {
+	return []string{filepath.Base(w.filePath), filepath.Base(w.blockFilePath), filepath.Base(w.txFilePath)}
+}
+
+// ResultColumns returns the columns of the result files, with a chunks data and stems count column for every
+// extra chunk size
+func ResultColumns(chunkSizes ...uint32) []string {
+	header := slices.Clone(resultHeader)
+	for _, size := range chunkSizes {
+		header = append(header, fmt.Sprintf("chunks_data_%d", size), fmt.Sprintf("stems_count_%d", size))
+	}
+	return header
+}
+
+// openCSV opens the CSV file at path for appending, creating it with the given header if it doesn't exist.
+// An existing file must have the same header, so that the rows appended line up with its columns.
+func openCSV(path string, header []string) (*os.File, *csv.Writer, error) {
 	// Check if file already exists
 	fileExists := false
-	if _, err := os.Stat(w.filePath); err == nil {
+	if _, err := os.Stat(path); err == nil {
 		fileExists = true
 	}
+	writeHeader := !fileExists
 
 	var file *os.File
 	var err error
 
 	if fileExists {
 		// Open existing file in append mode
-		file, err = os.OpenFile(w.filePath, os.O_WRONLY|os.O_APPEND, 0o644)
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
 		if err != nil {
-			return fmt.Errorf("failed to open existing file: %w", err)
+			return nil, nil, fmt.Errorf("failed to open existing file: %w", err)
 		}
 
 		// Ensure the file ends with a newline before appending
 		// Check if file is empty or doesn't end with newline
 		stat, err := file.Stat()
 		if err != nil {
-			return fmt.Errorf("failed to get file stats: %w", err)
+			return nil, nil, fmt.Errorf("failed to get file stats: %w", err)
+		}
+
+		if stat.Size() == 0 {
+			writeHeader = true
+		} else {
+			existing, err := csv.NewReader(io.NewSectionReader(file, 0, stat.Size())).Read()
+			if err != nil {
+				file.Close()
+				return nil, nil, fmt.Errorf("failed to read the header of %s: %w", path, err)
+			}
+			if !slices.Equal(existing, header) {
+				file.Close()
+				return nil, nil, fmt.Errorf("%s has columns %v, expected %v", path, existing, header)
+			}
 		}
 
+		last := make([]byte, 1)
 		if stat.Size() > 0 {
+			if _, err := file.ReadAt(last, stat.Size()-1); err != nil {
+				return nil, nil, fmt.Errorf("failed to read file end: %w", err)
+			}
+		}
+
+		if stat.Size() > 0 && last[0] != '\n' {
 			// Write a newline to ensure proper separation
 			if _, err := file.Write([]byte("\n")); err != nil {
-				return fmt.Errorf("failed to write newline separator: %w", err)
+				return nil, nil, fmt.Errorf("failed to write newline separator: %w", err)
 			}
 		}
 	} else {
 		// Create new file
-		file, err = os.Create(w.filePath)
+		file, err = os.Create(path)
 		if err != nil {
-			return fmt.Errorf("failed to create file: %w", err)
+			return nil, nil, fmt.Errorf("failed to create file: %w", err)
 		}
 	}
 
-	w.file = file
-	w.writer = csv.NewWriter(file)
-	w.writer.UseCRLF = false
+	writer := csv.NewWriter(file)
+	writer.UseCRLF = false
 
 	// Write header row only for new files
-	if !fileExists {
-		header := []string{"block_number", "address", "bytecode_size", "chunks_data", "code_size_count", "code_copy_count"}
-		if err := w.writer.Write(header); err != nil {
-			return fmt.Errorf("failed to write header: %w", err)
+	if writeHeader {
+		if err := writer.Write(header); err != nil {
+			return nil, nil, fmt.Errorf("failed to write header: %w", err)
 		}
-		w.writer.Flush()
-		if err := w.writer.Error(); err != nil {
-			return fmt.Errorf("failed to flush header: %w", err)
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return nil, nil, fmt.Errorf("failed to flush header: %w", err)
 		}
 	}
 
-	return nil
+	return file, writer, nil
 }
 
-// Close closes the CSV file and writer safely
+// encodeCopyChunks encodes the bytes copied by CODECOPY/EXTCODECOPY, or an empty string if none were recorded
+func encodeCopyChunks(bits *BitSet) string {
+	if bits == nil {
+		return ""
+	}
+	return bits.EncodeChunks()
+}
+
+// Close closes the CSV files and writers safely
 func (w *ResultWriter) Close() error {
-	if w.writer != nil {
-		w.writer.Flush()
-		if err := w.writer.Error(); err != nil {
+	if err := closeCSV(w.file, w.writer); err != nil {
+		return err
+	}
+	w.file = nil
+	w.writer = nil
+
+	if err := closeCSV(w.blockFile, w.blockWriter); err != nil {
+		return err
+	}
+	w.blockFile = nil
+	w.blockWriter = nil
+
+	if err := closeCSV(w.txFile, w.txWriter); err != nil {
+		return err
+	}
+	w.txFile = nil
+	w.txWriter = nil
+
+	return nil
+}
+
+// syncCSV flushes the writer and syncs its file to disk, if it was opened
+func syncCSV(file *os.File, writer *csv.Writer) error {
+	if writer == nil {
+		return nil
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to flush CSV writer: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+	}
+	return nil
+}
+
+func closeCSV(file *os.File, writer *csv.Writer) error {
+	if writer != nil {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
 			return fmt.Errorf("failed to flush writer on close: %w", err)
 		}
 	}
 
-	if w.file != nil {
-		if err := w.file.Close(); err != nil {
+	if file != nil {
+		if err := file.Close(); err != nil {
 			return fmt.Errorf("failed to close file: %w", err)
 		}
-		w.file = nil
-		w.writer = nil
 	}
 
 	return nil
@@ -36,12 +36,15 @@ func TestResultWriter_Write_SingleResult(t *testing.T) {
 	// Create test data
 	blockNum := uint64(12345)
 	addr := common.HexToAddress("0x1234567890123456789012345678901234567890")
-	bitSet := NewBitSet(100)
+	bitSet := NewBitSet(100, 32)
 	bitSet.Set(10).Set(20).Set(30)
+	copyBits := NewBitSet(100, 32)
+	copyBits.SetRange(40, 72)
 
 	results := map[common.Address]*MergedTraceResult{
 		addr: {
 			Bits:          bitSet,
+			CopyBits:      copyBits,
 			CodeSizeCount: 5,
 			CodeCopyCount: 1,
 		},
@@ -78,13 +81,13 @@ func TestResultWriter_Write_SingleResult(t *testing.T) {
 	}
 
 	// Verify header
-	expectedHeader := []string{"block_number", "address", "bytecode_size", "chunks_data", "code_size_count", "code_copy_count"}
+	expectedHeader := []string{"block_number", "address", "bytecode_size", "chunks_data", "code_size_count", "code_copy_count", "code_copy_data", "stems_count", "header_stem", "witness_gas", "code_type", "initcode_hash"}
 	if !equalSlices(records[0], expectedHeader) {
 		t.Errorf("Header mismatch. Expected %v, got %v", expectedHeader, records[0])
 	}
 
 	// Verify data row
-	expectedData := []string{"12345", strings.ToLower(addr.Hex()), strconv.Itoa(int(bitSet.Size())), bitSet.EncodeChunks(), "5", "1"}
+	expectedData := []string{"12345", strings.ToLower(addr.Hex()), strconv.Itoa(int(bitSet.Size())), bitSet.EncodeChunks(), "5", "1", copyBits.EncodeChunks(), "1", "true", "0", "runtime", ""}
 	if !equalSlices(records[1], expectedData) {
 		t.Errorf("Data row mismatch. Expected %v, got %v", expectedData, records[1])
 	}
@@ -99,11 +102,11 @@ func TestResultWriter_Write_MultipleResults(t *testing.T) {
 
 	// Create multiple test addresses with different data
 	addr1 := common.HexToAddress("0x1111111111111111111111111111111111111111")
-	bitSet1 := NewBitSet(50)
+	bitSet1 := NewBitSet(50, 32)
 	bitSet1.Set(0).Set(1).Set(2)
 
 	addr2 := common.HexToAddress("0x2222222222222222222222222222222222222222")
-	bitSet2 := NewBitSet(200)
+	bitSet2 := NewBitSet(200, 32)
 	bitSet2.Set(10).Set(50).Set(100).Set(150)
 
 	results := map[common.Address]*MergedTraceResult{
@@ -167,7 +170,7 @@ func TestResultWriter_Write_MultipleCalls(t *testing.T) {
 	defer writer.Close()
 
 	addr := common.HexToAddress("0x3333333333333333333333333333333333333333")
-	bitSet := NewBitSet(10)
+	bitSet := NewBitSet(10, 32)
 	bitSet.Set(5)
 
 	results := map[common.Address]*MergedTraceResult{
@@ -254,7 +257,7 @@ func TestResultWriter_Close(t *testing.T) {
 	// Write some data first
 	blockNum := uint64(123)
 	addr := common.HexToAddress("0x4444444444444444444444444444444444444444")
-	bitSet := NewBitSet(10)
+	bitSet := NewBitSet(10, 32)
 	bitSet.Set(1)
 
 	results := map[common.Address]*MergedTraceResult{
@@ -316,7 +319,7 @@ func TestResultWriter_DirectoryCreation(t *testing.T) {
 
 	blockNum := uint64(1)
 	addr := common.HexToAddress("0x6666666666666666666666666666666666666666")
-	bitSet := NewBitSet(5)
+	bitSet := NewBitSet(5, 32)
 	bitSet.Set(0)
 
 	results := map[common.Address]*MergedTraceResult{
@@ -352,7 +355,7 @@ func TestResultWriter_LargeData(t *testing.T) {
 	blockNum := uint64(1)
 
 	// Create a large bitset
-	bitSet := NewBitSet(1000)
+	bitSet := NewBitSet(1000, 32)
 	for i := uint64(0); i < 500; i++ {
 		bitSet.Set(uint32(i))
 	}
@@ -390,12 +393,232 @@ func TestResultWriter_LargeData(t *testing.T) {
 	}
 
 	// Verify the large numbers were written correctly
-	expectedData := []string{"1", strings.ToLower(addr.Hex()), strconv.Itoa(int(bitSet.Size())), bitSet.EncodeChunks(), "999", "0", "0"}
+	expectedData := []string{"1", strings.ToLower(addr.Hex()), strconv.Itoa(int(bitSet.Size())), bitSet.EncodeChunks(), "999", "0", "", "1", "true", "0", "runtime", ""}
 	if !equalSlices(records[1], expectedData) {
 		t.Errorf("Large data row mismatch. Expected %v, got %v", expectedData, records[1])
 	}
 }
 
+func TestResultWriter_Write_BlockSummary(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewResultWriter(tempDir, 0)
+	defer writer.Close()
+
+	blockNum := uint64(42)
+
+	// Touches the header stem only
+	addr1 := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bitSet1 := NewBitSet(100, 32)
+	bitSet1.Set(0)
+
+	// Touches the header stem through execution and a later stem through CODECOPY
+	addr2 := common.HexToAddress("0x2222222222222222222222222222222222222222")
+	bitSet2 := NewBitSet(maxContractBytes, 32)
+	bitSet2.Set(0)
+	copyBits2 := NewBitSet(maxContractBytes, 32)
+	copyBits2.Set(maxContractBytes - 1)
+
+	results := map[common.Address]*MergedTraceResult{
+		addr1: {Bits: bitSet1, WitnessGas: 200},
+		addr2: {Bits: bitSet2, CopyBits: copyBits2, WitnessGas: 2300},
+	}
+
+	if err := writer.Write(blockNum, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(tempDir, "blocks-0.csv"))
+	if err != nil {
+		t.Fatalf("Failed to open block CSV file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 rows (header + data), got %d", len(records))
+	}
+
+	expectedHeader := []string{"block_number", "contracts_count", "chunks_count", "stems_count", "header_stems_count", "witness_gas"}
+	if !equalSlices(records[0], expectedHeader) {
+		t.Errorf("Header mismatch. Expected %v, got %v", expectedHeader, records[0])
+	}
+
+	expectedData := []string{"42", "2", "3", "3", "2", "2500"}
+	if !equalSlices(records[1], expectedData) {
+		t.Errorf("Data row mismatch. Expected %v, got %v", expectedData, records[1])
+	}
+}
+
+func TestResultWriter_WriteTxs(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewResultWriter(tempDir, 0)
+	defer writer.Close()
+
+	addr := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bitSet := NewBitSet(100, 32)
+	bitSet.Set(0)
+
+	txs := []TxResult{
+		{
+			TxHash:     "0xaa",
+			TxIndex:    0,
+			TxType:     2,
+			Results:    map[common.Address]*TraceResult{addr: {Addr: addr, Bits: bitSet}},
+			WitnessGas: 200,
+		},
+		{
+			TxHash:  "0xbb",
+			TxIndex: 1,
+		},
+	}
+
+	if err := writer.WriteTxs(7, txs); err != nil {
+		t.Fatalf("WriteTxs() failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(tempDir, "txs-0.csv"))
+	if err != nil {
+		t.Fatalf("Failed to open tx CSV file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 rows (header + 2 data), got %d", len(records))
+	}
+
+	expected := [][]string{
+		{"7", "0xaa", "0", "2", "1", "1", "1", "200"},
+		{"7", "0xbb", "1", "0", "0", "0", "0", "0"},
+	}
+	for i, expectedData := range expected {
+		if !equalSlices(records[i+1], expectedData) {
+			t.Errorf("Data row %d mismatch. Expected %v, got %v", i, expectedData, records[i+1])
+		}
+	}
+}
+
+func TestResultWriter_WriteInitCodes(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewResultWriter(tempDir, 0)
+	defer writer.Close()
+
+	hash := common.HexToHash("0xabcdef")
+	bitSet := NewInitCodeBitSet(30000, 32)
+	bitSet.Set(0).Set(29999)
+
+	initCodes := map[common.Hash]*MergedTraceResult{
+		hash: {Bits: bitSet, CodeCopyCount: 1},
+	}
+
+	if err := writer.WriteInitCodes(9, initCodes); err != nil {
+		t.Fatalf("WriteInitCodes() failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(tempDir, "analysis-0.csv"))
+	if err != nil {
+		t.Fatalf("Failed to open CSV file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 rows (header + data), got %d", len(records))
+	}
+
+	expectedData := []string{"9", "", "30000", bitSet.EncodeChunks(), "0", "1", "", "0", "false", "0", "initcode", hash.Hex()}
+	if !equalSlices(records[1], expectedData) {
+		t.Errorf("Data row mismatch. Expected %v, got %v", expectedData, records[1])
+	}
+}
+
+func TestResultWriter_Write_ChunkSizes(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewResultWriter(tempDir, 0, 24, 64)
+	defer writer.Close()
+
+	addr := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bitSet := NewBitSet(100, 32)
+	bitSet.SetRange(20, 30)
+
+	results := map[common.Address]*MergedTraceResult{
+		addr: {Bits: bitSet},
+	}
+
+	if err := writer.Write(1, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(tempDir, "analysis-0.csv"))
+	if err != nil {
+		t.Fatalf("Failed to open CSV file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+
+	header := records[0]
+	expectedExtra := []string{"chunks_data_24", "stems_count_24", "chunks_data_64", "stems_count_64"}
+	if !equalSlices(header[len(header)-4:], expectedExtra) {
+		t.Errorf("Header mismatch. Expected extra columns %v, got %v", expectedExtra, header)
+	}
+
+	row := records[1]
+	expectedData := []string{bitSet.EncodeChunksFor(24), "1", bitSet.EncodeChunksFor(64), "1"}
+	if !equalSlices(row[len(row)-4:], expectedData) {
+		t.Errorf("Data mismatch. Expected extra columns %v, got %v", expectedData, row)
+	}
+	if bitSet.EncodeChunksFor(24) == bitSet.EncodeChunksFor(64) {
+		t.Error("Expected different encodings for different chunk sizes")
+	}
+}
+
+// Appending to a result file of other columns fails, instead of writing rows that don't line up
+func TestResultWriter_HeaderMismatch(t *testing.T) {
+	tempDir := t.TempDir()
+	results := map[common.Address]*MergedTraceResult{
+		common.HexToAddress("0x1111111111111111111111111111111111111111"): {Bits: NewBitSet(100, 32)},
+	}
+
+	writer := NewResultWriter(tempDir, 0)
+	if err := writer.Write(1, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// The same columns are appended to
+	writer = NewResultWriter(tempDir, 0)
+	if err := writer.Write(2, results); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	writer = NewResultWriter(tempDir, 0, 64)
+	defer writer.Close()
+	if err := writer.Write(3, results); err == nil || !strings.Contains(err.Error(), "has columns") {
+		t.Errorf("Expected a header mismatch error, got %v", err)
+	}
+}
+
 // Helper function to compare string slices
 func equalSlices(a, b []string) bool {
 	if len(a) != len(b) {
@@ -408,3 +631,39 @@ func equalSlices(a, b []string) bool {
 	}
 	return true
 }
+
+func TestResultWriter_OpenFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := NewResultWriter(tempDir, 0)
+	defer writer.Close()
+
+	// The tx file can't be opened, so none of the files is
+	txPath := filepath.Join(tempDir, "txs-0.csv")
+	if err := os.Mkdir(txPath, 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := writer.WriteBlock(BlockResult{BlockNum: 1}); err == nil {
+		t.Fatal("WriteBlock() should fail when a file can't be opened")
+	}
+	if writer.file != nil || writer.blockFile != nil || writer.txFile != nil {
+		t.Error("Expected the files opened before the failure to be closed")
+	}
+
+	// Once the file can be opened, every file is
+	if err := os.Remove(txPath); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if err := writer.WriteBlock(BlockResult{BlockNum: 1, Txs: []TxResult{{TxHash: "0xaa"}}}); err != nil {
+		t.Fatalf("WriteBlock() failed: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+	data, err := os.ReadFile(txPath)
+	if err != nil {
+		t.Fatalf("Failed to read tx CSV: %v", err)
+	}
+	if !strings.Contains(string(data), "0xaa") {
+		t.Errorf("Expected the tx row, got %q", data)
+	}
+}
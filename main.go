@@ -4,6 +4,12 @@ import (
 	"github.com/weiihann/chunk-analysis/cmd"
 )
 
+// Set by the Makefile
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+)
+
 func main() {
-	cmd.Execute()
+	cmd.Execute(Version, BuildTime)
 }